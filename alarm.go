@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+// --------------------------------------------------------------------
+// Size watermarks
+// --------------------------------------------------------------------
+
+type sizeAlarm struct {
+	high, low     int
+	onHigh, onLow func(size int)
+	raised        bool
+}
+
+// WithSizeAlarm calls onHigh once the number of entries reaches high and
+// onLow once it has dropped back to low. Each fires only once per
+// crossing: after onHigh, onHigh will not fire again until onLow has.
+// Either callback may be nil. Callbacks run after the map lock has been
+// released, on the goroutine that changed the size.
+func WithSizeAlarm(high, low int, onHigh, onLow func(size int)) Option {
+	return func(t *TimedMap) {
+		if low > high {
+			low = high
+		}
+		t.alarm = &sizeAlarm{high: high, low: low, onHigh: onHigh, onLow: onLow}
+	}
+}
+
+// checkSize fires the size alarm callbacks on watermark crossings.
+// Callers must hold mu.
+func (t *timedMap) checkSize() {
+	a := t.alarm
+	if a == nil {
+		return
+	}
+
+	size := len(t.items)
+	switch {
+	case !a.raised && size >= a.high:
+		a.raised = true
+		if a.onHigh != nil {
+			t.after(func() { a.onHigh(size) })
+		}
+	case a.raised && size <= a.low:
+		a.raised = false
+		if a.onLow != nil {
+			t.after(func() { a.onLow(size) })
+		}
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"bytes"
+	"sync"
+)
+
+// --------------------------------------------------------------------
+// Arena value storage
+// --------------------------------------------------------------------
+
+// arena packs the bytes of []byte values into large slabs. Each value
+// still has a small reference object, so this saves the allocation and
+// copying of the value bytes, not heap objects or GC scan work. Slab
+// memory is never reused: a slab is released to the GC once all of its
+// values are gone, so readers holding a reference can always copy it out
+// safely.
+type arena struct {
+	mu       sync.Mutex
+	slabSize int
+	cur      *slab
+	slabs    map[*slab]struct{}
+	bytes    uint64 // slab memory held
+	live     uint64 // bytes of live values
+}
+
+// slab is allocated at full length and only ever written past used, so
+// readers can copy values out of buf without holding the arena lock.
+type slab struct {
+	buf  []byte
+	used int // guarded by arena.mu
+	live int
+}
+
+// arenaRef is the stored form of an arena-backed value.
+type arenaRef struct {
+	slab *slab
+	off  int32
+	n    int32
+}
+
+// WithArena stores the bytes of []byte values in slabs of slabSize bytes
+// (1 MiB if slabSize <= 0) instead of as individual allocations. Values
+// are copied in on write and out on read; each one still takes a small
+// reference allocation. Values larger than a slab are stored normally,
+// and so are all values of maps using WithCompression or WithEncryption.
+// The space of removed or overwritten values is not reused: a slab is
+// only freed once every value in it is gone, so workloads that keep a
+// few long-lived values per slab can hold more memory than they use; see
+// the arena_bytes and arena_live_bytes stats.
+func WithArena(slabSize int) Option {
+	return func(t *TimedMap) {
+		if slabSize <= 0 {
+			slabSize = 1 << 20
+		}
+		t.arena = &arena{slabSize: slabSize, slabs: make(map[*slab]struct{})}
+	}
+}
+
+// alloc copies b into the arena, or returns nil if it does not fit in a
+// slab.
+func (a *arena) alloc(b []byte) *arenaRef {
+	if len(b) > a.slabSize {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.cur == nil || a.cur.used+len(b) > a.slabSize {
+		a.cur = &slab{buf: make([]byte, a.slabSize)}
+		a.slabs[a.cur] = struct{}{}
+		a.bytes += uint64(a.slabSize)
+	}
+	s := a.cur
+	ref := &arenaRef{slab: s, off: int32(s.used), n: int32(len(b))}
+	copy(s.buf[s.used:], b)
+	s.used += len(b)
+	s.live += len(b)
+	a.live += uint64(len(b))
+	return ref
+}
+
+// free releases v if it is an arena value.
+func (a *arena) free(v any) {
+	ref, ok := v.(*arenaRef)
+	if !ok {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := ref.slab
+	if _, held := a.slabs[s]; !held {
+		return // dropped by reset
+	}
+	s.live -= int(ref.n)
+	a.live -= uint64(ref.n)
+	if s.live == 0 && s != a.cur {
+		delete(a.slabs, s)
+		a.bytes -= uint64(a.slabSize)
+	}
+}
+
+// reset drops all slabs.
+func (a *arena) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.cur = nil
+	clear(a.slabs)
+	a.bytes, a.live = 0, 0
+}
+
+// stats returns the slab memory held and the bytes of live values.
+func (a *arena) stats() (held, live uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.bytes, a.live
+}
+
+// bytes returns a copy of the value.
+func (r *arenaRef) bytes() []byte {
+	return bytes.Clone(r.slab.buf[r.off : r.off+r.n])
+}
+
+// free releases the arena memory of a stored value. Callers must hold mu.
+func (t *timedMap) free(v any) {
+	if t.arena != nil {
+		t.arena.free(v)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Asynchronous writes
+// --------------------------------------------------------------------
+
+// asyncQueueSize bounds the writes queued by SetAsync; once it is full
+// SetAsync blocks until the applier catches up.
+const asyncQueueSize = 4096
+
+// asyncBatch is the most queued writes applied under one lock.
+const asyncBatch = 256
+
+type asyncWrite struct {
+	key, value any
+	exp        int64 // deadline as of the SetAsync call
+	done       func(err error)
+}
+
+type asyncWriter struct {
+	once sync.Once
+	ch   chan asyncWrite
+
+	mu     sync.RWMutex // held for reading while sending on ch
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// SetAsync queues a SetWithTTL for a background applier goroutine and
+// returns immediately, unless the queue is full. The TTL counts from the
+// call, not from when the write is applied. Queued writes are applied in
+// order and in batches under a single lock; done, if not nil, is called
+// once the write is visible, or with ErrFrozen or ErrClosed if it was
+// rejected. After Close, done is called right away with ErrClosed.
+func (t *timedMap) SetAsync(key, value any, ttl time.Duration, done func(err error)) {
+	exp := int64(ElementPermanent)
+	if ttl > 0 {
+		exp = t.ticks(t.now().Add(ttl))
+	}
+
+	a := &t.async
+	a.mu.RLock()
+	if a.closed {
+		a.mu.RUnlock()
+		if done != nil {
+			done(ErrClosed)
+		}
+		return
+	}
+
+	a.once.Do(func() {
+		a.ch = make(chan asyncWrite, asyncQueueSize)
+		a.wg.Add(1)
+		goLabeled(t.labels.async, func() { t.runApplier(a.ch) })
+	})
+	a.ch <- asyncWrite{key, value, exp, done}
+	a.mu.RUnlock()
+}
+
+// stopAsync applies the queued writes and stops the applier.
+func (t *timedMap) stopAsync() {
+	a := &t.async
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		if a.ch != nil {
+			close(a.ch)
+		}
+	}
+	a.mu.Unlock()
+	a.wg.Wait()
+}
+
+// runApplier applies queued writes until ch is closed.
+func (t *timedMap) runApplier(ch <-chan asyncWrite) {
+	defer t.async.wg.Done()
+
+	batch := make([]asyncWrite, 0, asyncBatch)
+	for w := range ch {
+		batch = append(batch[:0], w)
+	drain:
+		for len(batch) < asyncBatch {
+			select {
+			case w, ok := <-ch:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, w)
+			default:
+				break drain
+			}
+		}
+		t.applyAsync(batch)
+	}
+}
+
+// applyAsync applies one batch of writes and runs their callbacks.
+func (t *timedMap) applyAsync(batch []asyncWrite) {
+	for i := range batch {
+		batch[i].value = t.encode(batch[i].value)
+	}
+
+	var err error
+	t.lock()
+	for _, w := range batch {
+		if t.rejectWrite() {
+			err = t.writeErr()
+			t.free(w.value)
+			continue
+		}
+		t.set(w.key, w.value, w.exp)
+	}
+	t.unlock()
+
+	for i, w := range batch {
+		batch[i] = asyncWrite{}
+		if w.done != nil {
+			w.done(err)
+		}
+	}
+}
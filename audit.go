@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "time"
+
+// --------------------------------------------------------------------
+// Audit ring buffer
+// --------------------------------------------------------------------
+
+// Op is a mutation recorded by the audit log.
+type Op struct {
+	Type EventType
+	Key  any
+	At   time.Time
+}
+
+type auditRing struct {
+	ops  []Op
+	next int
+	full bool
+}
+
+func (r *auditRing) record(op Op) {
+	r.ops[r.next] = op
+	r.next++
+	if r.next == len(r.ops) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// WithAuditLog keeps the last n mutations in memory, queryable through
+// RecentOps.
+func WithAuditLog(n int) Option {
+	return func(t *TimedMap) {
+		if n > 0 {
+			t.audit = &auditRing{ops: make([]Op, n)}
+		}
+	}
+}
+
+// RecentOps returns up to n of the most recent mutations, oldest first.
+// It returns nil if the map was created without WithAuditLog.
+func (t *timedMap) RecentOps(n int) []Op {
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	r := t.audit
+	if r == nil || n <= 0 {
+		return nil
+	}
+
+	size := r.next
+	if r.full {
+		size = len(r.ops)
+	}
+	if n > size {
+		n = size
+	}
+
+	out := make([]Op, n)
+	start := r.next - n
+	if start < 0 {
+		start += len(r.ops)
+	}
+	for i := range out {
+		out[i] = r.ops[(start+i)%len(r.ops)]
+	}
+	return out
+}
@@ -0,0 +1,332 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Callback worker autoscaling
+// --------------------------------------------------------------------
+
+// WithCallbackAutoscale runs expiry callbacks on workers like
+// WithCallbackWorkers, starting with minWorkers, adding workers up to
+// maxWorkers while callbacks queue up and retiring them once the queue
+// has stayed empty for a second. It has no effect with
+// WithSerializedCallbacks or WithCallbackRouter, whose workers each own
+// a lane. The current number of workers is reported in the
+// "callback_workers" stat.
+func WithCallbackAutoscale(minWorkers, maxWorkers int) Option {
+	return func(t *TimedMap) {
+		p := t.callbackPool()
+		p.workers = max(minWorkers, 1)
+		p.maxWorkers = maxWorkers
+		if p.queueSize == 0 {
+			p.queueSize = defaultCallbackQueue
+		}
+	}
+}
+
+// callbackScaleEvery is how often the callback queue is checked, and
+// callbackScaleIdle how many checks in a row it must be found empty for
+// a worker to be retired.
+const (
+	callbackScaleEvery = 100 * time.Millisecond
+	callbackScaleIdle  = 10
+)
+
+// scale adds a worker whenever callbacks are queuing up and retires one
+// after the queue was empty for callbackScaleIdle checks in a row.
+func (p *callbackPool) scale() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(callbackScaleEvery)
+	defer ticker.Stop()
+
+	l := p.lanes[0]
+	lastWaits, idle := p.waits.Load(), 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+
+		depth, waits := len(l.queue)+len(l.urgent), p.waits.Load()
+		running := int(p.running.Load())
+		switch {
+		case (waits > lastWaits || depth > p.queueSize/2) && running < p.maxWorkers:
+			idle = 0
+			p.mu.RLock()
+			if !p.closed {
+				p.spawn(l)
+			}
+			p.mu.RUnlock()
+		case depth == 0 && running > p.workers:
+			if idle++; idle < callbackScaleIdle {
+				break
+			}
+			idle = 0
+			select {
+			case p.retire <- struct{}{}:
+			case <-p.stop:
+				return
+			}
+		default:
+			idle = 0
+		}
+		lastWaits = waits
+	}
+}
+
+// --------------------------------------------------------------------
+// Shard count autoscaling
+// --------------------------------------------------------------------
+
+// ErrFixedShards is returned by Resize on a ShardedMap created by
+// NewSharded, whose shard count is fixed.
+var ErrFixedShards = errors.New("temap: shard count is fixed")
+
+// ShardAutoscale configures NewAutoscaledSharded. Contention is measured
+// in lock acquisitions that had to wait, per shard and second.
+type ShardAutoscale struct {
+	Min, Max int           // bounds of the shard count
+	Every    time.Duration // how often contention is checked, 10s if zero
+	GrowAt   float64       // contention that doubles the shards, 1000 if zero
+	ShrinkAt float64       // contention that halves them, 10 if zero
+}
+
+// NewAutoscaledSharded creates a ShardedMap with cfg.Min shards that
+// doubles or halves its shard count within cfg.Min and cfg.Max as lock
+// contention rises and falls, see Resize. Its operations are slightly
+// slower than those of a fixed ShardedMap, as they have to coordinate
+// with resizing.
+func NewAutoscaledSharded(cfg ShardAutoscale, onExpire func(key, val any), opts ...Option) *ShardedMap {
+	cfg.Min = max(cfg.Min, 1)
+	cfg.Max = max(cfg.Max, cfg.Min)
+	if cfg.Every <= 0 {
+		cfg.Every = 10 * time.Second
+	}
+	if cfg.GrowAt <= 0 {
+		cfg.GrowAt = 1000
+	}
+	if cfg.ShrinkAt <= 0 {
+		cfg.ShrinkAt = 10
+	}
+
+	m := NewSharded(cfg.Min, onExpire, opts...)
+	m.elastic = true
+	m.stop = make(chan struct{})
+	m.wg.Add(1)
+	go m.autoscale(cfg)
+	return m
+}
+
+// autoscale resizes m by cfg until m is closed.
+func (m *ShardedMap) autoscale(cfg ShardAutoscale) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(cfg.Every)
+	defer ticker.Stop()
+
+	waits := func() (total uint64, n int) {
+		shards := m.layout.Load().shards
+		for _, s := range shards {
+			total += s.lockWaits.Load()
+		}
+		return total, len(shards)
+	}
+	last, _ := waits()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+		total, n := waits()
+		rate := float64(total-last) / float64(n) / cfg.Every.Seconds()
+		switch {
+		case rate > cfg.GrowAt && n < cfg.Max:
+			m.Resize(min(n*2, cfg.Max))
+		case rate < cfg.ShrinkAt && n > cfg.Min:
+			m.Resize(max(n/2, cfg.Min))
+		}
+		// New shards start counting from zero.
+		last, _ = waits()
+	}
+}
+
+// shardMoveChunk is how many entries Resize moves per lock acquisition.
+const shardMoveChunk = 256
+
+// Resize changes the number of shards of a map created by
+// NewAutoscaledSharded to n and returns once every entry has been moved
+// to the new shards. The map keeps serving meanwhile: entries are moved
+// in small batches, and operations look in both the old and the new
+// shards. Entries keep their deadlines; expiry callbacks for entries
+// still in old shards run as usual. Counters of the old shards are kept
+// in Stats.
+func (m *ShardedMap) Resize(n int) error {
+	if !m.elastic {
+		return ErrFixedShards
+	}
+	m.resize.Lock()
+	defer m.resize.Unlock()
+
+	cur := m.layout.Load()
+	n = max(n, 1)
+	if m.closed || n == len(cur.shards) {
+		return nil
+	}
+
+	next := &shardLayout{shards: m.newShards(n), old: cur.shards, seed: cur.seed}
+	m.moving.Lock()
+	m.layout.Store(next)
+	m.moving.Unlock()
+
+	for _, s := range next.old {
+		next.drain(s.timedMap)
+	}
+	// Moves skip the size alarms, see adopt; check them once now.
+	for _, s := range next.shards {
+		s.lock()
+		s.checkSize()
+		s.unlock()
+	}
+
+	// Switch layouts and retire the old counters at once, so that Stats
+	// sees each of them exactly once.
+	m.moving.Lock()
+	m.layout.Store(&shardLayout{shards: next.shards, seed: cur.seed})
+	m.retiredMu.Lock()
+	for _, s := range next.old {
+		for k, v := range s.Stats() {
+			if isCounter(k) {
+				m.retired[k] += v
+			}
+		}
+	}
+	m.retiredMu.Unlock()
+	m.moving.Unlock()
+
+	for _, s := range next.old {
+		s.Close()
+	}
+	return nil
+}
+
+// drain moves every entry of old to the current shards of l. The old
+// map is retired afterwards, so its size alarm is switched off.
+func (l *shardLayout) drain(old *timedMap) {
+	old.lock()
+	old.alarm = nil
+	old.unlock()
+
+	for {
+		old.lock()
+		n := 0
+		for _, el := range old.items {
+			if n == shardMoveChunk {
+				break
+			}
+			dst := l.shard(el.Key).timedMap
+			dst.lock()
+			dst.adopt(el)
+			dst.unlock()
+			old.delete(el)
+			n++
+		}
+		empty := len(old.items) == 0
+		old.unlock()
+
+		if empty {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// adopt inserts a copy of el, taken from another map with the same
+// options, unless its key exists. Callers must hold mu, and that of the
+// other map.
+func (t *timedMap) adopt(el *element) {
+	if _, ok := t.items[el.Key]; ok {
+		return
+	}
+	value := el.Value
+	if ref, ok := value.(*arenaRef); ok {
+		value = t.encode(ref.bytes())
+	}
+	// A move is not a write: no events or size alarms, and the old
+	// shard's counters already include the entry.
+	audit, alarm, pending, added, permanent := t.audit, t.alarm, len(t.pending), t.stats.added, t.stats.permanent
+	t.audit, t.alarm = nil, nil
+	t.set(el.Key, value, el.ExpiresAt)
+	t.audit, t.alarm, t.pending, t.stats.added, t.stats.permanent = audit, alarm, t.pending[:pending], added, permanent
+
+	nel := t.items[el.Key]
+	nel.createdAt, nel.ttl = el.createdAt, el.ttl
+	nel.priority, nel.silent, nel.stale = el.priority, el.silent, el.stale
+	if nel.class != nil {
+		nel.class.added--
+	}
+
+	// Take over the context watch and the refresher, so that deleting el
+	// from the old map does not stop them. A context that ended
+	// meanwhile expires nel at once.
+	if tie := el.tie; tie != nil {
+		el.tie = nil
+		tie.stop()
+		t.tie(nel, tie.ctx)
+	}
+	if job := el.refresh; job != nil {
+		el.refresh = nil
+		job.timer.Stop()
+		t.startRefresh(nel, job.fn, job.every)
+	}
+}
+
+// evictOld drops key from the old shard it may still be in, so that a
+// write to the new shard is not shadowed by it. Entries only move from
+// old to new shards, so afterwards the key can be in neither.
+func (l *shardLayout) evictOld(key any) {
+	if l.old == nil {
+		return
+	}
+	t := l.oldShard(key).timedMap
+	t.lock()
+	defer t.unlock()
+	if el, ok := t.items[key]; ok {
+		t.delete(el)
+	}
+}
+
+// isCounter reports whether the stat k only ever grows, as opposed to
+// gauges such as sizes, which Resize drops with their shard.
+func isCounter(k string) bool {
+	switch k {
+	case "expire_queue_depth", "precision_ns", "callback_workers",
+		"lock_wait_write_ns_max", "lock_wait_read_ns_max":
+		return false
+	}
+	return !strings.HasPrefix(k, "current") && !strings.HasSuffix(k, ".current") &&
+		!strings.HasPrefix(k, "arena_")
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"fmt"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Expiry backends
+// --------------------------------------------------------------------
+
+// Backend selects how a TimedMap finds and fires due entries.
+type Backend uint8
+
+const (
+	// BackendHeap uses a min-heap drained by a dedicated cleaner
+	// goroutine. It is the default and scales to any number of entries.
+	BackendHeap Backend = iota
+	// BackendTimers arms one time.AfterFunc per temporary entry and runs
+	// no cleaner goroutine, which is cheaper for maps with few entries.
+	BackendTimers
+	// BackendWheel uses a hashed timing wheel with O(1) inserts and
+	// removals; deadlines are resolved to the wheel's tick.
+	BackendWheel
+	// BackendBucket groups deadlines into fixed-width buckets ordered by
+	// a small heap, which suits many entries sharing few distinct TTLs.
+	BackendBucket
+)
+
+// String returns the name of the backend.
+func (b Backend) String() string {
+	switch b {
+	case BackendHeap:
+		return "heap"
+	case BackendTimers:
+		return "timers"
+	case BackendWheel:
+		return "wheel"
+	case BackendBucket:
+		return "bucket"
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (b Backend) MarshalText() ([]byte, error) {
+	if b > BackendBucket {
+		return nil, fmt.Errorf("temap: unknown backend %d", b)
+	}
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the names
+// returned by String.
+func (b *Backend) UnmarshalText(text []byte) error {
+	for c := BackendHeap; c <= BackendBucket; c++ {
+		if c.String() == string(text) {
+			*b = c
+			return nil
+		}
+	}
+	return fmt.Errorf("temap: unknown backend %q", text)
+}
+
+// WithBackend selects the expiry backend. The public API behaves the
+// same with every backend.
+func WithBackend(b Backend) Option {
+	return func(t *TimedMap) {
+		t.backend = b
+	}
+}
+
+// WithBackendResolution sets the tick width of BackendWheel and the
+// bucket width of BackendBucket (default 10ms). The wheel has slots
+// ticks per rotation; slots <= 0 keeps the default of 1024.
+func WithBackendResolution(res time.Duration, slots int) Option {
+	return func(t *TimedMap) {
+		t.backendRes = res
+		t.wheelSlots = slots
+	}
+}
+
+// defaultBackendResolution is the wheel tick and bucket width used when
+// WithBackendResolution is not given.
+const defaultBackendResolution = 10 * time.Millisecond
+
+// newScheduler builds the scheduler for the configured backend. It runs
+// after all options, once the deadline unit is known.
+func (t *timedMap) newScheduler() expiryScheduler {
+	res := t.backendRes
+	if res <= 0 {
+		res = defaultBackendResolution
+	}
+	resUnits := max(int64(res)/t.unit, 1)
+
+	switch t.backend {
+	case BackendTimers:
+		return &timerScheduler{
+			els:  make(map[*element]struct{}),
+			unit: t.unit,
+			wake: t.timerFired,
+		}
+	case BackendWheel:
+		return newWheelScheduler(resUnits, t.wheelSlots, t.nowTicks())
+	case BackendBucket:
+		return newBucketScheduler(resUnits)
+	}
+	return &heapScheduler{}
+}
+
+// --------------------------------------------------------------------
+// Per-key timer scheduler
+// --------------------------------------------------------------------
+
+// timerScheduler arms one timer per element. Fired timers queue their
+// element and wake the map, which then sweeps as the cleaner would.
+type timerScheduler struct {
+	els  map[*element]struct{}
+	unit int64
+	wake func()
+
+	firedMu sync.Mutex
+	fired   []*element // may hold stale or duplicate elements
+}
+
+func (s *timerScheduler) add(el *element) {
+	s.els[el] = struct{}{}
+	s.arm(el)
+}
+
+func (s *timerScheduler) update(el *element) {
+	s.arm(el)
+}
+
+func (s *timerScheduler) cancel(el *element) {
+	delete(s.els, el)
+	if el.timer != nil {
+		el.timer.Stop()
+		el.timer = nil
+	}
+}
+
+func (s *timerScheduler) arm(el *element) {
+	d := time.Until(time.Unix(0, el.ExpiresAt*s.unit))
+	if el.timer != nil && el.timer.Stop() {
+		el.timer.Reset(d)
+		return
+	}
+	el.timer = time.AfterFunc(d, func() {
+		s.firedMu.Lock()
+		s.fired = append(s.fired, el)
+		s.firedMu.Unlock()
+		s.wake()
+	})
+}
+
+func (s *timerScheduler) next() (int64, bool) {
+	s.firedMu.Lock()
+	defer s.firedMu.Unlock()
+
+	best, ok := int64(0), false
+	for _, el := range s.fired {
+		if _, live := s.els[el]; live && (!ok || el.ExpiresAt < best) {
+			best, ok = el.ExpiresAt, true
+		}
+	}
+	return best, ok
+}
+
+func (s *timerScheduler) popDue(now int64, limit int) []*element {
+	s.firedMu.Lock()
+	defer s.firedMu.Unlock()
+
+	var due []*element
+	keep := s.fired[:0]
+	for _, el := range s.fired {
+		if _, live := s.els[el]; !live {
+			continue // cancelled since it fired
+		}
+		if el.ExpiresAt > now {
+			s.arm(el) // deadline moved, or the timer beat the clock
+			continue
+		}
+		if limit == 0 {
+			keep = append(keep, el)
+			continue
+		}
+		delete(s.els, el)
+		el.timer = nil
+		due = append(due, el)
+		limit--
+	}
+	clear(s.fired[len(keep):])
+	s.fired = keep
+	return due
+}
+
+func (s *timerScheduler) len() int { return len(s.els) }
+
+func (s *timerScheduler) holds(el *element) bool {
+	_, ok := s.els[el]
+	return ok
+}
+
+func (s *timerScheduler) each(fn func(el *element) bool) {
+	for el := range s.els {
+		if !fn(el) {
+			return
+		}
+	}
+}
+
+func (s *timerScheduler) reset() {
+	for el := range s.els {
+		if el.timer != nil {
+			el.timer.Stop()
+			el.timer = nil
+		}
+	}
+	clear(s.els)
+
+	s.firedMu.Lock()
+	s.fired = nil
+	s.firedMu.Unlock()
+}
+
+// timerFired expires whatever is due when a per-key timer goes off.
+func (t *timedMap) timerFired() {
+	if !t.cleanerAlive.Load() {
+		return
+	}
+	pprof.SetGoroutineLabels(t.labels.cleaner)
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.cleanerPanics.Add(1)
+			t.logf("temap: expiry timer panic: %v", r)
+		}
+	}()
+	t.sweep(-1)
+}
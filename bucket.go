@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"container/heap"
+	"fmt"
+)
+
+// --------------------------------------------------------------------
+// Bucket scheduler
+// --------------------------------------------------------------------
+
+// bucketScheduler groups elements into buckets of width deadline units
+// and keeps a min-heap of bucket keys. Entries with close deadlines share
+// a bucket, so the heap stays small and a whole bucket expires at once.
+type bucketScheduler struct {
+	width   int64
+	buckets map[int64][]*element
+	keys    keyHeap // may hold keys of buckets that have since emptied
+	n       int
+}
+
+func newBucketScheduler(width int64) *bucketScheduler {
+	if width <= 0 {
+		width = 1
+	}
+	return &bucketScheduler{width: width, buckets: make(map[int64][]*element)}
+}
+
+func (s *bucketScheduler) add(el *element) {
+	k := el.ExpiresAt / s.width
+	b, ok := s.buckets[k]
+	if !ok {
+		heap.Push(&s.keys, k)
+	}
+	el.slot = k
+	el.index = len(b)
+	s.buckets[k] = append(b, el)
+	s.n++
+}
+
+func (s *bucketScheduler) update(el *element) {
+	s.cancel(el)
+	s.add(el)
+}
+
+func (s *bucketScheduler) cancel(el *element) {
+	if el.index < 0 {
+		return
+	}
+	b := s.buckets[el.slot]
+	last := len(b) - 1
+	b[el.index] = b[last]
+	b[el.index].index = el.index
+	b[last] = nil
+	if last == 0 {
+		delete(s.buckets, el.slot)
+	} else {
+		s.buckets[el.slot] = b[:last]
+	}
+	el.index = -1
+	s.n--
+}
+
+// first drops stale keys and returns the key of the earliest bucket.
+func (s *bucketScheduler) first() (int64, bool) {
+	for len(s.keys) > 0 {
+		if _, ok := s.buckets[s.keys[0]]; ok {
+			return s.keys[0], true
+		}
+		heap.Pop(&s.keys)
+	}
+	return 0, false
+}
+
+func (s *bucketScheduler) next() (int64, bool) {
+	k, ok := s.first()
+	if !ok {
+		return 0, false
+	}
+	best := s.buckets[k][0].ExpiresAt
+	for _, el := range s.buckets[k] {
+		best = min(best, el.ExpiresAt)
+	}
+	return best, true
+}
+
+func (s *bucketScheduler) popDue(now int64, limit int) []*element {
+	var due []*element
+	for limit != 0 {
+		k, ok := s.first()
+		if !ok || k*s.width > now {
+			break
+		}
+
+		b := s.buckets[k]
+		for j := 0; j < len(b) && limit != 0; {
+			el := b[j]
+			if el.ExpiresAt > now {
+				j++
+				continue
+			}
+			s.cancel(el) // moves the last element into j
+			b = s.buckets[k]
+			due = append(due, el)
+			limit--
+		}
+		if len(b) > 0 && limit != 0 {
+			break // the current bucket is only partly due
+		}
+	}
+	return due
+}
+
+func (s *bucketScheduler) len() int { return s.n }
+
+func (s *bucketScheduler) holds(el *element) bool {
+	if el.index < 0 {
+		return false
+	}
+	b := s.buckets[el.slot]
+	return el.index < len(b) && b[el.index] == el
+}
+
+// check verifies that every element knows its bucket and that n counts
+// them.
+func (s *bucketScheduler) check() error {
+	n := 0
+	for k, b := range s.buckets {
+		for j, el := range b {
+			if el.slot != k || el.index != j {
+				return fmt.Errorf("bucket %d/%d holds key %v, which thinks it is at %d/%d", k, j, el.Key, el.slot, el.index)
+			}
+		}
+		n += len(b)
+	}
+	if n != s.n {
+		return fmt.Errorf("buckets hold %d elements but count %d", n, s.n)
+	}
+	return nil
+}
+
+func (s *bucketScheduler) each(fn func(el *element) bool) {
+	for _, b := range s.buckets {
+		for _, el := range b {
+			if !fn(el) {
+				return
+			}
+		}
+	}
+}
+
+func (s *bucketScheduler) reset() {
+	for _, b := range s.buckets {
+		for _, el := range b {
+			el.index = -1
+		}
+	}
+	clear(s.buckets)
+	s.keys = s.keys[:0]
+	s.n = 0
+}
+
+// keyHeap is a min-heap of bucket keys.
+type keyHeap []int64
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i] < h[j] }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x any)        { *h = append(*h, x.(int64)) }
+func (h *keyHeap) Pop() any {
+	old := *h
+	k := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return k
+}
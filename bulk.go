@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"context"
+	"strings"
+)
+
+// --------------------------------------------------------------------
+// Bulk removal and key matching
+// --------------------------------------------------------------------
+
+// RemoveMatching removes every entry for which pred returns true, under a
+// single lock, and returns the number removed. pred sees decoded values
+// and must not call back into the map.
+func (t *timedMap) RemoveMatching(pred func(key, value any) bool) int {
+	n, _ := t.RemoveMatchingCtx(context.Background(), pred)
+	return n
+}
+
+// ctxCheckEvery is how many entries a locked walk visits between checks
+// of its context.
+const ctxCheckEvery = 256
+
+// ctxChecker returns a function for locked walks to call on every entry,
+// which returns ctx.Err() on every ctxCheckEvery-th call, starting with
+// the first.
+func ctxChecker(ctx context.Context) func() error {
+	seen := 0
+	return func() error {
+		seen++
+		if (seen-1)%ctxCheckEvery != 0 {
+			return nil
+		}
+		return ctx.Err()
+	}
+}
+
+// RemoveMatchingCtx is RemoveMatching, except that it stops once ctx is
+// done and returns the number removed so far along with ctx.Err().
+func (t *timedMap) RemoveMatchingCtx(ctx context.Context, pred func(key, value any) bool) (int, error) {
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		return 0, t.writeErr()
+	}
+
+	defer t.batch()()
+
+	n, check := 0, ctxChecker(ctx)
+	for k, el := range t.items {
+		if err := check(); err != nil {
+			return n, err
+		}
+		if !pred(k, t.decode(el.Value)) {
+			continue
+		}
+		t.delete(el)
+		t.countRemoved(el)
+		t.notify(EventDel, el)
+		n++
+	}
+	return n, nil
+}
+
+// RemoveByPrefix removes every string key starting with prefix and
+// returns the number removed. With WithPrefixIndex only the matching
+// keys are visited.
+func (t *timedMap) RemoveByPrefix(prefix string) int {
+	n, _ := t.RemoveByPrefixCtx(context.Background(), prefix)
+	return n
+}
+
+// RemoveByPrefixCtx is RemoveByPrefix, except that it stops once ctx is
+// done and returns the number removed so far along with ctx.Err().
+func (t *timedMap) RemoveByPrefixCtx(ctx context.Context, prefix string) (int, error) {
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		return 0, t.writeErr()
+	}
+
+	defer t.batch()()
+
+	var els []*element
+	var err error
+	check := ctxChecker(ctx)
+	if t.index != nil {
+		t.index.ascend(prefix, func(key string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			if err = check(); err != nil {
+				return false
+			}
+			els = append(els, t.items[key])
+			return true
+		})
+	} else {
+		for k, el := range t.items {
+			if err = check(); err != nil {
+				break
+			}
+			if s, ok := k.(string); ok && strings.HasPrefix(s, prefix) {
+				els = append(els, el)
+			}
+		}
+	}
+
+	for _, el := range els {
+		t.delete(el)
+		t.countRemoved(el)
+		t.notify(EventDel, el)
+	}
+	return len(els), err
+}
+
+// KeysMatching returns the string keys matching pattern, with Redis KEYS
+// glob syntax: '*', '?', character classes such as "[a-z]" or "[^0-9]",
+// and '\' to escape. With WithPrefixIndex only keys sharing the
+// pattern's literal prefix are visited. Meant for admin tooling; it
+// holds the read lock for the whole walk, see Scan for large maps.
+func (t *timedMap) KeysMatching(pattern string) []any {
+	keys, _ := t.KeysMatchingCtx(context.Background(), pattern)
+	return keys
+}
+
+// KeysMatchingCtx is KeysMatching, except that it stops once ctx is done
+// and returns the keys matched so far along with ctx.Err().
+func (t *timedMap) KeysMatchingCtx(ctx context.Context, pattern string) ([]any, error) {
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	var keys []any
+	var err error
+	check := ctxChecker(ctx)
+	if t.index != nil {
+		prefix := globPrefix(pattern)
+		t.index.ascend(prefix, func(key string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			if err = check(); err != nil {
+				return false
+			}
+			if globMatch(pattern, key) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		return keys, err
+	}
+
+	for k := range t.items {
+		if err = check(); err != nil {
+			break
+		}
+		if s, ok := k.(string); ok && globMatch(pattern, s) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, err
+}
@@ -0,0 +1,491 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"context"
+	"hash/maphash"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Expiry callback dispatch
+// --------------------------------------------------------------------
+
+// HeapLen returns the number of entries waiting in the expiry scheduler,
+// whatever the backend.
+func (t *timedMap) HeapLen() int {
+	return t.CountTemporary()
+}
+
+// ExpireQueueDepth returns the number of expiry callbacks that have been
+// dispatched but not finished yet. Together with PendingExpirations it
+// shows how far expiry processing is behind.
+func (t *timedMap) ExpireQueueDepth() int {
+	return int(t.inflight.Load())
+}
+
+// callbackPool runs expiry callbacks on a fixed set of workers fed by
+// bounded queues. Workers either share one lane, or, with a router, each
+// worker owns a lane and every key is routed to the same lane.
+type callbackPool struct {
+	workers   int
+	queueSize int
+	router    func(key any) uint64 // nil to share one lane
+	partition func(key any) string // see WithFairCallbacks
+	fair      *fairQueue           // replaces the lanes with a partition
+	lanes     []lane
+	space     chan struct{} // signalled when a worker takes a job
+	labels    context.Context
+
+	maxBlock time.Duration // see WithBackpressure
+	overflow atomic.Uint64 // jobs run on their own goroutine
+	waits    atomic.Uint64 // writers and dispatches that had to wait
+
+	maxWorkers int           // see WithCallbackAutoscale
+	running    atomic.Int32  // live workers
+	retire     chan struct{} // a worker that receives from it exits
+	stop       chan struct{} // closed by close, stops the scaler
+
+	mu     sync.RWMutex // held for reading while sending on a lane
+	closed bool
+	wg     sync.WaitGroup
+
+	once    sync.Once   // runs start, see ensureStarted
+	started atomic.Bool // start has run
+}
+
+// lane is a pair of job queues served by the same workers.
+type lane struct {
+	queue  chan func()
+	urgent chan func() // PriorityHigh callbacks, taken first
+}
+
+// WithCallbackWorkers runs expiry callbacks on workers goroutines fed by
+// a queue of queueSize, instead of one goroutine per callback. When the
+// queue is full a callback gets its own goroutine, unless
+// WithBackpressure is used.
+func WithCallbackWorkers(workers, queueSize int) Option {
+	return func(t *TimedMap) {
+		p := t.callbackPool()
+		p.workers = max(workers, 1)
+		p.queueSize = max(queueSize, 0)
+	}
+}
+
+// WithBackpressure makes a full callback queue (see WithCallbackWorkers)
+// slow the map down instead of spawning goroutines: the cleaner waits up
+// to maxBlock for room before handing a callback over, and SetTemporary,
+// SetWithTTL and SetPermanent wait up to maxBlock before writing.
+// Callbacks are never dropped; one that still finds no room after
+// maxBlock runs on its own goroutine and is counted in the
+// "callback_overflow" stat.
+func WithBackpressure(maxBlock time.Duration) Option {
+	return func(t *TimedMap) {
+		t.callbackPool().maxBlock = maxBlock
+	}
+}
+
+// WithSerializedCallbacks guarantees that expiry callbacks for the same
+// key never run concurrently and start in expiry order, by routing each
+// key to one worker by its hash, which treats keys as == does: pointer
+// keys by address, whatever they point to. It implies WithCallbackWorkers with
+// one worker per CPU unless that option is given too. A full worker
+// queue then always blocks the cleaner instead of spawning a goroutine,
+// whatever WithBackpressure says.
+func WithSerializedCallbacks() Option {
+	return func(t *TimedMap) {
+		seed := maphash.MakeSeed()
+		t.callbackPool().router = func(key any) uint64 { return hashKey(seed, key) }
+	}
+}
+
+// WithCallbackRouter is WithSerializedCallbacks with route choosing the
+// worker instead of the key hash: keys for which route returns the same
+// value are handled by the same worker, one at a time and in expiry
+// order. Routing by tenant or key prefix, for example, gives per-tenant
+// ordering.
+func WithCallbackRouter(route func(key any) uint64) Option {
+	return func(t *TimedMap) {
+		if route != nil {
+			t.callbackPool().router = route
+		}
+	}
+}
+
+// WorkerPool is a bounded callback worker pool that several maps can
+// share, centralizing the concurrency limit of expiry callbacks, see
+// WithWorkerPool.
+type WorkerPool struct {
+	p *callbackPool
+}
+
+// NewWorkerPool starts workers goroutines fed by a queue of queueSize.
+// A full queue blocks the map handing over a callback for up to maxBlock,
+// as with WithBackpressure; zero means no blocking.
+func NewWorkerPool(workers, queueSize int, maxBlock time.Duration) *WorkerPool {
+	p := &callbackPool{
+		workers:   max(workers, 1),
+		queueSize: max(queueSize, 0),
+		maxBlock:  maxBlock,
+		labels:    newGoroutineLabels("").callback,
+	}
+	p.ensureStarted()
+	return &WorkerPool{p: p}
+}
+
+// WithWorkerPool runs the map's expiry callbacks on w. The other callback
+// options are ignored for the map, and closing it leaves w running.
+func WithWorkerPool(w *WorkerPool) Option {
+	return func(t *TimedMap) {
+		t.shared = w
+	}
+}
+
+// WithSyncCallbacks runs expiry callbacks inline instead of on other
+// goroutines: the cleaner calls them itself, one at a time and in
+// deadline order, once it has released the lock. Priorities and the
+// other callback options have no effect. This trades throughput for
+// determinism: a slow callback delays every later expiry, and one that
+// panics restarts the cleaner. A callback may stop, restart or close the
+// map, as StopCleaner and Close do not wait for the callbacks the
+// cleaner has started: its goroutine exits once they have returned.
+// Callbacks of entries removed by the caller, as by Flush, run on the
+// caller's goroutine, and with BackendTimers on the timer's goroutine.
+func WithSyncCallbacks() Option {
+	return func(t *TimedMap) {
+		t.inline = true
+	}
+}
+
+// Stats returns the pool's counters: "queued" callbacks waiting for a
+// worker, "callback_overflow" and "backpressure_waits" as in
+// TimedMap.Stats.
+func (w *WorkerPool) Stats() map[string]uint64 {
+	queued := 0
+	for _, l := range w.p.lanes {
+		queued += len(l.queue) + len(l.urgent)
+	}
+	if w.p.fair != nil {
+		queued += w.p.fair.len()
+	}
+	return map[string]uint64{
+		"queued":             uint64(queued),
+		"callback_overflow":  w.p.overflow.Load(),
+		"backpressure_waits": w.p.waits.Load(),
+	}
+}
+
+// Close stops the workers once the queued callbacks have run. Close the
+// pool after the maps using it.
+func (w *WorkerPool) Close() {
+	w.p.close()
+}
+
+// callbackPool returns the pool configured by the callback options,
+// creating it on first use.
+func (t *timedMap) callbackPool() *callbackPool {
+	if t.pool == nil {
+		t.pool = &callbackPool{}
+	}
+	return t.pool
+}
+
+// start creates the lanes and starts the workers, if any were
+// configured.
+func (p *callbackPool) start() {
+	if (p.router != nil || p.partition != nil) && p.workers == 0 {
+		p.workers, p.queueSize = runtime.NumCPU(), defaultCallbackQueue
+	}
+	if p.workers == 0 {
+		return
+	}
+	if p.partition != nil {
+		if p.queueSize == 0 {
+			p.queueSize = defaultCallbackQueue
+		}
+		p.fair = newFairQueue(p.queueSize)
+		p.space = make(chan struct{}, 1)
+		for i := 0; i < p.workers; i++ {
+			p.wg.Add(1)
+			p.running.Add(1)
+			goLabeled(p.labels, p.workFair)
+		}
+		return
+	}
+
+	n := 1
+	if p.router != nil {
+		n = p.workers
+	}
+	p.lanes = make([]lane, n)
+	for i := range p.lanes {
+		p.lanes[i] = lane{
+			queue:  make(chan func(), p.queueSize),
+			urgent: make(chan func(), p.queueSize),
+		}
+	}
+	p.space = make(chan struct{}, 1)
+	scaled := p.router == nil && p.maxWorkers > p.workers
+	if scaled {
+		p.retire, p.stop = make(chan struct{}), make(chan struct{})
+	}
+
+	for i := 0; i < p.workers; i++ {
+		p.spawn(p.lanes[i%n])
+	}
+	if scaled {
+		p.wg.Add(1)
+		goLabeled(p.labels, p.scale)
+	}
+}
+
+// ensureStarted runs start unless it has run, or close has, before.
+// Lazy maps start their pool with the first callback, see
+// WithLazyCleaner.
+func (p *callbackPool) ensureStarted() {
+	p.once.Do(func() {
+		p.start()
+		p.started.Store(true)
+	})
+}
+
+// spawn starts a worker serving l.
+func (p *callbackPool) spawn(l lane) {
+	p.wg.Add(1)
+	p.running.Add(1)
+	goLabeled(p.labels, func() { p.work(l) })
+}
+
+// defaultCallbackQueue is the per-worker queue size used by
+// WithSerializedCallbacks without WithCallbackWorkers, and the queue size
+// of WithFairCallbacks without one.
+const defaultCallbackQueue = 1024
+
+func (p *callbackPool) work(l lane) {
+	defer p.wg.Done()
+	defer p.running.Add(-1)
+
+	queue, urgent := l.queue, l.urgent
+	for queue != nil || urgent != nil {
+		var job func()
+		var ok bool
+		select {
+		case job, ok = <-urgent:
+			if !ok {
+				urgent = nil
+				continue
+			}
+		default:
+			select {
+			case job, ok = <-urgent:
+				if !ok {
+					urgent = nil
+					continue
+				}
+			case job, ok = <-queue:
+				if !ok {
+					queue = nil
+					continue
+				}
+			case <-p.retire:
+				return
+			}
+		}
+
+		select {
+		case p.space <- struct{}{}:
+		default:
+		}
+		job()
+	}
+}
+
+// full reports whether any normal queue has no room.
+func (p *callbackPool) full() bool {
+	if p.fair != nil {
+		return p.fair.len() >= p.queueSize
+	}
+	for _, l := range p.lanes {
+		if len(l.queue) == cap(l.queue) {
+			return true
+		}
+	}
+	return false
+}
+
+// submit queues job for key, on the urgent queue if urgent is set. It
+// waits up to maxBlock for room and falls back to running job on its own
+// goroutine; with a router it waits as long as it takes.
+func (p *callbackPool) submit(key any, job func(), urgent bool) {
+	p.ensureStarted()
+	if p.lanes == nil && p.fair == nil {
+		goLabeled(p.labels, job)
+		return
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.fair != nil && !p.closed {
+		p.submitFair(key, job, urgent)
+		return
+	}
+	if p.closed {
+		if p.router != nil && p.fair == nil {
+			job() // keep per-key order
+			return
+		}
+		p.overflow.Add(1)
+		goLabeled(p.labels, job)
+		return
+	}
+
+	l := p.lanes[0]
+	if p.router != nil {
+		l = p.lanes[p.router(key)%uint64(len(p.lanes))]
+	}
+	queue := l.queue
+	if urgent {
+		queue = l.urgent
+	}
+
+	select {
+	case queue <- job:
+		return
+	default:
+	}
+	p.waits.Add(1)
+	if p.router != nil {
+		queue <- job
+		return
+	}
+	if p.maxBlock > 0 {
+		timer := time.NewTimer(p.maxBlock)
+		defer timer.Stop()
+		select {
+		case queue <- job:
+			return
+		case <-timer.C:
+		}
+	}
+	p.overflow.Add(1)
+	goLabeled(p.labels, job)
+}
+
+// throttle blocks a writer for up to maxBlock while a queue is full.
+func (p *callbackPool) throttle() {
+	if p.maxBlock <= 0 || !p.started.Load() || !p.full() {
+		return
+	}
+	p.waits.Add(1)
+	timer := time.NewTimer(p.maxBlock)
+	defer timer.Stop()
+	for p.full() {
+		select {
+		case <-p.space:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// close stops the workers once the queued callbacks have run.
+func (p *callbackPool) close() {
+	p.once.Do(func() {}) // never start after closing
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		if p.stop != nil {
+			close(p.stop)
+		}
+		for _, l := range p.lanes {
+			close(l.queue)
+			close(l.urgent)
+		}
+		if p.fair != nil {
+			p.fair.close()
+		}
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// dispatch runs the expiry callback for key, on the worker pool if there
+// is one and on its own goroutine otherwise. value is in stored form and
+// is decoded by the callback goroutine.
+func (t *timedMap) dispatch(key, value any, prio Priority) {
+	t.dispatchTo(t.onExpire, key, value, prio)
+}
+
+// dispatchTo is dispatch for callback fn.
+func (t *timedMap) dispatchTo(fn func(key, value any), key, value any, prio Priority) {
+	t.inflight.Add(1)
+	job := func() {
+		defer t.inflight.Add(-1)
+		if t.slowAfter > 0 {
+			defer t.watchCallback(key)()
+		}
+		fn(key, t.decode(value))
+	}
+	switch {
+	case t.inline:
+		job()
+	case t.pool != nil:
+		t.pool.submit(key, job, prio == PriorityHigh)
+	default:
+		goLabeled(t.labels.callback, job)
+	}
+}
+
+// WithSlowCallbackThreshold reports expiry callbacks that run longer
+// than threshold: each one is logged with its key as soon as it crosses
+// threshold, again with its total time when it returns, and counted in
+// the "slow_callbacks" stat. A single slow callback can starve a small
+// worker pool, see WithCallbackWorkers.
+func WithSlowCallbackThreshold(threshold time.Duration) Option {
+	return func(t *TimedMap) {
+		if threshold > 0 {
+			t.slowAfter = threshold
+		}
+	}
+}
+
+// watchCallback starts watching the expiry callback for key and returns
+// a func to call when it returns.
+func (t *timedMap) watchCallback(key any) (done func()) {
+	start := time.Now()
+	timer := time.AfterFunc(t.slowAfter, func() {
+		t.slowCallbacks.Add(1)
+		t.logf("temap: expiry callback for key %v still running after %v", key, t.slowAfter)
+	})
+	return func() {
+		if !timer.Stop() {
+			t.logf("temap: slow expiry callback for key %v took %v", key, time.Since(start))
+		}
+	}
+}
+
+// throttle applies backpressure to writers, see WithBackpressure.
+func (t *timedMap) throttle() {
+	if t.pool != nil {
+		t.pool.throttle()
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+// --------------------------------------------------------------------
+// Capacity management
+// --------------------------------------------------------------------
+
+// WithCapacity pre-sizes the map and expiry heap for n entries.
+func WithCapacity(n int) Option {
+	return func(t *TimedMap) {
+		t.capacity = max(n, 0)
+	}
+}
+
+// Cap returns an estimate of how many entries the map can hold before
+// it has to grow again. Go maps never shrink, so this is the larger of
+// the reserved capacity and the peak size seen since the last RemoveAll.
+func (t *timedMap) Cap() int {
+	t.rlock()
+	defer t.mu.RUnlock()
+	return max(t.capacity, t.peak)
+}
+
+// Reserve pre-grows the map and expiry heap so that at least n entries
+// fit without rehashing or slice growth. It is a no-op if Cap is already
+// n or more.
+func (t *timedMap) Reserve(n int) {
+	t.lock()
+	defer t.unlock()
+	t.reserve(n)
+}
+
+// reserve grows the backing storage to n entries. Callers must hold mu.
+func (t *timedMap) reserve(n int) {
+	if n <= max(t.capacity, t.peak) {
+		return
+	}
+
+	items := make(map[any]*element, n)
+	for k, el := range t.items {
+		items[k] = el
+	}
+	t.items = items
+	if g, ok := t.sched.(growableScheduler); ok {
+		g.grow(n)
+	}
+	t.capacity = n
+}
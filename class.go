@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"sort"
+	"strings"
+)
+
+// --------------------------------------------------------------------
+// Per-class statistics
+// --------------------------------------------------------------------
+
+// classStats holds the counters of one key class, see WithKeyClassifier.
+type classStats struct {
+	added   uint64
+	removed uint64
+	expired uint64
+	current uint64
+}
+
+// WithKeyClassifier breaks Stats down by key class. classify names the
+// class of a key, or returns "" to leave it out; it runs under the map's
+// lock when a key is inserted, so it must be cheap, must not call back
+// into the map, and should return few distinct names. For each class
+// Stats reports "class.<name>.added", ".removed", ".expired" and
+// ".current".
+func WithKeyClassifier(classify func(key any) string) Option {
+	return func(t *TimedMap) {
+		t.classify = classify
+	}
+}
+
+// ClassifyByPrefix returns a classifier for WithKeyClassifier that puts
+// string keys in the class of the longest of prefixes they start with.
+func ClassifyByPrefix(prefixes ...string) func(key any) string {
+	sorted := append([]string(nil), prefixes...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	return func(key any) string {
+		s, ok := key.(string)
+		if !ok {
+			return ""
+		}
+		for _, p := range sorted {
+			if strings.HasPrefix(s, p) {
+				return p
+			}
+		}
+		return ""
+	}
+}
+
+// classOf returns the counters of key's class, or nil if key has none.
+// Callers must hold mu.
+func (t *timedMap) classOf(key any) *classStats {
+	if t.classify == nil {
+		return nil
+	}
+	name := t.classify(key)
+	if name == "" {
+		return nil
+	}
+	c, ok := t.classes[name]
+	if !ok {
+		if t.classes == nil {
+			t.classes = make(map[string]*classStats)
+		}
+		c = &classStats{}
+		t.classes[name] = c
+	}
+	return c
+}
+
+// countRemoved counts el as removed. Callers must hold mu.
+func (t *timedMap) countRemoved(el *element) {
+	t.stats.removed++
+	if el.class != nil {
+		el.class.removed++
+	}
+}
+
+// countExpired counts el as expired. Callers must hold mu.
+func (t *timedMap) countExpired(el *element) {
+	t.stats.expired++
+	if el.class != nil {
+		el.class.expired++
+	}
+}
+
+// classStatsInto adds the per-class counters to stats. Callers must hold
+// mu.
+func (t *timedMap) classStatsInto(stats map[string]uint64) {
+	for name, c := range t.classes {
+		prefix := "class." + name + "."
+		stats[prefix+"added"] = c.added
+		stats[prefix+"removed"] = c.removed
+		stats[prefix+"expired"] = c.expired
+		stats[prefix+"current"] = c.current
+	}
+}
@@ -17,7 +17,10 @@
 package temap
 
 import (
-	"container/heap"
+	"errors"
+	"math"
+	"runtime"
+	"runtime/debug"
 	"time"
 )
 
@@ -25,91 +28,470 @@ import (
 // Cleaner control
 // --------------------------------------------------------------------
 
-// StopCleaner gracefully stops background cleaner.
-func (t *TimedMap) StopCleaner() {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+// cleanerState is the lifecycle state of the background cleaner.
+//
+//	Stopped --StartCleaner--> Running --StopCleaner--> Stopped
+//	Stopped/Running --Close--> Closed
+//
+// Closed is terminal. Transitions are serialized by TimedMap.life, so
+// every method below is safe to call concurrently and any number of times.
+type cleanerState uint8
 
-	if t.stopped {
-		return
-	}
+const (
+	cleanerStopped cleanerState = iota
+	cleanerRunning
+	cleanerClosed
+)
 
-	t.stopped = true
-	close(t.stopCh)
-	t.mu.Unlock()
-	t.wg.Wait()
-	t.mu.Lock()
+// StopCleaner gracefully stops background cleaner. It returns once the
+// cleaner goroutine has exited, or with WithSyncCallbacks once it has
+// stopped expiring entries.
+func (t *timedMap) StopCleaner() {
+	t.life.Lock()
+	defer t.life.Unlock()
+	t.stopCleaner()
 }
 
-// StartCleaner restarts background cleaner if stopped.
-func (t *TimedMap) StartCleaner() {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+// StartCleaner restarts background cleaner if stopped. It is a no-op if
+// the cleaner is already running or the map has been closed.
+func (t *timedMap) StartCleaner() {
+	t.life.Lock()
+	defer t.life.Unlock()
 	t.startCleaner()
 }
 
 // RestartCleaner stops and starts cleaner again.
-func (t *TimedMap) RestartCleaner() {
-	t.StopCleaner()
-	t.StartCleaner()
+func (t *timedMap) RestartCleaner() {
+	t.life.Lock()
+	defer t.life.Unlock()
+	t.stopCleaner()
+	t.startCleaner()
+}
+
+// ErrClosed is returned by mutations that report errors once the map has
+// been closed.
+var ErrClosed = errors.New("temap: map is closed")
+
+// Close applies writes queued by SetAsync and stops the cleaner for
+// good. A closed map keeps serving reads of the entries it held, which
+// no longer expire, and rejects every mutation: it does nothing, returns
+// false, zero or ErrClosed as its signature allows. Cleaner controls
+// such as StartCleaner do nothing, and Close may be called again.
+func (t *timedMap) Close() {
+	t.stopAsync()
+
+	t.lock()
+	t.closed = true
+	t.unlock()
+
+	t.life.Lock()
+	defer t.life.Unlock()
+	t.stopCleaner()
+	t.state = cleanerClosed
+	if t.pool != nil && t.shared == nil {
+		t.pool.close()
+	}
+	if t.clock != nil {
+		t.clock.close()
+	}
+	t.unregister()
+}
+
+// WithSuspendCatchUp makes the cleaner detect system sleep/suspend: when
+// the wall clock jumped more than threshold past the monotonic clock
+// while the cleaner was waiting, overdue entries are expired at most
+// batch at a time with pause between batches, instead of all at once.
+func WithSuspendCatchUp(threshold time.Duration, batch int, pause time.Duration) Option {
+	return func(t *TimedMap) {
+		if batch <= 0 {
+			batch = 1
+		}
+		t.catchUp.threshold = threshold
+		t.catchUp.batch = batch
+		t.catchUp.pause = pause
+	}
+}
+
+// WithExpiryBound asks for expiry callbacks to start within bound of
+// their deadline. The cleaner runs on a locked OS thread, sleeps until
+// shortly before the next deadline and busy-waits the rest of the way,
+// which costs up to highPrecisionLead of CPU per deadline. Misses are
+// counted in the "expiry_bound_misses" stat. Deadlines are still rounded
+// to the precision unit, see WithPrecision.
+func WithExpiryBound(bound time.Duration) Option {
+	return func(t *TimedMap) {
+		if bound > 0 {
+			t.bound = bound
+		}
+	}
+}
+
+// highPrecisionLead is how long before a deadline the cleaner stops
+// sleeping and starts spinning when WithExpiryBound is used; it covers
+// the usual lateness of the runtime's timers.
+const highPrecisionLead = 2 * time.Millisecond
+
+// CleanerRunning reports whether the cleaner goroutine is alive.
+func (t *timedMap) CleanerRunning() bool {
+	return t.cleanerAlive.Load()
+}
+
+// LastSweepAt returns when the cleaner last inspected the heap, or the
+// zero time if it never has. An idle cleaner only wakes for the next
+// deadline (or once a second when nothing is scheduled), so this is only
+// a sign of a stall when PendingExpirations is also non-zero.
+func (t *timedMap) LastSweepAt() time.Time {
+	ns := t.lastSweep.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// PendingExpirations returns the number of entries past their deadline
+// that the cleaner has not removed yet.
+func (t *timedMap) PendingExpirations() int {
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	now, n := t.nowTicks(), 0
+	count := func(el *element) bool {
+		if el.ExpiresAt <= now {
+			n++
+		}
+		return true
+	}
+	if o, ok := t.sched.(orderedScheduler); ok {
+		o.ascend(func(el *element) bool { return el.ExpiresAt <= now && count(el) })
+	} else {
+		t.sched.each(count)
+	}
+	return n
 }
 
 // --------------------------------------------------------------------
 // Internal cleaner goroutine
 // --------------------------------------------------------------------
-func (t *TimedMap) startCleaner() {
-	if !t.stopped && t.stopCh != nil {
-		return // already running
+
+// startCleaner moves Stopped to Running. Callers must hold life.
+func (t *timedMap) startCleaner() {
+	if t.state != cleanerStopped {
+		return
 	}
 
-	t.stopCh = make(chan struct{})
-	t.stopped = false
-	t.wg.Add(1)
+	stop := make(chan struct{})
+	t.lock()
+	t.stopCh = stop
+	t.state = cleanerRunning
+	t.parked = t.parkable() && t.sched.len() == 0
+	if t.parked {
+		t.nextWake = math.MaxInt64
+	}
+	parked := t.parked
+	t.unlock()
+	if parked {
+		return
+	}
+
+	if t.backend == BackendTimers {
+		t.cleanerAlive.Store(true)
+		// Timers that went off while stopped were ignored.
+		goLabeled(t.labels.cleaner, t.timerFired)
+		return
+	}
+	if t.driver != nil {
+		t.cleanerAlive.Store(true)
+		t.driver.add(t)
+		return
+	}
+	t.spawnCleaner(stop)
+}
 
-	go func() {
+// spawnCleaner starts the cleaner goroutine. The goroutine exits when
+// stop is closed or, see WithLazyCleaner, when it parks itself.
+func (t *timedMap) spawnCleaner(stop <-chan struct{}) {
+	t.cleanerAlive.Store(true)
+	t.wg.Add(1)
+	goLabeled(t.labels.cleaner, func() {
 		defer t.wg.Done()
+		t.superviseCleaner(stop)
+	})
+}
 
-		for {
-			t.mu.Lock()
-			if len(t.expHeap) == 0 {
-				t.mu.Unlock()
-				select {
-				case <-time.After(time.Second):
-					continue
-				case <-t.stopCh:
-					return
-				}
-			}
+// stopCleaner moves Running to Stopped and waits for the goroutine to
+// exit. Callers must hold life.
+func (t *timedMap) stopCleaner() {
+	if t.state != cleanerRunning {
+		return
+	}
+
+	t.lock()
+	close(t.stopCh)
+	t.stopCh = nil
+	t.state = cleanerStopped
+	t.parked = false
+	t.unlock()
+
+	// With synchronous callbacks, one stopping the cleaner it runs on
+	// would wait for itself. The cleaner is stopped as far as the map is
+	// concerned once it no longer holds the lock; the goroutine exits
+	// after the callbacks it has started.
+	wait := !t.inline
+	if t.driver != nil {
+		t.driver.remove(t, wait)
+	}
+	if wait {
+		t.wg.Wait()
+	}
+	t.cleanerAlive.Store(false)
+}
+
+// superviseCleaner runs the cleaner loop until stop is closed,
+// restarting it after a panic so that expirations never silently stop.
+func (t *timedMap) superviseCleaner(stop <-chan struct{}) {
+	for !t.runCleanerSafely(stop) {
+		select {
+		case <-time.After(cleanerRestartDelay):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// cleanerRestartDelay keeps a cleaner that panics on every pass from
+// spinning.
+const cleanerRestartDelay = 100 * time.Millisecond
+
+// runCleanerSafely runs the cleaner loop and reports whether it returned
+// normally.
+func (t *timedMap) runCleanerSafely(stop <-chan struct{}) (done bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.cleanerPanics.Add(1)
+			t.logf("temap: cleaner panic (restarting): %v\n%s", r, debug.Stack())
+		}
+	}()
+
+	t.runCleaner(stop)
+	return true
+}
 
-			next := t.expHeap[0]
-			wait := time.Until(time.Unix(0, next.ExpiresAt))
-			if wait <= 0 {
-				expired := []*element{}
-				now := time.Now().UnixNano()
-
-				for len(t.expHeap) > 0 && t.expHeap[0].ExpiresAt <= now {
-					el := heap.Pop(&t.expHeap).(*element)
-					delete(t.items, el.Key)
-					expired = append(expired, el)
-					t.stats.expired++
-				}
-				t.mu.Unlock()
-
-				for _, el := range expired {
-					if t.onExpire != nil {
-						go t.onExpire(el.Key, el.Value)
-					}
-				}
-				continue
+// runCleaner expires entries until stop is closed.
+func (t *timedMap) runCleaner(stop <-chan struct{}) {
+	if t.bound > 0 {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	// catchUp is set after a suspend is detected, and limits how many
+	// overdue entries are expired per round until the backlog is gone.
+	catchUp := false
+
+	// idleSince is when the scheduler was first found empty, see
+	// WithLazyCleaner.
+	var idleSince time.Time
+
+	// sleep waits for d or an earlier deadline and reports whether the
+	// cleaner should keep running. A wall clock that advanced much
+	// further than the monotonic clock means the machine was suspended
+	// meanwhile.
+	sleep := func(d time.Duration) bool {
+		start := time.Now()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d)
+		select {
+		case <-timer.C:
+		case <-t.wake:
+		case <-stop:
+			return false
+		}
+		if t.catchUp.threshold > 0 {
+			now := time.Now()
+			if now.Round(0).Sub(start.Round(0))-now.Sub(start) > t.catchUp.threshold {
+				catchUp = true
 			}
+		}
+		return true
+	}
 
-			t.mu.Unlock()
+	// spin busy-waits for d, see WithExpiryBound.
+	spin := func(d time.Duration) bool {
+		end := time.Now().Add(d)
+		for time.Now().Before(end) {
 			select {
-			case <-time.After(wait):
-				continue
-			case <-t.stopCh:
+			case <-stop:
+				return false
+			case <-t.wake:
+				return true
+			default:
+				runtime.Gosched()
+			}
+		}
+		return true
+	}
+
+	for {
+		limit := -1
+		if catchUp {
+			limit = t.catchUp.batch
+		}
+
+		wait := t.sweep(limit)
+		if t.idleStop > 0 {
+			if t.park(&idleSince) {
 				return
 			}
+			wait = min(wait, t.idleStop)
 		}
-	}()
+
+		switch {
+		case wait > 0:
+			catchUp = false
+		case catchUp:
+			wait = t.catchUp.pause
+		default:
+			continue
+		}
+
+		if t.bound > 0 && wait <= highPrecisionLead {
+			if !spin(wait) {
+				return
+			}
+			continue
+		}
+		if t.bound > 0 {
+			wait -= highPrecisionLead
+		}
+		if !sleep(wait) {
+			return
+		}
+	}
+}
+
+// cleanerIdleWait is how long the cleaner sleeps when nothing is
+// scheduled.
+const cleanerIdleWait = time.Second
+
+// scheduled wakes the cleaner if el is now due before the cleaner
+// planned to wake up. Callers must hold mu.
+func (t *timedMap) scheduled(el *element) {
+	if t.checks {
+		t.checkScheduled(el)
+	}
+	t.wakeBy(el.ExpiresAt)
+}
+
+// wakeBy wakes the cleaner if exp is before the cleaner planned to wake
+// up. Callers must hold mu.
+func (t *timedMap) wakeBy(exp int64) {
+	if exp >= t.nextWake {
+		return
+	}
+	t.nextWake = exp
+	if t.driver != nil {
+		t.driver.reschedule(t, t.unixNano(exp))
+		return
+	}
+	if t.parked {
+		t.parked = false
+		t.spawnCleaner(t.stopCh)
+		return
+	}
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// expire removes due elements that are no longer scheduled and runs
+// their callbacks once mu is released. Callers must hold mu.
+func (t *timedMap) expire(els []*element, sweptAt int64) {
+	fire := els[:0] // filtered in place
+	for _, el := range els {
+		t.forget(el)
+		if t.tombs != nil {
+			t.bury(el, sweptAt)
+		}
+		if t.bound > 0 && sweptAt-t.unixNano(el.ExpiresAt) > int64(t.bound) {
+			t.boundMisses.Add(1)
+		}
+		t.countExpired(el)
+		if el.silent {
+			continue
+		}
+		t.notify(EventExpired, el)
+		fire = append(fire, el)
+	}
+	if len(fire) > 0 && t.onExpire != nil {
+		t.after(func() {
+			t.dispatchOrder(fire)
+			for _, el := range fire {
+				t.dispatch(el.Key, el.Value, el.priority)
+			}
+		})
+	}
+}
+
+// expireDue removes up to limit entries due at now, in ticks (all of
+// them if limit < 0). Callers must hold mu.
+func (t *timedMap) expireDue(now, sweptAt int64, limit int) {
+	expired := t.sched.popDue(now, limit)
+	if t.grace > 0 {
+		expired = t.softExpire(expired)
+	}
+	if t.decide != nil {
+		t.awaitVerdicts(expired)
+	} else {
+		t.expire(expired, sweptAt)
+	}
+}
+
+// sweep removes up to limit due entries (all of them if limit < 0) and
+// returns the time until the next deadline, which is zero or negative if
+// due entries are left over. Expiry callbacks are started before any
+// subscriber runs, so a panicking subscriber cannot swallow them.
+func (t *timedMap) sweep(limit int) (wait time.Duration) {
+	defer t.profile(ProfileSweep, t.profStart())
+	t.lock()
+	defer t.unlock()
+
+	sweptAt := time.Now().UnixNano()
+	t.lastSweep.Store(sweptAt)
+	now := t.nowTicks()
+
+	if t.frozen {
+		// Unfreeze wakes the cleaner again.
+		t.nextWake = math.MaxInt64
+		if t.driver != nil {
+			t.driver.reschedule(t, math.MaxInt64)
+		}
+		return cleanerIdleWait
+	}
+
+	t.expireDue(now, sweptAt, limit)
+	if t.checks {
+		t.checkPeriodically()
+	}
+
+	next, ok := t.sched.next()
+	if !ok {
+		t.nextWake = math.MaxInt64
+		if t.driver != nil {
+			t.driver.reschedule(t, math.MaxInt64)
+		}
+		return cleanerIdleWait
+	}
+	t.nextWake = next
+	if t.driver != nil {
+		t.driver.reschedule(t, t.unixNano(next))
+	}
+	return time.Until(time.Unix(0, t.unixNano(next)))
 }
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Coarse clock
+// --------------------------------------------------------------------
+
+// coarseClock caches the current time, refreshed by a ticker, so hot
+// paths can read it without calling time.Now.
+type coarseClock struct {
+	now  atomic.Int64 // UnixNano
+	stop chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// WithCoarseClock makes writes and expiry checks read the time from a
+// clock refreshed every res (1ms if res <= 0) by a background goroutine
+// instead of calling time.Now. Deadlines computed from TTLs and expiry
+// checks may then be off by up to res; Close stops the goroutine.
+func WithCoarseClock(res time.Duration) Option {
+	return func(t *TimedMap) {
+		if res <= 0 {
+			res = time.Millisecond
+		}
+		t.clock = newCoarseClock(res)
+	}
+}
+
+func newCoarseClock(res time.Duration) *coarseClock {
+	c := &coarseClock{stop: make(chan struct{})}
+	c.now.Store(time.Now().UnixNano())
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		tick := time.NewTicker(res)
+		defer tick.Stop()
+		for {
+			select {
+			case now := <-tick.C:
+				c.now.Store(now.UnixNano())
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// close stops the refreshing goroutine.
+func (c *coarseClock) close() {
+	c.once.Do(func() { close(c.stop) })
+	c.wg.Wait()
+}
+
+// nowNano returns the current time in nanoseconds, from the coarse clock
+// if there is one.
+func (t *timedMap) nowNano() int64 {
+	if t.clock != nil {
+		return t.clock.now.Load()
+	}
+	return time.Now().UnixNano()
+}
+
+// now is nowNano as a time.Time.
+func (t *timedMap) now() time.Time {
+	if t.clock != nil {
+		return time.Unix(0, t.clock.now.Load())
+	}
+	return time.Now()
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command temapbench runs the same workloads against every expiry
+// backend, alone and sharded, and prints a comparison table:
+//
+//	go run ./cmd/temapbench -keys 200000 -goroutines 8
+//
+// For each variant it measures set and get throughput, the allocations
+// per set, and how late expiry callbacks run after their deadline.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/majiddarvishan/temap"
+)
+
+// target is what the workloads need from a map; both *temap.TimedMap
+// and *temap.ShardedMap provide it.
+type target interface {
+	SetWithTTL(key, value any, ttl time.Duration)
+	Get(key any) (any, int64, bool)
+	Close()
+}
+
+// variant is one map configuration under test.
+type variant struct {
+	name string
+	make func(onExpire func(key, val any)) target
+}
+
+func variants(shards int) []variant {
+	var out []variant
+	for _, b := range []temap.Backend{temap.BackendHeap, temap.BackendTimers, temap.BackendWheel, temap.BackendBucket} {
+		b := b
+		out = append(out, variant{
+			name: b.String(),
+			make: func(onExpire func(key, val any)) target {
+				return temap.New(onExpire, temap.WithBackend(b))
+			},
+		})
+	}
+	for _, b := range []temap.Backend{temap.BackendHeap, temap.BackendWheel} {
+		b := b
+		out = append(out, variant{
+			name: fmt.Sprintf("sharded-%d/%s", shards, b),
+			make: func(onExpire func(key, val any)) target {
+				return temap.NewSharded(shards, onExpire, temap.WithBackend(b))
+			},
+		})
+	}
+	return out
+}
+
+// result holds the measurements of one variant.
+type result struct {
+	name          string
+	sets, gets    float64 // operations per second
+	allocsPerSet  float64
+	bytesPerSet   float64
+	lagP50        time.Duration
+	lagP99        time.Duration
+	lagMax        time.Duration
+	missedExpires int
+}
+
+func main() {
+	keys := flag.Int("keys", 100000, "keys per workload")
+	goroutines := flag.Int("goroutines", runtime.GOMAXPROCS(0), "concurrent writers and readers")
+	shards := flag.Int("shards", 16, "shards of the sharded variants")
+	ttl := flag.Duration("ttl", 200*time.Millisecond, "TTL of the entries timed for expiry lag")
+	only := flag.String("backend", "", "run only the variant with this name")
+	flag.Parse()
+
+	if *keys <= 0 || *goroutines <= 0 {
+		fmt.Fprintln(os.Stderr, "temapbench: -keys and -goroutines must be positive")
+		os.Exit(2)
+	}
+
+	var results []result
+	for _, v := range variants(*shards) {
+		if *only != "" && v.name != *only {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "running %s...\n", v.name)
+		results = append(results, run(v, *keys, *goroutines, *ttl))
+	}
+	if len(results) == 0 {
+		fmt.Fprintf(os.Stderr, "temapbench: no variant named %q\n", *only)
+		os.Exit(2)
+	}
+	report(os.Stdout, results)
+}
+
+// run measures v with the given workload sizes.
+func run(v variant, keys, goroutines int, ttl time.Duration) result {
+	r := result{name: v.name}
+
+	m := v.make(nil)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	elapsed := parallel(keys, goroutines, func(i int) {
+		m.SetWithTTL(i, i, time.Hour)
+	})
+	runtime.ReadMemStats(&after)
+	r.sets = float64(keys) / elapsed.Seconds()
+	r.allocsPerSet = float64(after.Mallocs-before.Mallocs) / float64(keys)
+	r.bytesPerSet = float64(after.TotalAlloc-before.TotalAlloc) / float64(keys)
+
+	elapsed = parallel(keys, goroutines, func(i int) {
+		m.Get(i)
+	})
+	r.gets = float64(keys) / elapsed.Seconds()
+	m.Close()
+
+	r.lagP50, r.lagP99, r.lagMax, r.missedExpires = expiryLag(v, keys, goroutines, ttl)
+	return r
+}
+
+// parallel calls op for every i in [0, n) from the given number of
+// goroutines and returns how long that took.
+func parallel(n, goroutines int, op func(i int)) time.Duration {
+	var wg sync.WaitGroup
+	start := time.Now()
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < n; i += goroutines {
+				op(i)
+			}
+		}(g)
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+// expiryLag sets keys entries expiring within ttl of each other and
+// returns percentiles of how late their callbacks ran, along with the
+// number of callbacks that did not run within a generous timeout.
+func expiryLag(v variant, keys, goroutines int, ttl time.Duration) (p50, p99, worst time.Duration, missed int) {
+	lags := make([]time.Duration, 0, keys)
+	var mu sync.Mutex
+	done := make(chan struct{})
+	m := v.make(func(key, val any) {
+		lag := time.Since(val.(time.Time))
+		mu.Lock()
+		defer mu.Unlock()
+		if lags = append(lags, lag); len(lags) == keys {
+			close(done)
+		}
+	})
+	defer m.Close()
+
+	start := time.Now()
+	parallel(keys, goroutines, func(i int) {
+		// Spread deadlines over [ttl, 2*ttl) so the backends do not
+		// just fire one big batch.
+		d := ttl + time.Duration(i)*ttl/time.Duration(keys)
+		m.SetWithTTL(i, start.Add(d), time.Until(start.Add(d)))
+	})
+
+	select {
+	case <-done:
+	case <-time.After(2*ttl + 10*time.Second):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	missed = keys - len(lags)
+	if len(lags) == 0 {
+		return 0, 0, 0, missed
+	}
+	sort.Slice(lags, func(i, j int) bool { return lags[i] < lags[j] })
+	return lags[len(lags)/2], lags[len(lags)*99/100], lags[len(lags)-1], missed
+}
+
+// report prints results as an aligned table.
+func report(w io.Writer, results []result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "variant\tsets/s\tgets/s\tallocs/set\tB/set\tlag p50\tlag p99\tlag max\tmissed\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%.0f\t%.0f\t%.1f\t%.0f\t%v\t%v\t%v\t%d\t\n",
+			r.name, r.sets, r.gets, r.allocsPerSet, r.bytesPerSet,
+			r.lagP50.Round(time.Microsecond), r.lagP99.Round(time.Microsecond),
+			r.lagMax.Round(time.Microsecond), r.missedExpires)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+)
+
+// --------------------------------------------------------------------
+// Transparent value compression
+// --------------------------------------------------------------------
+
+// Codec compresses values stored in a TimedMap.
+type Codec interface {
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// CodecFuncs adapts a pair of functions to the Codec interface, which
+// makes wrapping snappy, zstd or similar libraries a one-liner.
+type CodecFuncs struct {
+	CompressFunc   func(src []byte) ([]byte, error)
+	DecompressFunc func(src []byte) ([]byte, error)
+}
+
+func (c CodecFuncs) Compress(src []byte) ([]byte, error)   { return c.CompressFunc(src) }
+func (c CodecFuncs) Decompress(src []byte) ([]byte, error) { return c.DecompressFunc(src) }
+
+type flateCodec struct {
+	level int
+}
+
+// NewFlateCodec returns a Codec using compress/flate at the given level.
+func NewFlateCodec(level int) Codec {
+	return flateCodec{level: level}
+}
+
+func (c flateCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c flateCodec) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// WithCompression compresses []byte and string values of at least
+// threshold bytes with codec. Values are decompressed on the way out, so
+// callers always see what they stored.
+func WithCompression(codec Codec, threshold int) Option {
+	return func(t *TimedMap) {
+		t.codec = codec
+		t.codecThreshold = threshold
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Declarative configuration
+// --------------------------------------------------------------------
+
+// Config is the settings of a map in a form that can be loaded from
+// application config files. The zero value is New's defaults; see the
+// option each field stands for.
+type Config struct {
+	Name     string `json:"name,omitempty" yaml:"name,omitempty"`         // WithName
+	Capacity int    `json:"capacity,omitempty" yaml:"capacity,omitempty"` // WithCapacity
+
+	DefaultTTL  Duration `json:"default_ttl,omitempty" yaml:"default_ttl,omitempty"`   // WithDefaultTTL
+	MaxLifetime Duration `json:"max_lifetime,omitempty" yaml:"max_lifetime,omitempty"` // WithMaxLifetime
+	Sliding     bool     `json:"sliding,omitempty" yaml:"sliding,omitempty"`           // WithSlidingExpiration
+	Precision   Duration `json:"precision,omitempty" yaml:"precision,omitempty"`       // WithPrecision
+
+	Backend           Backend  `json:"backend,omitempty" yaml:"backend,omitempty"`                       // WithBackend
+	BackendResolution Duration `json:"backend_resolution,omitempty" yaml:"backend_resolution,omitempty"` // WithBackendResolution
+	WheelSlots        int      `json:"wheel_slots,omitempty" yaml:"wheel_slots,omitempty"`               // WithBackendResolution
+
+	CallbackWorkers int      `json:"callback_workers,omitempty" yaml:"callback_workers,omitempty"` // WithCallbackWorkers
+	CallbackQueue   int      `json:"callback_queue,omitempty" yaml:"callback_queue,omitempty"`     // WithCallbackWorkers
+	MaxBlock        Duration `json:"max_block,omitempty" yaml:"max_block,omitempty"`               // WithBackpressure
+	SlowCallback    Duration `json:"slow_callback,omitempty" yaml:"slow_callback,omitempty"`       // WithSlowCallbackThreshold
+
+	Tombstones Duration `json:"tombstones,omitempty" yaml:"tombstones,omitempty"` // WithTombstones
+}
+
+// Duration is a time.Duration that reads and writes as text such as
+// "1m30s" in config files.
+type Duration time.Duration
+
+// String returns the duration as text, such as "1m30s".
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("temap: %w", err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Validate reports every setting that makes no sense, such as negative
+// sizes or a queue without workers.
+func (c Config) Validate() error {
+	var errs []error
+	bad := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("temap: config: "+format, args...))
+	}
+
+	for _, f := range []struct {
+		name string
+		n    int64
+	}{
+		{"capacity", int64(c.Capacity)},
+		{"default_ttl", int64(c.DefaultTTL)},
+		{"max_lifetime", int64(c.MaxLifetime)},
+		{"precision", int64(c.Precision)},
+		{"backend_resolution", int64(c.BackendResolution)},
+		{"wheel_slots", int64(c.WheelSlots)},
+		{"callback_workers", int64(c.CallbackWorkers)},
+		{"callback_queue", int64(c.CallbackQueue)},
+		{"max_block", int64(c.MaxBlock)},
+		{"slow_callback", int64(c.SlowCallback)},
+		{"tombstones", int64(c.Tombstones)},
+	} {
+		if f.n < 0 {
+			bad("%s is negative", f.name)
+		}
+	}
+
+	if c.Backend > BackendBucket {
+		bad("unknown backend %d", c.Backend)
+	}
+	if c.MaxLifetime > 0 && c.DefaultTTL > c.MaxLifetime {
+		bad("default_ttl %v exceeds max_lifetime %v", c.DefaultTTL, c.MaxLifetime)
+	}
+	if c.Precision > 0 && c.DefaultTTL > 0 && c.DefaultTTL < c.Precision {
+		bad("default_ttl %v is below precision %v", c.DefaultTTL, c.Precision)
+	}
+	if c.BackendResolution > 0 && c.Backend != BackendWheel && c.Backend != BackendBucket {
+		bad("backend_resolution needs the wheel or bucket backend")
+	}
+	if c.WheelSlots > 0 && c.Backend != BackendWheel {
+		bad("wheel_slots needs the wheel backend")
+	}
+	if c.CallbackWorkers == 0 && (c.CallbackQueue > 0 || c.MaxBlock > 0) {
+		bad("callback_queue and max_block need callback_workers")
+	}
+	return errors.Join(errs...)
+}
+
+// Options returns the options c stands for.
+func (c Config) Options() []Option {
+	var opts []Option
+	if c.Name != "" {
+		opts = append(opts, WithName(c.Name))
+	}
+	if c.Capacity > 0 {
+		opts = append(opts, WithCapacity(c.Capacity))
+	}
+	if c.DefaultTTL > 0 {
+		opts = append(opts, WithDefaultTTL(time.Duration(c.DefaultTTL)))
+	}
+	if c.MaxLifetime > 0 {
+		opts = append(opts, WithMaxLifetime(time.Duration(c.MaxLifetime)))
+	}
+	if c.Sliding {
+		opts = append(opts, WithSlidingExpiration())
+	}
+	if c.Precision > 0 {
+		opts = append(opts, WithPrecision(time.Duration(c.Precision)))
+	}
+	if c.Backend != BackendHeap {
+		opts = append(opts, WithBackend(c.Backend))
+	}
+	if c.BackendResolution > 0 || c.WheelSlots > 0 {
+		opts = append(opts, WithBackendResolution(time.Duration(c.BackendResolution), c.WheelSlots))
+	}
+	if c.CallbackWorkers > 0 {
+		opts = append(opts, WithCallbackWorkers(c.CallbackWorkers, c.CallbackQueue))
+	}
+	if c.MaxBlock > 0 {
+		opts = append(opts, WithBackpressure(time.Duration(c.MaxBlock)))
+	}
+	if c.SlowCallback > 0 {
+		opts = append(opts, WithSlowCallbackThreshold(time.Duration(c.SlowCallback)))
+	}
+	if c.Tombstones > 0 {
+		opts = append(opts, WithTombstones(time.Duration(c.Tombstones)))
+	}
+	return opts
+}
+
+// NewFromConfig validates cfg and creates a map from it; opts are applied
+// after cfg, for settings such as callbacks that config files cannot
+// hold.
+func NewFromConfig(cfg Config, onExpire func(key, val any), opts ...Option) (*TimedMap, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return New(onExpire, append(cfg.Options(), opts...)...), nil
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Context-aware operations
+// --------------------------------------------------------------------
+
+// ErrNotFound is returned by GetCtx for a missing key when the map has
+// no loader.
+var ErrNotFound = errors.New("temap: key not found")
+
+// GetCtx returns the value of key. Missing keys are loaded with ctx if
+// the map has a loader (see WithLoader) and reported as ErrNotFound
+// otherwise. It returns ctx.Err() if ctx is already done.
+func (t *timedMap) GetCtx(ctx context.Context, key any) (any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if t.loader.fn == nil {
+		v, _, ok := t.Get(key)
+		if !ok {
+			return nil, ErrNotFound
+		}
+		return v, nil
+	}
+	v, _, err := t.getOrLoad(ctx, key)
+	return v, err
+}
+
+// SetCtx is SetWithTTL, except that it does nothing and returns ctx.Err()
+// if ctx is already done.
+func (t *timedMap) SetCtx(ctx context.Context, key, value any, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t.SetWithTTL(key, value, ttl)
+	return nil
+}
+
+// RemoveCtx is Remove, except that it does nothing and returns ctx.Err()
+// if ctx is already done.
+func (t *timedMap) RemoveCtx(ctx context.Context, key any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t.Remove(key)
+	return nil
+}
+
+// SetUntilDone sets a permanent key that is removed as if it expired,
+// with callback and EventExpired, once ctx is done. Overwriting or
+// removing the key first unties it from ctx.
+func (t *timedMap) SetUntilDone(ctx context.Context, key, value any) {
+	value = t.encode(value)
+
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		t.free(value)
+		return
+	}
+
+	t.set(key, value, ElementPermanent)
+	el := t.items[key]
+	t.tie(el, ctx)
+}
+
+// contextTie is the context an entry follows, see SetUntilDone.
+type contextTie struct {
+	ctx  context.Context
+	stop func() bool
+}
+
+// tie makes el follow ctx. Callers must hold mu.
+func (t *timedMap) tie(el *element, ctx context.Context) {
+	el.tie = &contextTie{ctx: ctx, stop: context.AfterFunc(ctx, func() { t.expireDone(el) })}
+}
+
+// expireDone expires el after its context ended, unless it was removed
+// or overwritten meanwhile.
+func (t *timedMap) expireDone(el *element) {
+	t.lock()
+	defer t.unlock()
+
+	if !t.live(el) {
+		return
+	}
+	if t.frozen || t.closed {
+		// Leave it to the cleaner once the map is unfrozen, if ever.
+		el.tie = nil
+		t.setDeadline(el, t.nowTicks())
+		return
+	}
+	t.delete(el)
+	if t.tombs != nil {
+		t.bury(el, time.Now().UnixNano())
+	}
+	t.countExpired(el)
+	if el.silent {
+		return
+	}
+	t.notify(EventExpired, el)
+	if t.onExpire != nil {
+		t.after(func() { t.dispatch(el.Key, el.Value, el.priority) })
+	}
+}
+
+// untie stops el from following a context, see SetUntilDone. Callers must
+// hold mu.
+func (t *timedMap) untie(el *element) {
+	if el.tie != nil {
+		el.tie.stop()
+		el.tie = nil
+	}
+}
+
+// Run ties the map to a service lifecycle managed by errgroup or similar:
+// it starts the cleaner if it is not running, blocks until ctx is done,
+// then closes the map and waits for the expiry callbacks still queued or
+// running to return. It returns nil after a graceful shutdown and
+// ErrClosed at once if the map was already closed.
+func (t *timedMap) Run(ctx context.Context) error {
+	t.rlock()
+	closed := t.closed
+	t.mu.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
+	t.runs.Add(1)
+	defer t.runs.Add(-1)
+
+	t.StartCleaner()
+	<-ctx.Done()
+	t.Close()
+	t.awaitCallbacks()
+	return nil
+}
+
+// awaitCallbacks waits until no expiry callback is queued or running.
+func (t *timedMap) awaitCallbacks() {
+	for t.inflight.Load() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "runtime"
+
+// --------------------------------------------------------------------
+// Incremental copy-on-write copies
+// --------------------------------------------------------------------
+
+// cowChunk is how many slots a copy takes per lock acquisition.
+var cowChunk = 4096
+
+// cowCopy is a copy of all entries taken incrementally, see copyEntries.
+// It walks the slot table (see Scan) a chunk at a time; in between,
+// writers hand it the old state of any entry it has not reached yet
+// before changing or removing it, so that the result is the map as of
+// the moment the copy started.
+type cowCopy struct {
+	pos      int // next slot to copy
+	end      int // slots at or past end only hold fresh entries
+	out      []Entry
+	fresh    map[*element]struct{} // inserted after the copy started
+	captured map[*element]struct{} // saved by a writer
+}
+
+// copyEntries returns every entry as of the moment it was called, with
+// values in stored form except arena values, which are copied out.
+// Writers are blocked for one chunk at a time only. If stats is set, it
+// is called with mu held at the instant the copy is taken.
+func (t *timedMap) copyEntries(stats func()) []Entry {
+	t.lock()
+	c := &cowCopy{
+		end:      len(t.slots.els),
+		out:      make([]Entry, 0, len(t.items)),
+		fresh:    make(map[*element]struct{}),
+		captured: make(map[*element]struct{}),
+	}
+	if stats != nil {
+		stats()
+	}
+	t.cows = append(t.cows, c)
+	t.unlock()
+
+	for {
+		t.lock()
+		stop := min(c.pos+cowChunk, c.end, len(t.slots.els))
+		for _, el := range t.slots.els[c.pos:max(stop, c.pos)] {
+			if el != nil && !c.has(el) {
+				c.take(t, el)
+			}
+		}
+		c.pos = max(stop, c.pos)
+		done := c.pos >= min(c.end, len(t.slots.els))
+		if done {
+			for i, other := range t.cows {
+				if other == c {
+					t.cows = append(t.cows[:i], t.cows[i+1:]...)
+					break
+				}
+			}
+		}
+		t.unlock()
+
+		if done {
+			return c.out
+		}
+		runtime.Gosched() // let waiting writers in before the next chunk
+	}
+}
+
+// has reports whether el is already in the copy or does not belong in
+// it.
+func (c *cowCopy) has(el *element) bool {
+	if _, ok := c.fresh[el]; ok {
+		return true
+	}
+	_, ok := c.captured[el]
+	return ok
+}
+
+// save adds the current state of el, which the copy has not reached
+// yet, unless it is already there. Callers must hold mu.
+func (c *cowCopy) save(t *timedMap, el *element) {
+	if c.has(el) {
+		return
+	}
+	c.captured[el] = struct{}{}
+	c.take(t, el)
+}
+
+// take adds the current state of el to the copy. Callers must hold mu.
+func (c *cowCopy) take(t *timedMap, el *element) {
+	e := t.entry(el)
+	if ref, ok := e.Value.(*arenaRef); ok {
+		e.Value = ref.bytes() // the arena may reuse the space
+	}
+	c.out = append(c.out, e)
+}
+
+// beforeWrite lets running copies save el before it is changed or
+// removed. Callers must hold mu.
+func (t *timedMap) beforeWrite(el *element) {
+	for _, c := range t.cows {
+		if el.pos >= c.pos {
+			c.save(t, el)
+		}
+	}
+}
+
+// inserted tells running copies that el is not part of them. Callers
+// must hold mu.
+func (t *timedMap) inserted(el *element) {
+	for _, c := range t.cows {
+		c.fresh[el] = struct{}{}
+	}
+}
+
+// beforeClear lets running copies save every entry they still need.
+// Callers must hold mu.
+func (t *timedMap) beforeClear() {
+	for _, c := range t.cows {
+		for _, el := range t.items {
+			if el.pos >= c.pos {
+				c.save(t, el)
+			}
+		}
+		c.pos = c.end
+	}
+}
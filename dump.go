@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// dumpEntry is the JSON form of an entry in DumpJSON.
+type dumpEntry struct {
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value"`
+	Permanent bool            `json:"permanent"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+	TTL       string          `json:"ttl,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	Version   uint64          `json:"version"`
+}
+
+// DumpJSON writes a human-readable JSON dump of the map to w: the Stats
+// block followed by every entry, sorted by key, with its remaining TTL.
+// Values that cannot be marshalled are written in their %v form, and
+// encrypted values as their ciphertext. It is meant for debugging and
+// bug reports, not for persistence.
+func (t *timedMap) DumpJSON(w io.Writer, pretty bool) error {
+	return t.Snapshot().WriteJSON(w, pretty)
+}
+
+// WriteJSON writes the snapshot in the format of DumpJSON, with TTLs
+// relative to the time the snapshot was taken.
+func (s *Snapshot) WriteJSON(w io.Writer, pretty bool) error {
+	dump := struct {
+		Time    time.Time         `json:"time"`
+		Stats   map[string]uint64 `json:"stats"`
+		Entries []dumpEntry       `json:"entries"`
+	}{
+		Time:    s.at,
+		Stats:   s.stats,
+		Entries: make([]dumpEntry, 0, len(s.entries)),
+	}
+
+	for _, e := range s.entries {
+		d := dumpEntry{
+			Key:       fmt.Sprint(e.Key),
+			Value:     dumpValue(e.Value),
+			Permanent: e.Permanent,
+			CreatedAt: e.CreatedAt,
+			Version:   e.Version,
+		}
+		if !e.Permanent {
+			d.ExpiresAt = &e.ExpiresAt
+			d.TTL = max(e.ExpiresAt.Sub(s.at), 0).String()
+		}
+		dump.Entries = append(dump.Entries, d)
+	}
+	sort.Slice(dump.Entries, func(i, j int) bool {
+		return dump.Entries[i].Key < dump.Entries[j].Key
+	})
+
+	enc := json.NewEncoder(w)
+	if pretty {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(dump)
+}
+
+// dumpValue marshals v, falling back to its %v form.
+func dumpValue(v any) json.RawMessage {
+	if b, err := json.Marshal(v); err == nil {
+		return b
+	}
+	b, _ := json.Marshal(fmt.Sprintf("%v", v))
+	return b
+}
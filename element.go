@@ -16,14 +16,34 @@
 
 package temap
 
+import "time"
+
 // --------------------------------------------------------------------
 // Internal element + heap (efficient expiry tracking)
 // --------------------------------------------------------------------
 type element struct {
-	Key       any   `json:"key"`
-	Value     any   `json:"value"`
-	ExpiresAt int64 `json:"expires_at"` // UnixNano timestamp
-	index     int   `json:"index"`      // heap index
+	Key       any    `json:"key"`
+	Value     any    `json:"value"`
+	ExpiresAt int64  `json:"expires_at"` // deadline in precision units
+	index     int    // position in the scheduler, -1 if unscheduled
+	slot      int64  // wheel slot or bucket key
+	pos       int    // position in the scan table, see Scan
+	version   uint64 // bumped on every value write
+	createdAt int64  // UnixNano timestamp of the first insert
+	gen       uint64 // map generation it was inserted in, see clear
+	ttl       int64  // last TTL in precision units, see WithSlidingExpiration
+	priority  Priority
+	silent    bool        // no expiry notification, see SetSilentWithTTL
+	deciding  bool        // due and unscheduled, see WithExpiryDecider
+	stale     bool        // in its grace period, see WithGracePeriod
+	class     *classStats // see WithKeyClassifier
+	valueKey  any         // indexed as, see WithValueIndex
+
+	prev, next *element // insertion order, see WithInsertionOrder
+
+	timer   *time.Timer // see BackendTimers
+	tie     *contextTie // see SetUntilDone
+	refresh *refreshJob // see SetRefreshing
 }
 
 type expiryHeap []*element
@@ -0,0 +1,29 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "crypto/cipher"
+
+// WithEncryption encrypts []byte and string values with aead while they
+// are held in memory, so they never appear in plain text in heap or crash
+// dumps. Each value is sealed with a fresh random nonce and opened again
+// on the way out.
+func WithEncryption(aead cipher.AEAD) Option {
+	return func(t *TimedMap) {
+		t.aead = aead
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "time"
+
+// Entry is a public view of a stored key.
+type Entry struct {
+	Key       any
+	Value     any
+	ExpiresAt time.Time // zero for permanent entries
+	Permanent bool
+	CreatedAt time.Time
+	Version   uint64
+}
+
+// GetEntry returns the entry stored under key.
+func (t *timedMap) GetEntry(key any) (Entry, bool) {
+	t.rlock()
+	el, ok := t.items[key]
+	if !ok {
+		t.mu.RUnlock()
+		t.looked(key, false)
+		return Entry{}, false
+	}
+	e := t.entry(el)
+	t.mu.RUnlock()
+
+	t.looked(key, true)
+	e.Value = t.decode(e.Value)
+	return e, true
+}
+
+// entry builds the public view of el without decoding its value. Callers
+// must hold mu.
+func (t *timedMap) entry(el *element) Entry {
+	e := Entry{
+		Key:       el.Key,
+		Value:     el.Value,
+		Permanent: el.ExpiresAt == ElementPermanent,
+		CreatedAt: time.Unix(0, el.createdAt),
+		Version:   el.version,
+	}
+	if !e.Permanent {
+		e.ExpiresAt = time.Unix(0, t.unixNano(el.ExpiresAt))
+	}
+	return e
+}
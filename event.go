@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "time"
+
+// --------------------------------------------------------------------
+// Keyspace notifications
+// --------------------------------------------------------------------
+
+// EventType identifies a keyspace notification. The set of events and
+// their names mirror Redis keyspace notifications.
+type EventType uint8
+
+const (
+	EventSet     EventType = iota + 1 // key written by one of the Set methods
+	EventDel                          // key removed by the caller
+	EventExpire                       // key given a (new) deadline
+	EventExpired                      // key removed by the cleaner after its deadline
+	EventPersist                      // key made permanent
+	EventStale                        // key past its deadline but in its grace period
+	EventEvicted                      // key dropped by RemoveOlderThan
+)
+
+// String returns the Redis name of the event.
+func (e EventType) String() string {
+	switch e {
+	case EventSet:
+		return "set"
+	case EventDel:
+		return "del"
+	case EventExpire:
+		return "expire"
+	case EventExpired:
+		return "expired"
+	case EventPersist:
+		return "persist"
+	case EventStale:
+		return "stale"
+	case EventEvicted:
+		return "evicted"
+	}
+	return "unknown"
+}
+
+// Event is a single keyspace notification.
+//
+// Deadline is the key's expiry after the event. For EventExpire and
+// EventPersist, PrevDeadline is the expiry it replaced, so mirrors of the
+// map can tell an extension from a fresh deadline. The zero time means
+// the key is (or was) permanent or did not exist yet.
+type Event struct {
+	Type         EventType
+	Key          any
+	Value        any
+	Time         time.Time
+	Deadline     time.Time
+	PrevDeadline time.Time
+}
+
+type subscriber struct {
+	id   uint64
+	mask uint32 // bit per EventType, 0 means all events
+	fn   func(Event)
+}
+
+func (s subscriber) wants(e EventType) bool {
+	return s.mask == 0 || s.mask&(1<<e) != 0
+}
+
+// Subscribe registers fn to receive keyspace notifications. If types are
+// given, only those events are delivered. The returned function cancels
+// the subscription.
+//
+// Notifications are delivered synchronously, in order, on the goroutine
+// that caused them once the map lock has been released, so fn may call
+// back into the map but should not block. Events of expiry, such as
+// EventExpired, come from the cleaner's goroutine, or that of its
+// CleanerGroup or TimerWheel; as StopCleaner, RestartCleaner and Close
+// wait for the cleaner, fn must call them on another goroutine.
+func (t *timedMap) Subscribe(fn func(Event), types ...EventType) (unsubscribe func()) {
+	var mask uint32
+	for _, typ := range types {
+		mask |= 1 << typ
+	}
+
+	t.lock()
+	t.subSeq++
+	id := t.subSeq
+	subs := make([]subscriber, len(t.subs), len(t.subs)+1)
+	copy(subs, t.subs)
+	t.subs = append(subs, subscriber{id: id, mask: mask, fn: fn})
+	t.mu.Unlock()
+
+	return func() {
+		t.lock()
+		defer t.mu.Unlock()
+
+		for i, s := range t.subs {
+			if s.id == id {
+				subs := make([]subscriber, 0, len(t.subs)-1)
+				subs = append(subs, t.subs[:i]...)
+				t.subs = append(subs, t.subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// notify records an event for el in the audit log and queues it for
+// subscribers; it is delivered by unlock. Callers must hold mu.
+func (t *timedMap) notify(typ EventType, el *element) {
+	t.notifyDeadline(typ, el, ElementPermanent)
+}
+
+// notifyDeadline is notify for a deadline change from prev, in ticks, to
+// el's current expiry. Callers must hold mu.
+func (t *timedMap) notifyDeadline(typ EventType, el *element, prev int64) {
+	if t.audit == nil && len(t.subs) == 0 {
+		return
+	}
+
+	now := time.Now()
+	if t.audit != nil {
+		t.audit.record(Op{Type: typ, Key: el.Key, At: now})
+	}
+	for _, s := range t.subs {
+		if s.wants(typ) {
+			t.pending = append(t.pending, Event{
+				Type:         typ,
+				Key:          el.Key,
+				Value:        el.Value,
+				Time:         now,
+				Deadline:     t.deadline(el.ExpiresAt),
+				PrevDeadline: t.deadline(prev),
+			})
+			return
+		}
+	}
+}
+
+// deadline converts an expiry in ticks to wall time, or the zero time
+// for permanent entries.
+func (t *timedMap) deadline(exp int64) time.Time {
+	if exp == ElementPermanent {
+		return time.Time{}
+	}
+	return time.Unix(0, t.unixNano(exp))
+}
+
+// after queues fn to run once mu is released. Callers must hold mu.
+func (t *timedMap) after(fn func()) {
+	t.deferred = append(t.deferred, fn)
+}
+
+// unlock releases mu, runs the deferred calls and then delivers the
+// notifications queued while it was held.
+func (t *timedMap) unlock() {
+	if len(t.pending) == 0 && len(t.deferred) == 0 {
+		t.mu.Unlock()
+		return
+	}
+
+	pending, subs, deferred := t.pending, t.subs, t.deferred
+	t.pending, t.deferred = nil, nil
+	t.mu.Unlock()
+
+	for _, fn := range deferred {
+		fn()
+	}
+	for _, ev := range pending {
+		ev.Value = t.decode(ev.Value)
+		for _, s := range subs {
+			if s.wants(ev.Type) {
+				s.fn(ev)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "time"
+
+// --------------------------------------------------------------------
+// Deadlines in the past
+// --------------------------------------------------------------------
+
+// PastExpiry selects what SetExpiry and SetExpiryMany do with a deadline
+// that has already passed.
+type PastExpiry uint8
+
+const (
+	// PastExpiryDelete removes the key without running the expiry
+	// callback, as Remove would. It is the default.
+	PastExpiryDelete PastExpiry = iota
+	// PastExpiryExpire expires the key right away, running the expiry
+	// callback and emitting EventExpired as the cleaner would.
+	PastExpiryExpire
+	// PastExpiryReject leaves the key and its deadline unchanged.
+	PastExpiryReject
+)
+
+// WithPastExpiry sets the policy for deadlines that have already passed.
+func WithPastExpiry(p PastExpiry) Option {
+	return func(t *TimedMap) {
+		t.pastExpiry = p
+	}
+}
+
+// ExpiryResult is the outcome of UpdateExpiry.
+type ExpiryResult uint8
+
+const (
+	ExpiryNotFound ExpiryResult = iota // no such key
+	ExpiryUpdated                      // deadline changed
+	ExpiryRemoved                      // past deadline, key deleted (PastExpiryDelete)
+	ExpiryExpired                      // past deadline, key expired (PastExpiryExpire)
+	ExpiryRejected                     // past deadline (PastExpiryReject), or the map is frozen or closed
+)
+
+// String returns the name of the result.
+func (r ExpiryResult) String() string {
+	switch r {
+	case ExpiryNotFound:
+		return "not found"
+	case ExpiryUpdated:
+		return "updated"
+	case ExpiryRemoved:
+		return "removed"
+	case ExpiryExpired:
+		return "expired"
+	case ExpiryRejected:
+		return "rejected"
+	}
+	return "unknown"
+}
+
+// UpdateExpiry is SetExpiry reporting what happened to the key. What a
+// deadline in the past does depends on WithPastExpiry.
+func (t *timedMap) UpdateExpiry(key any, expiresAt time.Time) ExpiryResult {
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		return ExpiryRejected
+	}
+
+	el, ok := t.items[key]
+	if !ok || el == nil {
+		return ExpiryNotFound
+	}
+
+	if expiresAt.IsZero() {
+		t.setDeadline(el, ElementPermanent)
+		return ExpiryUpdated
+	}
+
+	exp := t.ticks(expiresAt)
+	if exp <= t.nowTicks() {
+		return t.pastDeadline(el)
+	}
+
+	t.setDeadline(el, exp)
+	return ExpiryUpdated
+}
+
+// pastDeadline applies the PastExpiry policy to el, whose new deadline
+// has already passed. Callers must hold mu.
+func (t *timedMap) pastDeadline(el *element) ExpiryResult {
+	switch t.pastExpiry {
+	case PastExpiryReject:
+		return ExpiryRejected
+	case PastExpiryExpire:
+		t.sched.cancel(el)
+		el.ExpiresAt = t.nowTicks() // due now, not late
+		t.expire([]*element{el}, time.Now().UnixNano())
+		return ExpiryExpired
+	}
+	t.delete(el)
+	t.countRemoved(el)
+	t.notify(EventDel, el)
+	return ExpiryRemoved
+}
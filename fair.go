@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Fair callback scheduling
+// --------------------------------------------------------------------
+
+// WithFairCallbacks makes the callback workers (see WithCallbackWorkers)
+// serve partitions round-robin: partition maps each key to its tenant,
+// say, and one callback of every tenant with callbacks waiting runs
+// before a second one of any, so a tenant whose keys expire en masse
+// cannot hold up the others. It implies WithCallbackWorkers with one
+// worker per CPU unless that option is given too, and takes precedence
+// over WithSerializedCallbacks and WithCallbackRouter.
+//
+// Up to queueSize callbacks wait in all, or 1024 if queueSize is 0; a
+// full queue is handled as WithCallbackWorkers describes. PriorityHigh
+// callbacks are taken before all others, and WithCallbackAutoscale has
+// no effect.
+func WithFairCallbacks(partition func(key any) string) Option {
+	return func(t *TimedMap) {
+		if partition != nil {
+			t.callbackPool().partition = partition
+		}
+	}
+}
+
+// fairQueue holds the jobs of each partition in FIFO order and hands
+// them out round-robin across the partitions that have any.
+type fairQueue struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	urgent []func()
+	parts  map[string]*fairPart
+	ring   []*fairPart   // partitions with jobs, in serving order
+	next   int           // index in ring of the next partition served
+	n      int           // jobs queued
+	size   int           // most jobs queued
+	room   chan struct{} // signalled when a job is taken
+	closed bool
+}
+
+type fairPart struct {
+	name string
+	jobs []func()
+}
+
+func newFairQueue(size int) *fairQueue {
+	q := &fairQueue{
+		parts: make(map[string]*fairPart),
+		size:  size,
+		room:  make(chan struct{}, 1),
+	}
+	q.cond.L = &q.mu
+	return q
+}
+
+// push queues job for partition, ahead of every partition if urgent. It
+// reports false if the queue is full.
+func (q *fairQueue) push(partition string, job func(), urgent bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.n >= q.size {
+		return false
+	}
+	if urgent {
+		q.urgent = append(q.urgent, job)
+	} else {
+		p, ok := q.parts[partition]
+		if !ok {
+			p = &fairPart{name: partition}
+			q.parts[partition] = p
+			q.ring = append(q.ring, p)
+		}
+		p.jobs = append(p.jobs, job)
+	}
+	q.n++
+	q.cond.Signal()
+	return true
+}
+
+// pop waits for a job and returns it, or returns false once the queue is
+// closed and empty.
+func (q *fairQueue) pop() (func(), bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.n == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.n == 0 {
+		return nil, false
+	}
+	q.n--
+	select {
+	case q.room <- struct{}{}:
+	default:
+	}
+
+	if len(q.urgent) > 0 {
+		job := q.urgent[0]
+		q.urgent[0] = nil
+		q.urgent = q.urgent[1:]
+		return job, true
+	}
+
+	if q.next >= len(q.ring) {
+		q.next = 0
+	}
+	p := q.ring[q.next]
+	job := p.jobs[0]
+	p.jobs[0] = nil
+	p.jobs = p.jobs[1:]
+	if len(p.jobs) == 0 {
+		// The following partition moves into this slot and is next.
+		q.ring = append(q.ring[:q.next], q.ring[q.next+1:]...)
+		delete(q.parts, p.name)
+	} else {
+		q.next++
+	}
+	return job, true
+}
+
+// len returns the number of queued jobs.
+func (q *fairQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n
+}
+
+// close makes pop return false once the queued jobs are taken.
+func (q *fairQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// workFair runs jobs from the fair queue until it is closed.
+func (p *callbackPool) workFair() {
+	defer p.wg.Done()
+	defer p.running.Add(-1)
+
+	for {
+		job, ok := p.fair.pop()
+		if !ok {
+			return
+		}
+		select {
+		case p.space <- struct{}{}:
+		default:
+		}
+		job()
+	}
+}
+
+// submitFair queues job on the fair queue, waiting up to maxBlock for
+// room before running it on its own goroutine. Callers must hold mu for
+// reading.
+func (p *callbackPool) submitFair(key any, job func(), urgent bool) {
+	partition := p.partition(key)
+	if p.fair.push(partition, job, urgent) {
+		return
+	}
+	p.waits.Add(1)
+	if p.maxBlock > 0 {
+		timer := time.NewTimer(p.maxBlock)
+		defer timer.Stop()
+	wait:
+		for {
+			select {
+			case <-p.fair.room:
+			case <-timer.C:
+				break wait
+			}
+			if p.fair.push(partition, job, urgent) {
+				return
+			}
+		}
+	}
+	p.overflow.Add(1)
+	goLabeled(p.labels, job)
+}
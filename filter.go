@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"hash/maphash"
+	"math"
+	"sync/atomic"
+)
+
+// --------------------------------------------------------------------
+// Miss filter
+// --------------------------------------------------------------------
+
+// missFilter is a counting Bloom filter of the keys in the map. It is
+// updated under mu and read without it, so Get can turn away keys that
+// are certainly missing without locking.
+type missFilter struct {
+	seed     maphash.Seed
+	cells    []atomic.Uint32
+	hashes   int
+	rejected atomic.Uint64
+}
+
+// WithMissFilter puts a filter sized for expected keys with a false
+// positive rate of fpRate in front of Get, GetWithTTL, GetWithVersion and
+// Set.Contains: a key the filter has never seen is reported missing without
+// taking the read lock. It pays off when most lookups miss. Each cell
+// takes 4 bytes; a map that grows far beyond expected keys makes the
+// filter useless but never wrong. Rejected lookups are counted in the
+// "filter_rejects" stat.
+func WithMissFilter(expected int, fpRate float64) Option {
+	return func(t *TimedMap) {
+		t.filter = newMissFilter(max(expected, 1), fpRate)
+	}
+}
+
+func newMissFilter(n int, p float64) *missFilter {
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(n) * math.Ln2))
+	return &missFilter{
+		seed:   maphash.MakeSeed(),
+		cells:  make([]atomic.Uint32, int(m)),
+		hashes: min(max(k, 1), 16),
+	}
+}
+
+// each calls fn with the cells of key, derived from one 64-bit hash.
+func (f *missFilter) each(key any, fn func(c *atomic.Uint32) bool) {
+	h := hashKey(f.seed, key)
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	n := uint32(len(f.cells))
+	for i := 0; i < f.hashes; i++ {
+		if !fn(&f.cells[(h1+uint32(i)*h2)%n]) {
+			return
+		}
+	}
+}
+
+func (f *missFilter) add(key any) {
+	f.each(key, func(c *atomic.Uint32) bool { c.Add(1); return true })
+}
+
+func (f *missFilter) remove(key any) {
+	f.each(key, func(c *atomic.Uint32) bool { c.Add(^uint32(0)); return true })
+}
+
+// mayContain reports false if key is certainly not in the map.
+func (f *missFilter) mayContain(key any) bool {
+	ok := true
+	f.each(key, func(c *atomic.Uint32) bool {
+		ok = c.Load() > 0
+		return ok
+	})
+	if !ok {
+		f.rejected.Add(1)
+	}
+	return ok
+}
+
+func (f *missFilter) reset() {
+	for i := range f.cells {
+		f.cells[i].Store(0)
+	}
+}
+
+// definitelyMissing reports whether the miss filter rules key out.
+func (t *timedMap) definitelyMissing(key any) bool {
+	return t.filter != nil && !t.filter.mayContain(key)
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "errors"
+
+// --------------------------------------------------------------------
+// Read-only freeze
+// --------------------------------------------------------------------
+
+// ErrFrozen is returned by mutations that report errors while the map is
+// frozen, see Freeze.
+var ErrFrozen = errors.New("temap: map is frozen")
+
+// Freeze makes the map read-only, for example while its state is being
+// migrated to another instance. Reads are served as usual, but nothing
+// expires and every mutation is rejected: it does nothing, returns
+// false, zero or ErrFrozen as its signature allows, and is counted in the
+// "frozen_rejects" stat. Sliding expiration stops sliding, and entries
+// tied to a context that ends meanwhile expire after Unfreeze.
+func (t *timedMap) Freeze() {
+	t.lock()
+	defer t.unlock()
+	t.frozen = true
+}
+
+// Unfreeze makes a frozen map writable again and expires the entries
+// whose deadline passed meanwhile.
+func (t *timedMap) Unfreeze() {
+	t.lock()
+	defer t.unlock()
+
+	if !t.frozen {
+		return
+	}
+	t.frozen = false
+	if next, ok := t.sched.next(); ok {
+		t.wakeBy(next)
+	}
+	if t.backend == BackendTimers && t.cleanerAlive.Load() {
+		// Timers that went off while frozen were ignored.
+		t.after(func() { goLabeled(t.labels.cleaner, t.timerFired) })
+	}
+}
+
+// Frozen reports whether the map is frozen, see Freeze.
+func (t *timedMap) Frozen() bool {
+	t.rlock()
+	defer t.mu.RUnlock()
+	return t.frozen
+}
+
+// rejectWrite reports whether a mutation must be rejected because the
+// map is closed or frozen, counting the latter. Callers must hold mu.
+func (t *timedMap) rejectWrite() bool {
+	if t.closed {
+		return true
+	}
+	if !t.frozen {
+		return false
+	}
+	t.frozenRejects++
+	return true
+}
+
+// writeErr returns the error for a mutation rejected by rejectWrite.
+// Callers must hold mu.
+func (t *timedMap) writeErr() error {
+	if t.closed {
+		return ErrClosed
+	}
+	return ErrFrozen
+}
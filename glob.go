@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "strings"
+
+// --------------------------------------------------------------------
+// Glob matching
+// --------------------------------------------------------------------
+
+// globMatch reports whether s matches pattern with Redis KEYS syntax:
+// '*' matches any run of characters, '?' any one character, "[abc]",
+// "[a-z]" and "[^a]" match character classes and '\' escapes the next
+// character. Unlike path.Match, '*' also matches '/'. An unterminated
+// class is matched literally.
+func globMatch(pattern, s string) bool {
+	// Backtrack to the most recent '*' on mismatch.
+	var starP, starS = -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch c := pattern[p]; c {
+			case '*':
+				starP, starS = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if ok, n, valid := matchClass(pattern[p:], s[i]); valid {
+					if ok {
+						p += n
+						i++
+						continue
+					}
+					break
+				}
+				if s[i] == '[' {
+					p++
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+			default:
+				if c == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starS++
+		p, i = starP+1, starS
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c against the class at the start of pattern and
+// returns the length of the class; valid is false if it is unterminated.
+func matchClass(pattern string, c byte) (ok bool, n int, valid bool) {
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+	for first := true; i < len(pattern); first = false {
+		lo := pattern[i]
+		if lo == ']' && !first {
+			return ok != negate, i + 1, true
+		}
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			ok = true
+		}
+		i++
+	}
+	return false, 0, false
+}
+
+// globPrefix returns the literal prefix of pattern before its first
+// special character.
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
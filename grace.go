@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "time"
+
+// --------------------------------------------------------------------
+// Soft expiry
+// --------------------------------------------------------------------
+
+// WithGracePeriod makes expiry two-phase. At its deadline an entry only
+// goes stale: it stays readable for grace more, onStale (if not nil) is
+// called with it and EventStale is emitted; GetStale tells stale entries
+// apart. Once grace has passed, it expires as usual with the expiry
+// callback. Any new deadline, including one set by overwriting the
+// entry, makes it fresh again. Silent entries skip onStale and
+// EventStale too.
+func WithGracePeriod(grace time.Duration, onStale func(key, value any)) Option {
+	return func(t *TimedMap) {
+		if grace > 0 {
+			t.grace = grace
+			t.onStale = onStale
+		}
+	}
+}
+
+// softExpire marks due elements that are still fresh stale and schedules
+// them again at the end of their grace period. It returns the elements
+// whose grace period is over, filtered in place. Callers must hold mu.
+func (t *timedMap) softExpire(els []*element) (over []*element) {
+	over = els[:0]
+	var stale []*element
+	for _, el := range els {
+		if el.stale {
+			over = append(over, el)
+			continue
+		}
+		t.beforeWrite(el)
+		el.stale = true
+		el.ExpiresAt = t.ticks(time.Unix(0, t.unixNano(el.ExpiresAt)+int64(t.grace)))
+		t.sched.add(el)
+		if el.silent {
+			continue
+		}
+		t.notify(EventStale, el)
+		stale = append(stale, el)
+	}
+	if len(stale) > 0 && t.onStale != nil {
+		t.after(func() {
+			for _, el := range stale {
+				t.dispatchTo(t.onStale, el.Key, el.Value, el.priority)
+			}
+		})
+	}
+	return over
+}
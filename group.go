@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Shared cleaner
+// --------------------------------------------------------------------
+
+// expiryDriver sweeps a map in place of its cleaner goroutine. While
+// the cleaner is running, the map reports every change of its next
+// deadline (UnixNano, math.MaxInt64 for none) to reschedule with mu
+// held, and the driver calls sweepDriven once it is due.
+type expiryDriver interface {
+	add(t *timedMap)
+	remove(t *timedMap, wait bool) // wait for a sweep of t in progress
+	reschedule(t *timedMap, at int64)
+}
+
+// sweepDriven is sweep for a map driven by an expiryDriver. A sweep
+// that panics is retried after cleanerRestartDelay.
+func (t *timedMap) sweepDriven() {
+	defer func() {
+		if r := recover(); r != nil {
+			t.cleanerPanics.Add(1)
+			t.logf("temap: cleaner panic (retrying): %v", r)
+			t.driver.reschedule(t, time.Now().Add(cleanerRestartDelay).UnixNano())
+		}
+	}()
+	t.sweep(-1)
+}
+
+// CleanerGroup expires the entries of many maps from a single goroutine
+// and timer, for services with many small maps. Each member map tells the
+// group its next deadline and the group sweeps whichever map is due
+// first. Maps join with WithCleanerGroup; WithSuspendCatchUp and
+// WithExpiryBound do not apply to them. Close the group after its maps.
+type CleanerGroup struct {
+	mu      sync.Mutex
+	idle    sync.Cond // signalled when a sweep ends
+	members map[*timedMap]*groupEntry
+	due     groupHeap
+
+	wake chan struct{}
+	stop chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// groupEntry is a member map and its next deadline in UnixNano.
+type groupEntry struct {
+	t        *timedMap
+	at       int64
+	index    int // position in due, -1 if nothing is scheduled
+	sweeping bool
+}
+
+// NewCleanerGroup starts a group's goroutine.
+func NewCleanerGroup() *CleanerGroup {
+	g := &CleanerGroup{
+		members: make(map[*timedMap]*groupEntry),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	g.idle.L = &g.mu
+
+	ctx := pprof.WithLabels(context.Background(), pprof.Labels("temap.role", "cleaner-group"))
+	g.wg.Add(1)
+	goLabeled(ctx, func() {
+		defer g.wg.Done()
+		g.run()
+	})
+	return g
+}
+
+// WithCleanerGroup has g expire the map's entries instead of a cleaner
+// goroutine of its own. It has no effect with BackendTimers.
+func WithCleanerGroup(g *CleanerGroup) Option {
+	return func(t *TimedMap) {
+		t.driver = g
+	}
+}
+
+// Size returns the number of maps the group is currently cleaning.
+func (g *CleanerGroup) Size() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.members)
+}
+
+// Close stops the group's goroutine. Member maps stop expiring entries.
+func (g *CleanerGroup) Close() {
+	g.once.Do(func() { close(g.stop) })
+	g.wg.Wait()
+}
+
+// add makes t a member, due for a sweep right away.
+func (g *CleanerGroup) add(t *timedMap) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.members[t]; ok {
+		return
+	}
+	e := &groupEntry{t: t, index: -1}
+	g.members[t] = e
+	g.set(e, time.Now().UnixNano())
+}
+
+// remove drops t from the group, waiting for a sweep of t in progress if
+// wait is set.
+func (g *CleanerGroup) remove(t *timedMap, wait bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e, ok := g.members[t]
+	if !ok {
+		return
+	}
+	delete(g.members, t)
+	if e.index >= 0 {
+		heap.Remove(&g.due, e.index)
+	}
+	for wait && e.sweeping {
+		g.idle.Wait()
+	}
+}
+
+// reschedule records t's next deadline, math.MaxInt64 for none. Called
+// with t.mu held.
+func (g *CleanerGroup) reschedule(t *timedMap, at int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if e, ok := g.members[t]; ok {
+		g.set(e, at)
+	}
+}
+
+// set moves e to deadline at and wakes the goroutine if at is now the
+// earliest. Callers must hold mu.
+func (g *CleanerGroup) set(e *groupEntry, at int64) {
+	e.at = at
+	switch {
+	case at == math.MaxInt64:
+		if e.index >= 0 {
+			heap.Remove(&g.due, e.index)
+		}
+		return
+	case e.index < 0:
+		heap.Push(&g.due, e)
+	default:
+		heap.Fix(&g.due, e.index)
+	}
+	if e.index == 0 {
+		select {
+		case g.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run sweeps due maps until the group is closed.
+func (g *CleanerGroup) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	var due []*groupEntry
+	for {
+		g.mu.Lock()
+		now := time.Now().UnixNano()
+		due = due[:0]
+		for len(g.due) > 0 && g.due[0].at <= now {
+			e := heap.Pop(&g.due).(*groupEntry)
+			e.sweeping = true
+			due = append(due, e)
+		}
+		wait := cleanerIdleWait
+		if len(g.due) > 0 {
+			wait = time.Duration(g.due[0].at - now)
+		}
+		g.mu.Unlock()
+
+		if len(due) > 0 {
+			for _, e := range due {
+				e.t.sweepDriven()
+			}
+			g.mu.Lock()
+			for _, e := range due {
+				e.sweeping = false
+			}
+			g.idle.Broadcast()
+			g.mu.Unlock()
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-g.wake:
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// groupHeap orders member maps by next deadline.
+type groupHeap []*groupEntry
+
+func (h groupHeap) Len() int           { return len(h) }
+func (h groupHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h groupHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *groupHeap) Push(x any) {
+	e := x.(*groupEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *groupHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"sort"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Ordered index of string keys
+// --------------------------------------------------------------------
+
+// skipMaxLevel allows for about 4^24 keys at p = 1/4.
+const skipMaxLevel = 24
+
+// skipIndex is a skip list of string keys kept in ascending order. It
+// backs prefix and range queries, see WithPrefixIndex.
+type skipIndex struct {
+	head  skipNode
+	level int
+	n     int
+	rnd   uint64
+}
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+func newSkipIndex() *skipIndex {
+	s := &skipIndex{level: 1, rnd: uint64(time.Now().UnixNano()) | 1}
+	s.head.next = make([]*skipNode, skipMaxLevel)
+	return s
+}
+
+// randomLevel picks a node height with p = 1/4 per extra level.
+func (s *skipIndex) randomLevel() int {
+	l := 1
+	for l < skipMaxLevel {
+		s.rnd ^= s.rnd << 13
+		s.rnd ^= s.rnd >> 7
+		s.rnd ^= s.rnd << 17
+		if s.rnd&3 != 0 {
+			break
+		}
+		l++
+	}
+	return l
+}
+
+// seek fills update with the last node before key on every level.
+func (s *skipIndex) seek(key string, update *[skipMaxLevel]*skipNode) *skipNode {
+	x := &s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	return x.next[0]
+}
+
+func (s *skipIndex) insert(key string) {
+	var update [skipMaxLevel]*skipNode
+	if x := s.seek(key, &update); x != nil && x.key == key {
+		return
+	}
+
+	l := s.randomLevel()
+	for i := s.level; i < l; i++ {
+		update[i] = &s.head
+	}
+	s.level = max(s.level, l)
+
+	x := &skipNode{key: key, next: make([]*skipNode, l)}
+	for i := 0; i < l; i++ {
+		x.next[i] = update[i].next[i]
+		update[i].next[i] = x
+	}
+	s.n++
+}
+
+func (s *skipIndex) remove(key string) {
+	var update [skipMaxLevel]*skipNode
+	x := s.seek(key, &update)
+	if x == nil || x.key != key {
+		return
+	}
+	for i := 0; i < len(x.next); i++ {
+		update[i].next[i] = x.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.n--
+}
+
+// ascend calls fn for every key >= from in ascending order until fn
+// returns false.
+func (s *skipIndex) ascend(from string, fn func(key string) bool) {
+	var update [skipMaxLevel]*skipNode
+	for x := s.seek(from, &update); x != nil; x = x.next[0] {
+		if !fn(x.key) {
+			return
+		}
+	}
+}
+
+func (s *skipIndex) reset() {
+	clear(s.head.next)
+	s.level, s.n = 1, 0
+}
+
+// WithPrefixIndex keeps string keys in an ordered index, so prefix and
+// range operations such as RemoveByPrefix and KeysInRange only visit
+// matching keys instead of the whole map, at the cost of O(log n) extra
+// work per insert and delete.
+func WithPrefixIndex() Option {
+	return func(t *TimedMap) {
+		t.index = newSkipIndex()
+	}
+}
+
+// indexKey adds key to the ordered index. Callers must hold mu.
+func (t *timedMap) indexKey(key any) {
+	if s, ok := key.(string); ok && t.index != nil {
+		t.index.insert(s)
+	}
+}
+
+// unindexKey drops key from the ordered index. Callers must hold mu.
+func (t *timedMap) unindexKey(key any) {
+	if s, ok := key.(string); ok && t.index != nil {
+		t.index.remove(s)
+	}
+}
+
+// SortedKeys returns the string keys in ascending order; other keys are
+// left out. It walks the ordered index with WithPrefixIndex and sorts a
+// copy of the keys otherwise.
+func (t *timedMap) SortedKeys() []string {
+	return t.KeysInRange("", "")
+}
+
+// KeysInRange returns the string keys k with from <= k < to in ascending
+// order; an empty to means no upper bound. With WithPrefixIndex only the
+// keys in range are visited.
+func (t *timedMap) KeysInRange(from, to string) []string {
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	var keys []string
+	if t.index != nil {
+		t.index.ascend(from, func(key string) bool {
+			if to != "" && key >= to {
+				return false
+			}
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	}
+
+	for k := range t.items {
+		if s, ok := k.(string); ok && s >= from && (to == "" || s < to) {
+			keys = append(keys, s)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Consistency checks
+// --------------------------------------------------------------------
+
+// ErrInconsistent is wrapped by the errors CheckIntegrity returns.
+var ErrInconsistent = errors.New("temap: inconsistent map state")
+
+// integrityCheckEvery is how often the cleaner runs CheckIntegrity under
+// WithConsistencyChecks.
+const integrityCheckEvery = time.Second
+
+// integrityMaxProblems caps the problems one CheckIntegrity error lists.
+const integrityMaxProblems = 10
+
+// WithConsistencyChecks makes the map verify its invariants as it runs:
+// every write checks that the scheduler really holds the entry it just
+// scheduled, and the cleaner runs CheckIntegrity at most once a second.
+// Problems are logged, counted in the "integrity_errors" stat and
+// repaired as by Repair, which the "integrity_repairs" stat counts. The
+// periodic check walks the whole map, so this is meant for debugging
+// and tests rather than large production maps.
+func WithConsistencyChecks() Option {
+	return func(t *TimedMap) {
+		t.checks = true
+	}
+}
+
+// CheckIntegrity verifies that the map's internal structures agree with
+// each other: every scheduled entry is in the map and temporary, every
+// temporary entry is scheduled exactly where the scheduler thinks it is,
+// and the size counter and the key, value and scan indexes match the
+// entries. It returns nil if they do, and an error wrapping
+// ErrInconsistent listing the problems otherwise. It holds the read lock
+// for the duration of the walk.
+func (t *timedMap) CheckIntegrity() error {
+	t.rlock()
+	defer t.mu.RUnlock()
+	return t.checkIntegrity()
+}
+
+// checkIntegrity is CheckIntegrity for callers that hold mu.
+func (t *timedMap) checkIntegrity() error {
+	var problems []string
+	bad := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if n := t.size.Load(); n != int64(len(t.items)) {
+		bad("size counter is %d with %d entries", n, len(t.items))
+	}
+	if c, ok := t.sched.(checkedScheduler); ok {
+		if err := c.check(); err != nil {
+			bad("%v", err)
+		}
+	}
+
+	scheduled := 0
+	t.sched.each(func(el *element) bool {
+		scheduled++
+		switch {
+		case t.items[el.Key] != el:
+			bad("scheduled key %v is not in the map", el.Key)
+		case el.ExpiresAt == ElementPermanent:
+			bad("permanent key %v is scheduled", el.Key)
+		case el.deciding:
+			bad("key %v is scheduled while awaiting its verdict", el.Key)
+		}
+		return len(problems) < integrityMaxProblems
+	})
+	if n := t.sched.len(); n != scheduled {
+		bad("scheduler counts %d entries but holds %d", n, scheduled)
+	}
+
+	stringKeys, valued := 0, 0
+	for key, el := range t.items {
+		if len(problems) >= integrityMaxProblems {
+			break
+		}
+		if el.Key != key {
+			bad("entry under key %v claims key %v", key, el.Key)
+		}
+		temporary := el.ExpiresAt != ElementPermanent && !el.deciding
+		if held := t.sched.holds(el); held != temporary {
+			bad("key %v is temporary=%v but scheduled=%v", key, temporary, held)
+		}
+		if el.pos < 0 || el.pos >= len(t.slots.els) || t.slots.els[el.pos] != el {
+			bad("key %v is not in its scan slot %d", key, el.pos)
+		}
+		if _, ok := key.(string); ok {
+			stringKeys++
+		}
+		if t.values != nil && el.valueKey != nil {
+			valued++
+			if _, ok := t.values.keys[el.valueKey][key]; !ok {
+				bad("key %v is missing from the value index", key)
+			}
+		}
+	}
+
+	if t.index != nil {
+		indexed := 0
+		t.index.ascend("", func(key string) bool {
+			indexed++
+			if _, ok := t.items[key]; !ok {
+				bad("indexed key %q is not in the map", key)
+			}
+			return len(problems) < integrityMaxProblems
+		})
+		if indexed != stringKeys {
+			bad("key index holds %d keys for %d string keys", indexed, stringKeys)
+		}
+	}
+	if t.values != nil {
+		indexed := 0
+		for _, keys := range t.values.keys {
+			indexed += len(keys)
+		}
+		if indexed != valued {
+			bad("value index holds %d keys for %d indexed entries", indexed, valued)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	if len(problems) > integrityMaxProblems {
+		problems = problems[:integrityMaxProblems]
+	}
+	return fmt.Errorf("%w: %q", ErrInconsistent, problems)
+}
+
+// Repair runs CheckIntegrity and, if it finds problems, rebuilds the
+// schedule, the size counter and the key and value indexes from the
+// entries, so that orphaned deadlines are dropped and every temporary
+// entry expires again. It returns the problems found, or nil if there
+// were none.
+func (t *timedMap) Repair() error {
+	t.lock()
+	defer t.unlock()
+
+	err := t.checkIntegrity()
+	if err != nil {
+		t.repair()
+	}
+	return err
+}
+
+// repair rebuilds everything that is derived from items, except the scan
+// table, which running scans depend on. Callers must hold mu.
+func (t *timedMap) repair() {
+	t.sched.reset()
+	for _, el := range t.items {
+		el.index = -1
+	}
+	end := t.batch()
+	for _, el := range t.items {
+		if el.ExpiresAt != ElementPermanent && !el.deciding {
+			t.sched.add(el)
+		}
+	}
+	end()
+	if next, ok := t.sched.next(); ok {
+		t.wakeBy(next)
+	}
+
+	t.size.Store(int64(len(t.items)))
+	if t.index != nil {
+		t.index.reset()
+		for key := range t.items {
+			t.indexKey(key)
+		}
+	}
+	if t.values != nil {
+		clear(t.values.keys)
+		for _, el := range t.items {
+			t.indexValue(el)
+		}
+	}
+	t.integrityRepairs.Add(1)
+	t.logf("temap: rebuilt the schedule and indexes from %d entries", len(t.items))
+}
+
+// checkScheduled verifies, under WithConsistencyChecks, that el was
+// scheduled as it should have been. Callers must hold mu.
+func (t *timedMap) checkScheduled(el *element) {
+	if !t.sched.holds(el) {
+		t.integrityFailed(fmt.Errorf("%w: key %v was scheduled but the scheduler does not hold it", ErrInconsistent, el.Key))
+	}
+}
+
+// checkPeriodically runs checkIntegrity if it has not run for
+// integrityCheckEvery. Callers must hold mu.
+func (t *timedMap) checkPeriodically() {
+	now := time.Now()
+	if now.Sub(t.lastCheck) < integrityCheckEvery {
+		return
+	}
+	t.lastCheck = now
+	if err := t.checkIntegrity(); err != nil {
+		t.integrityFailed(err)
+	}
+}
+
+// integrityFailed reports a failed consistency check and repairs the
+// map. Callers must hold mu.
+func (t *timedMap) integrityFailed(err error) {
+	t.integrityErrors.Add(1)
+	t.logf("%v", err)
+	t.repair()
+}
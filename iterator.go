@@ -16,14 +16,224 @@
 
 package temap
 
-// ToMap returns a safe snapshot of all items.
-func (t *TimedMap) ToMap() map[any]any {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+import (
+	"container/heap"
+	"context"
+	"sort"
+)
+
+// ToMap returns a safe snapshot of all items, see Entries.
+func (t *timedMap) ToMap() map[any]any {
+	entries := t.copyEntries(nil)
+	out := make(map[any]any, len(entries))
+	for _, e := range entries {
+		out[e.Key] = t.decode(e.Value)
+	}
+	return out
+}
+
+// Keys returns every key, as of the moment it was called, see Entries.
+func (t *timedMap) Keys() []any {
+	entries := t.copyEntries(nil)
+	keys := make([]any, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return keys
+}
+
+// Entries returns every entry as of the moment it was called. The copy
+// is taken a chunk at a time, with writers saving entries it has not
+// reached yet before changing them, so writers are never blocked for
+// the whole copy of a large map.
+func (t *timedMap) Entries() []Entry {
+	entries := t.copyEntries(nil)
+	for i := range entries {
+		entries[i].Value = t.decode(entries[i].Value)
+	}
+	return entries
+}
+
+// Range calls fn for every entry until fn returns false. Unlike
+// ForEachByExpiry, no lock is held while fn runs, so fn may read or
+// modify the map, including removing the current key. Range visits the
+// keys present when it started; entries removed before their turn are
+// skipped and entries added meanwhile may not be visited.
+func (t *timedMap) Range(fn func(key, value any) bool) {
+	_ = t.RangeCtx(context.Background(), fn)
+}
 
-	out := make(map[any]any, len(t.items))
-	for k, v := range t.items {
-		out[k] = v.Value
+// RangeCtx is Range, except that it stops and returns ctx.Err() once ctx
+// is done.
+func (t *timedMap) RangeCtx(ctx context.Context, fn func(key, value any) bool) error {
+	t.rlock()
+	keys := make([]any, 0, len(t.items))
+	for k := range t.items {
+		keys = append(keys, k)
 	}
+	t.mu.RUnlock()
+
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		t.rlock()
+		el, ok := t.items[k]
+		var value any
+		if ok {
+			value = el.Value
+		}
+		t.mu.RUnlock()
+
+		if ok && !fn(k, t.decode(value)) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Filter returns the entries for which pred returns true. Like Range, it
+// holds no lock while pred runs.
+func (t *timedMap) Filter(pred func(key, value any) bool) map[any]any {
+	out, _ := t.FilterCtx(context.Background(), pred)
 	return out
 }
+
+// FilterCtx is Filter, except that it stops once ctx is done and returns
+// the entries matched so far along with ctx.Err().
+func (t *timedMap) FilterCtx(ctx context.Context, pred func(key, value any) bool) (map[any]any, error) {
+	out := make(map[any]any)
+	err := t.RangeCtx(ctx, func(key, value any) bool {
+		if pred(key, value) {
+			out[key] = value
+		}
+		return true
+	})
+	return out, err
+}
+
+// TemporaryKeys returns the keys of all entries with a deadline.
+func (t *timedMap) TemporaryKeys() []any {
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	keys := make([]any, 0, t.sched.len())
+	t.sched.each(func(el *element) bool {
+		keys = append(keys, el.Key)
+		return true
+	})
+	return keys
+}
+
+// PermanentKeys returns the keys of all entries that never expire.
+func (t *timedMap) PermanentKeys() []any {
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	keys := make([]any, 0, len(t.items)-t.sched.len())
+	for k, el := range t.items {
+		if el.ExpiresAt == ElementPermanent {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// ForEachByExpiry calls fn for every temporary entry, soonest deadline
+// first, until fn returns false. With the heap backend the heap is walked
+// lazily without modifying it, so stopping early costs O(k log k) for k
+// visited entries; other backends sort a copy.
+//
+// The map is read-locked while fn runs; fn must not modify the map.
+func (t *timedMap) ForEachByExpiry(fn func(e Entry) bool) {
+	_ = t.ForEachByExpiryCtx(context.Background(), fn)
+}
+
+// ForEachByExpiryCtx is ForEachByExpiry, except that it stops and returns
+// ctx.Err() once ctx is done.
+func (t *timedMap) ForEachByExpiryCtx(ctx context.Context, fn func(e Entry) bool) error {
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	var err error
+	check := ctxChecker(ctx)
+	t.ascend(func(el *element) bool {
+		if err = check(); err != nil {
+			return false
+		}
+		e := t.entry(el)
+		e.Value = t.decode(e.Value)
+		return fn(e)
+	})
+	return err
+}
+
+// LongestLived returns up to n temporary entries furthest from expiry,
+// latest deadline first, along with the number of permanent entries. It
+// is meant for spotting entries given absurd TTLs.
+func (t *timedMap) LongestLived(n int) (entries []Entry, permanent int) {
+	if n <= 0 {
+		return nil, t.CountPermanent()
+	}
+
+	t.rlock()
+	top := make(latestHeap, 0, min(n, t.sched.len()))
+	t.sched.each(func(el *element) bool {
+		switch {
+		case len(top) < n:
+			heap.Push(&top, el)
+		case el.ExpiresAt > top[0].ExpiresAt:
+			top[0] = el
+			heap.Fix(&top, 0)
+		}
+		return true
+	})
+	entries = make([]Entry, len(top))
+	for i := len(top) - 1; i >= 0; i-- {
+		entries[i] = t.entry(heap.Pop(&top).(*element))
+	}
+	permanent = len(t.items) - t.sched.len()
+	t.mu.RUnlock()
+
+	for i := range entries {
+		entries[i].Value = t.decode(entries[i].Value)
+	}
+	return entries, permanent
+}
+
+// latestHeap is a min-heap of deadlines that keeps the n latest seen,
+// see LongestLived. Unlike expiryHeap it leaves element.index alone.
+type latestHeap []*element
+
+func (h latestHeap) Len() int           { return len(h) }
+func (h latestHeap) Less(i, j int) bool { return h[i].ExpiresAt < h[j].ExpiresAt }
+func (h latestHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *latestHeap) Push(x any)        { *h = append(*h, x.(*element)) }
+func (h *latestHeap) Pop() any {
+	old := *h
+	el := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return el
+}
+
+// ascend calls fn for scheduled elements in deadline order until fn
+// returns false. Callers must hold mu.
+func (t *timedMap) ascend(fn func(el *element) bool) {
+	if o, ok := t.sched.(orderedScheduler); ok {
+		o.ascend(fn)
+		return
+	}
+
+	els := make([]*element, 0, t.sched.len())
+	t.sched.each(func(el *element) bool {
+		els = append(els, el)
+		return true
+	})
+	sort.Slice(els, func(i, j int) bool { return els[i].ExpiresAt < els[j].ExpiresAt })
+	for _, el := range els {
+		if !fn(el) {
+			return
+		}
+	}
+}
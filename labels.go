@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// --------------------------------------------------------------------
+// Map names and pprof labels
+// --------------------------------------------------------------------
+
+// WithName names the map. The name labels the map's goroutines in
+// profiles, see labels.
+func WithName(name string) Option {
+	return func(t *TimedMap) {
+		t.name = name
+	}
+}
+
+// Name returns the name given with WithName, if any.
+func (t *timedMap) Name() string {
+	return t.name
+}
+
+// goroutineLabels holds one labelled context per role of the map's
+// goroutines. Every goroutine the map starts carries the pprof labels
+// "temap.map" (the map's name, if any) and "temap.role", so CPU profiles
+// can tell the cleaner of one map from another's.
+type goroutineLabels struct {
+	cleaner  context.Context
+	callback context.Context
+	async    context.Context
+}
+
+func newGoroutineLabels(name string) goroutineLabels {
+	ctx := func(role string) context.Context {
+		labels := pprof.Labels("temap.role", role)
+		if name != "" {
+			labels = pprof.Labels("temap.map", name, "temap.role", role)
+		}
+		return pprof.WithLabels(context.Background(), labels)
+	}
+	return goroutineLabels{
+		cleaner:  ctx("cleaner"),
+		callback: ctx("callback"),
+		async:    ctx("async"),
+	}
+}
+
+// goLabeled runs fn on a new goroutine labelled with the labels of ctx.
+func goLabeled(ctx context.Context, fn func()) {
+	go func() {
+		pprof.SetGoroutineLabels(ctx)
+		fn()
+	}()
+}
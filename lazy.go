@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"math"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Lazy cleaner
+// --------------------------------------------------------------------
+
+// WithLazyCleaner defers starting the cleaner goroutine until the first
+// temporary entry is inserted, and the callback workers until the first
+// callback is due, so maps holding mostly permanent entries cost no
+// goroutines. With idle > 0 the cleaner also exits again once nothing
+// has been scheduled for idle, and comes back with the next temporary
+// entry. CleanerRunning reports false while the cleaner is parked. It
+// has no effect with BackendTimers or WithCleanerGroup, which run no
+// cleaner goroutine of their own.
+func WithLazyCleaner(idle time.Duration) Option {
+	return func(t *TimedMap) {
+		t.lazy = true
+		t.idleStop = max(idle, 0)
+	}
+}
+
+// parkable reports whether the cleaner may be parked instead of running.
+func (t *timedMap) parkable() bool {
+	return t.lazy && t.driver == nil && t.backend != BackendTimers
+}
+
+// park parks the cleaner if nothing has been scheduled since idleSince
+// for idleStop, and reports whether it did, in which case the cleaner
+// goroutine must exit. wakeBy restarts it.
+func (t *timedMap) park(idleSince *time.Time) bool {
+	t.lock()
+	defer t.unlock()
+
+	if t.sched.len() > 0 || !t.parkable() {
+		*idleSince = time.Time{}
+		return false
+	}
+	now := time.Now()
+	if idleSince.IsZero() {
+		*idleSince = now
+		return false
+	}
+	if now.Sub(*idleSince) < t.idleStop {
+		return false
+	}
+	*idleSince = time.Time{}
+	t.parked = true
+	t.nextWake = math.MaxInt64
+	t.cleanerAlive.Store(false)
+	return true
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Abandoned maps
+// --------------------------------------------------------------------
+
+// leaked counts maps garbage collected without Close, see LeakedMaps.
+var leaked atomic.Uint64
+
+// LeakedMaps returns how many maps became unreachable without being
+// closed. Such maps are closed when the garbage collector finds them, so
+// their goroutines do not outlive them, and entries still waiting to
+// expire are expired then, so that their callbacks run. Since that may
+// take a while, a growing count points at a missing Close. Tests can
+// compare it before and after running.
+func LeakedMaps() uint64 {
+	return leaked.Load()
+}
+
+// abandoned is the finalizer of a TimedMap handle. It expires the
+// pending entries and closes the map, unless the owner already closed
+// it. While an expiry callback or Run is executing, the map is still in
+// use through the internals, which do not hold the handle; it is left
+// running and checked again at the next collection.
+func (t *TimedMap) abandoned() {
+	t.life.Lock()
+	closed := t.state == cleanerClosed
+	t.life.Unlock()
+	if closed {
+		return
+	}
+	if t.busy() {
+		runtime.SetFinalizer(t, (*TimedMap).abandoned)
+		return
+	}
+	leaked.Add(1)
+	// Keep the finalizer goroutine free.
+	go func(t *timedMap) {
+		t.expirePending()
+		t.Close()
+	}(t.timedMap)
+}
+
+// busy reports whether an expiry callback or Run is executing.
+func (t *timedMap) busy() bool {
+	return t.runs.Load() > 0 || t.inflight.Load() > 0
+}
+
+// expirePending expires every entry with a deadline at once, as if it
+// were due, so that its callback runs before an abandoned map closes.
+func (t *timedMap) expirePending() {
+	t.lock()
+	defer t.unlock()
+
+	if t.frozen || t.closed {
+		return
+	}
+	var els []*element
+	t.sched.each(func(el *element) bool {
+		els = append(els, el)
+		return true
+	})
+	for _, el := range els {
+		t.sched.cancel(el)
+	}
+	t.expire(els, time.Now().UnixNano())
+}
+
+// Close is timedMap.Close on the handle, so that a deferred m.Close()
+// keeps the map from being abandoned until it runs.
+func (t *TimedMap) Close() {
+	t.timedMap.Close()
+	runtime.KeepAlive(t)
+}
+
+// Run is timedMap.Run on the handle, which it keeps reachable while it
+// blocks.
+func (t *TimedMap) Run(ctx context.Context) error {
+	defer runtime.KeepAlive(t)
+	return t.timedMap.Run(ctx)
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Read-through loading
+// --------------------------------------------------------------------
+
+// LoaderFunc loads the value of a key that is missing from the map. The
+// value is stored with the returned ttl, or permanently if ttl <= 0.
+type LoaderFunc func(ctx context.Context, key any) (value any, ttl time.Duration, err error)
+
+// ErrNoLoader is returned by GetOrLoad when the map has no loader.
+var ErrNoLoader = errors.New("temap: no loader configured")
+
+// loadCall is an in-flight load shared by concurrent GetOrLoad calls.
+// Its bookkeeping fields are guarded by the loader's mu.
+type loadCall struct {
+	done  chan struct{}
+	value any
+	stale bool
+	err   error
+
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	waiters   int
+	deadline  time.Time   // latest deadline of the waiters
+	unbounded bool        // some waiter has no deadline
+	timer     *time.Timer // cancels ctx at deadline
+}
+
+// loadContext is the context of a shared load: it keeps the values of
+// the context that started the load, is cancelled once every waiter's
+// context is done, and has the latest of their deadlines.
+type loadContext struct {
+	context.Context
+	mu *sync.Mutex
+	c  *loadCall
+}
+
+func (ctx loadContext) Deadline() (time.Time, bool) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.c.unbounded {
+		return time.Time{}, false
+	}
+	return ctx.c.deadline, true
+}
+
+func (ctx loadContext) Err() error {
+	if ctx.Context.Err() == nil {
+		return nil
+	}
+	return context.Cause(ctx.Context)
+}
+
+// join counts a waiter with context ctx, pushing the deadline of the
+// load back to that of ctx. Callers must hold the loader's mu.
+func (c *loadCall) join(ctx context.Context) {
+	c.waiters++
+	d, ok := ctx.Deadline()
+	switch {
+	case c.unbounded:
+	case !ok:
+		c.unbounded = true
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+	case c.timer == nil:
+		c.deadline = d
+		c.timer = time.AfterFunc(time.Until(d), func() { c.cancel(context.DeadlineExceeded) })
+	case d.After(c.deadline):
+		c.deadline = d
+		c.timer.Reset(time.Until(d))
+	}
+}
+
+type loaderState struct {
+	fn         LoaderFunc
+	serveStale bool
+
+	mu    sync.Mutex
+	calls map[any]*loadCall
+}
+
+// WithLoader makes GetOrLoad call fn for missing keys. Concurrent misses
+// on the same key share a single call to fn.
+func WithLoader(fn LoaderFunc) Option {
+	return func(t *TimedMap) {
+		t.loader.fn = fn
+	}
+}
+
+// WithServeStale makes GetOrLoad fail open: when the loader returns an
+// error and a stale value is retained (see WithStaleRetention), that
+// value is returned flagged as stale instead of the error.
+func WithServeStale() Option {
+	return func(t *TimedMap) {
+		t.loader.serveStale = true
+	}
+}
+
+// GetOrLoad returns the value of key, loading and storing it with the
+// loader if it is missing. stale is set when the loader failed and a
+// stale value was served instead, see WithServeStale.
+func (t *timedMap) GetOrLoad(key any) (value any, stale bool, err error) {
+	return t.getOrLoad(context.Background(), key)
+}
+
+// GetOrLoadCtx is GetOrLoad with a context whose values are passed to
+// the loader. A caller whose context ends returns ctx.Err() at once. The
+// shared load goes on while any caller still waits for it; it is
+// cancelled once all of them gave up, and its context has the latest of
+// their deadlines.
+func (t *timedMap) GetOrLoadCtx(ctx context.Context, key any) (value any, stale bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	return t.getOrLoad(ctx, key)
+}
+
+func (t *timedMap) getOrLoad(ctx context.Context, key any) (any, bool, error) {
+	if v, _, ok := t.Get(key); ok {
+		return v, false, nil
+	}
+	l := &t.loader
+	if l.fn == nil {
+		return nil, false, ErrNoLoader
+	}
+
+	l.mu.Lock()
+	c, ok := l.calls[key]
+	if !ok {
+		// The load outlives the caller that started it if other callers
+		// still wait for it, so it only keeps ctx's values.
+		c = &loadCall{done: make(chan struct{})}
+		c.ctx, c.cancel = context.WithCancelCause(context.WithoutCancel(ctx))
+		if l.calls == nil {
+			l.calls = make(map[any]*loadCall)
+		}
+		l.calls[key] = c
+	}
+	c.join(ctx)
+	l.mu.Unlock()
+
+	if !ok {
+		go t.load(loadContext{c.ctx, &l.mu, c}, key, c)
+	}
+
+	select {
+	case <-c.done:
+		return c.value, c.stale, c.err
+	case <-ctx.Done():
+		l.mu.Lock()
+		if c.waiters--; c.waiters == 0 {
+			// Later callers start a load of their own.
+			if l.calls[key] == c {
+				delete(l.calls, key)
+			}
+			c.cancel(context.Canceled)
+		}
+		l.mu.Unlock()
+		return nil, false, ctx.Err()
+	}
+}
+
+// runLoader calls the loader, turning a panic into an error since the
+// load runs on its own goroutine.
+func (t *timedMap) runLoader(ctx context.Context, key any) (value any, ttl time.Duration, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("temap: loader panic: %v", r)
+		}
+	}()
+	return t.loader.fn(ctx, key)
+}
+
+// load runs the loader for key and publishes the result on c.
+func (t *timedMap) load(ctx context.Context, key any, c *loadCall) {
+	l := &t.loader
+	defer func() {
+		l.mu.Lock()
+		if l.calls[key] == c {
+			delete(l.calls, key)
+		}
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		l.mu.Unlock()
+		c.cancel(context.Canceled)
+		close(c.done)
+	}()
+
+	value, ttl, err := t.runLoader(ctx, key)
+	if err == nil {
+		t.SetWithTTL(key, value, ttl)
+		c.value = value
+		return
+	}
+
+	if l.serveStale {
+		if v, stale, ok := t.GetStale(key); ok {
+			c.value, c.stale = v, stale
+			return
+		}
+	}
+	c.err = err
+}
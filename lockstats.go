@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Lock wait statistics
+// --------------------------------------------------------------------
+
+// lockWaitSampleEvery is how many contended lock acquisitions there are
+// per timed one; timing every one would slow down the contended path.
+const lockWaitSampleEvery = 8
+
+// lockWaitStats times a sample of the lock acquisitions that had to wait,
+// separately for writers and readers.
+type lockWaitStats struct {
+	write, read waitSamples
+}
+
+type waitSamples struct {
+	n     atomic.Uint64
+	total atomic.Int64 // nanoseconds
+	max   atomic.Int64 // nanoseconds
+}
+
+func (s *waitSamples) sample(d time.Duration) {
+	s.n.Add(1)
+	s.total.Add(int64(d))
+	for {
+		m := s.max.Load()
+		if int64(d) <= m || s.max.CompareAndSwap(m, int64(d)) {
+			return
+		}
+	}
+}
+
+// avg returns the mean sampled wait.
+func (s *waitSamples) avg() time.Duration {
+	n := s.n.Load()
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(s.total.Load() / int64(n))
+}
+
+// into adds the samples to stats under prefix.
+func (s *waitSamples) into(stats map[string]uint64, prefix string) {
+	stats[prefix+"_samples"] = s.n.Load()
+	stats[prefix+"_ns_total"] = uint64(s.total.Load())
+	stats[prefix+"_ns_max"] = uint64(s.max.Load())
+}
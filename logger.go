@@ -0,0 +1,37 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+// Logger receives diagnostics from a TimedMap. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, args ...any)
+}
+
+// WithLogger sets where the map reports internal problems such as
+// recovered cleaner panics. The default is log.Default(); pass nil to
+// silence it.
+func WithLogger(l Logger) Option {
+	return func(t *TimedMap) {
+		t.logger = l
+	}
+}
+
+func (t *timedMap) logf(format string, args ...any) {
+	if t.logger != nil {
+		t.logger.Printf(format, args...)
+	}
+}
@@ -17,26 +17,163 @@
 package temap
 
 import (
-	"container/heap"
+	"crypto/cipher"
+	"log"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Get reports ElementDoesntExist as the expiry of missing keys and
+// ElementPermanent as that of permanent ones. No deadline is ever stored
+// as ElementPermanent, not even the Unix epoch, so the two cannot be
+// confused.
 const (
 	ElementDoesntExist = -1
 	ElementPermanent   = 0
 )
 
+// TimedMap is a map whose entries may expire. It is a handle on the map's
+// state: the cleaner and other internal goroutines only reference the
+// state, so a map dropped without Close can be garbage collected, see
+// LeakedMaps.
 type TimedMap struct {
-	mu       sync.RWMutex
-	items    map[any]*element
-	expHeap  expiryHeap
-	onExpire func(key, val any)
+	*timedMap
+}
+
+type timedMap struct {
+	mu        sync.RWMutex
+	lockWaits atomic.Uint64 // see lock
+	waits     lockWaitStats
+	items     map[any]*element
+	sched     expiryScheduler
+	onExpire  func(key, val any)
 
+	life   sync.Mutex // serializes cleaner state transitions
+	state  cleanerState
 	stopCh chan struct{}
-	wg     sync.WaitGroup
 
-	stopped bool // indicates if cleaner is currently stopped
+	lazy     bool          // see WithLazyCleaner
+	idleStop time.Duration // see WithLazyCleaner
+	parked   bool          // cleaner goroutine not running, guarded by mu
+	wg       sync.WaitGroup
+
+	inflight atomic.Int64 // expiry callbacks queued or running, see dispatch
+	runs     atomic.Int32 // Run calls in progress
+	pool     *callbackPool
+	shared   *WorkerPool // see WithWorkerPool
+	inline   bool        // see WithSyncCallbacks
+	manual   bool        // see WithManualExpiry
+
+	cleanerAlive  atomic.Bool
+	lastSweep     atomic.Int64 // UnixNano
+	cleanerPanics atomic.Uint64
+
+	logger Logger
+
+	name       string // see WithName
+	registered bool   // see NewNamed
+	labels     goroutineLabels
+
+	backend    Backend
+	backendRes time.Duration // see WithBackendResolution
+	wheelSlots int
+
+	version uint64 // last version handed out to an entry
+	gen     uint64 // bumped by RemoveAll and Flush, see clear
+
+	subs     []subscriber // copy-on-write, guarded by mu
+	subSeq   uint64
+	pending  []Event  // notifications queued while mu is held
+	deferred []func() // calls queued while mu is held
+	audit    *auditRing
+
+	codec          Codec
+	codecThreshold int
+	aead           cipher.AEAD
+	decodeErrors   atomic.Uint64
+
+	unit int64 // deadline precision in nanoseconds
+
+	arena  *arena
+	index  *skipIndex  // see WithPrefixIndex
+	values *valueIndex // see WithValueIndex
+	filter *missFilter // see WithMissFilter
+	slots  slotTable   // see Scan
+	cows   []*cowCopy  // copies in progress, see copyEntries
+
+	alarm *sizeAlarm
+	tombs *tombstones
+
+	loader loaderState
+
+	warmup    WarmupFunc    // see WithWarmup
+	warmAsync bool          // see WithAsyncWarmup
+	ready     chan struct{} // closed once warmup returned
+	warmErr   error         // set before ready is closed
+
+	async asyncWriter
+
+	sliding     bool          // see WithSlidingExpiration
+	maxLifetime time.Duration // see WithMaxLifetime
+	defaultTTL  time.Duration // see WithDefaultTTL
+
+	ttlPolicy func(key, value any) time.Duration // see WithTTLPolicy
+
+	capacity int // reserved size, see Reserve
+	peak     int // largest size since the map was last reallocated
+
+	ordered bool // maintain order, see WithInsertionOrder
+	order   orderList
+
+	wake     chan struct{} // signals the cleaner of an earlier deadline
+	nextWake int64         // deadline the cleaner sleeps until, guarded by mu
+
+	clock *coarseClock // see WithCoarseClock
+
+	driver expiryDriver // replaces the cleaner goroutine, see WithCleanerGroup
+
+	bound       time.Duration // see WithExpiryBound
+	boundMisses atomic.Uint64
+
+	slowAfter     time.Duration // see WithSlowCallbackThreshold
+	slowCallbacks atomic.Uint64
+
+	catchUp struct {
+		threshold time.Duration
+		batch     int
+		pause     time.Duration
+	}
+
+	profHook func(op ProfileOp, d time.Duration) // see WithProfiler
+	profRate uint64
+	profSeq  atomic.Uint64
+
+	decide func(key, value any) Verdict // see WithExpiryDecider
+
+	pastExpiry PastExpiry // see WithPastExpiry
+
+	observers []Observer // see WithObserver
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+
+	grace   time.Duration        // see WithGracePeriod
+	onStale func(key, value any) // see WithGracePeriod
+
+	classify func(key any) string // see WithKeyClassifier
+	classes  map[string]*classStats
+
+	size atomic.Int64 // len(items), for Size without locking
+
+	closed        bool   // see Close
+	frozen        bool   // see Freeze
+	frozenRejects uint64 // mutations rejected while frozen
+
+	checks           bool      // see WithConsistencyChecks
+	lastCheck        time.Time // last periodic CheckIntegrity
+	integrityErrors  atomic.Uint64
+	integrityRepairs atomic.Uint64
 
 	stats struct {
 		added     uint64
@@ -47,15 +184,33 @@ type TimedMap struct {
 }
 
 // New creates a TimedMap with a background cleaner.
-func New(onExpire func(key, val any)) *TimedMap {
-	tm := &TimedMap{
-		items:    make(map[any]*element),
+func New(onExpire func(key, val any), opts ...Option) *TimedMap {
+	tm := &timedMap{
 		onExpire: onExpire,
-		stopCh:   make(chan struct{}),
+		wake:     make(chan struct{}, 1),
+		unit:     int64(time.Nanosecond),
+		logger:   log.Default(),
+	}
+	t := &TimedMap{tm}
+	for _, opt := range opts {
+		opt(t)
 	}
-	heap.Init(&tm.expHeap)
-	tm.startCleaner()
-	return tm
+	tm.labels = newGoroutineLabels(tm.name)
+	if tm.shared != nil {
+		tm.pool = tm.shared.p
+	} else if tm.pool != nil {
+		tm.pool.labels = tm.labels.callback
+		if !tm.lazy {
+			tm.pool.ensureStarted()
+		}
+	}
+	tm.items, tm.sched = tm.newStorage(tm.capacity)
+	if !tm.manual {
+		tm.StartCleaner()
+	}
+	tm.startWarmup()
+	runtime.SetFinalizer(t, (*TimedMap).abandoned)
+	return t
 }
 
 // func New(interval time.Duration, timeout_callback func(key, val any)) *TimedMap {
@@ -74,176 +229,659 @@ func New(onExpire func(key, val any)) *TimedMap {
 // 	return t
 // }
 
+// SetTemporary sets a key with explicit expiration time. As with
+// SetExpiry, the zero time makes the key permanent.
+func (t *timedMap) SetTemporary(key, value any, expiresAt time.Time) {
+	defer t.profile(ProfileSet, t.profStart())
+	t.throttle()
+	value = t.encode(value)
 
-// SetTemporary sets a key with explicit expiration time.
-func (t *TimedMap) SetTemporary(key, value any, expiresAt time.Time) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	t.lock()
+	defer t.unlock()
 
-	exp := expiresAt.UnixNano()
-	if el, ok := t.items[key]; ok {
-		el.Value = value
-		el.ExpiresAt = exp
-		if el.ExpiresAt != ElementPermanent {
-			heap.Fix(&t.expHeap, el.index)
-		}
-	} else {
-		el := &element{Key: key, Value: value, ExpiresAt: exp}
-		t.items[key] = el
-		if exp != ElementPermanent {
-			heap.Push(&t.expHeap, el)
-		} else {
-			t.stats.permanent++
-		}
-		t.stats.added++
+	if t.rejectWrite() {
+		t.free(value)
+		return
 	}
+
+	exp := int64(ElementPermanent)
+	if !expiresAt.IsZero() {
+		exp = t.ticks(expiresAt)
+	}
+	t.set(key, value, exp)
 }
 
 // SetWithTTL sets a key that expires after the given TTL duration.
-func (t *TimedMap) SetWithTTL(key, value any, ttl time.Duration) {
+func (t *timedMap) SetWithTTL(key, value any, ttl time.Duration) {
 	if ttl <= 0 {
 		t.SetPermanent(key, value)
 		return
 	}
-	t.SetTemporary(key, value, time.Now().Add(ttl))
+	t.SetTemporary(key, value, t.now().Add(ttl))
+}
+
+// WithDefaultTTL sets the TTL Set gives entries; without it, or with
+// ttl <= 0, Set stores them permanently.
+func WithDefaultTTL(ttl time.Duration) Option {
+	return func(t *TimedMap) {
+		t.defaultTTL = max(ttl, 0)
+	}
+}
+
+// WithTTLPolicy makes Set ask policy for the TTL of each entry, e.g. by
+// value size or type. A result of 0 falls back to the default TTL and a
+// negative one, such as NoExpiry, stores the entry permanently. The
+// policy runs before the lock is taken and must not call into the map.
+func WithTTLPolicy(policy func(key, value any) time.Duration) Option {
+	return func(t *TimedMap) {
+		t.ttlPolicy = policy
+	}
+}
+
+// Set sets a key with the TTL given by the policy, see WithTTLPolicy, or
+// else the default TTL, see WithDefaultTTL.
+func (t *timedMap) Set(key, value any) {
+	ttl := t.defaultTTL
+	if t.ttlPolicy != nil {
+		if d := t.ttlPolicy(key, value); d != 0 {
+			ttl = d
+		}
+	}
+	t.SetWithTTL(key, value, ttl)
+}
+
+// SetIfVersion replaces the value of an existing key only if its current
+// version equals version, keeping the key's expiration unchanged.
+// Returns false if the key is missing or was written since version was read.
+func (t *timedMap) SetIfVersion(key, value any, version uint64) bool {
+	value = t.encode(value)
+
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		t.free(value)
+		return false
+	}
+
+	el, ok := t.items[key]
+	if !ok || el.version != version {
+		t.free(value)
+		return false
+	}
+
+	t.beforeWrite(el)
+	t.version++
+	t.unindexValue(el)
+	t.free(el.Value)
+	el.Value = value
+	el.version = t.version
+	t.indexValue(el)
+	t.notify(EventSet, el)
+	return true
+}
+
+// SetTemporaryBatch sets every entry under a single lock, as if by
+// SetTemporary with its ExpiresAt; entries marked Permanent or without a
+// deadline are set permanently. With the heap backend the heap is
+// rebuilt once instead of pushed per entry.
+func (t *timedMap) SetTemporaryBatch(entries []Entry) {
+	values := make([]any, len(entries))
+	for i, e := range entries {
+		values[i] = t.encode(e.Value)
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		for _, v := range values {
+			t.free(v)
+		}
+		return
+	}
+
+	defer t.batch()()
+
+	for i, e := range entries {
+		exp := int64(ElementPermanent)
+		if !e.Permanent && !e.ExpiresAt.IsZero() {
+			exp = t.ticks(e.ExpiresAt)
+		}
+		t.set(e.Key, values[i], exp)
+	}
 }
 
 // SetPermanent sets a key that never expires.
-func (t *TimedMap) SetPermanent(key, value any) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+func (t *timedMap) SetPermanent(key, value any) {
+	defer t.profile(ProfileSet, t.profStart())
+	t.throttle()
+	value = t.encode(value)
 
-	if el, ok := t.items[key]; ok {
-		el.Value = value
-		el.ExpiresAt = ElementPermanent
-	} else {
-		t.items[key] = &element{Key: key, Value: value, ExpiresAt: ElementPermanent}
-		t.stats.added++
-		t.stats.permanent++
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		t.free(value)
+		return
 	}
+
+	t.set(key, value, ElementPermanent)
 }
 
 // Get retrieves a value and its expiration.
-func (t *TimedMap) Get(key any) (any, int64, bool) {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+func (t *timedMap) Get(key any) (any, int64, bool) {
+	defer t.profile(ProfileGet, t.profStart())
+	value, exp, ok := t.get(key)
+	t.looked(key, ok)
+	return value, exp, ok
+}
 
+func (t *timedMap) get(key any) (any, int64, bool) {
+	if t.definitelyMissing(key) {
+		return nil, ElementDoesntExist, false
+	}
+	if t.sliding {
+		return t.getSliding(key)
+	}
+
+	t.rlock()
 	el, ok := t.items[key]
 	if !ok {
+		t.mu.RUnlock()
 		return nil, ElementDoesntExist, false
 	}
-	return el.Value, el.ExpiresAt, true
+	value, exp := el.Value, el.ExpiresAt
+	t.mu.RUnlock()
+
+	return t.decode(value), t.unixNano(exp), true
+}
+
+// NoExpiry is the remaining TTL GetWithTTL reports for permanent
+// entries.
+const NoExpiry time.Duration = -1
+
+// GetWithTTL retrieves a value and how long it remains valid: NoExpiry
+// for permanent entries, and zero for entries past their deadline that
+// the cleaner has not removed yet.
+func (t *timedMap) GetWithTTL(key any) (value any, remaining time.Duration, ok bool) {
+	value, exp, ok := t.Get(key)
+	switch {
+	case !ok:
+		return nil, 0, false
+	case exp == ElementPermanent:
+		return value, NoExpiry, true
+	}
+	return value, max(time.Unix(0, exp).Sub(t.now()), 0), true
+}
+
+// GetWithVersion retrieves a value and its version. Versions increase
+// monotonically across the whole map on every value write, so a changed
+// version always means the value was replaced.
+func (t *timedMap) GetWithVersion(key any) (any, uint64, bool) {
+	if t.definitelyMissing(key) {
+		t.looked(key, false)
+		return nil, 0, false
+	}
+	t.rlock()
+	el, ok := t.items[key]
+	if !ok {
+		t.mu.RUnlock()
+		t.looked(key, false)
+		return nil, 0, false
+	}
+	value, version := el.Value, el.version
+	t.mu.RUnlock()
+
+	t.looked(key, true)
+	return t.decode(value), version, true
 }
 
 // Remove deletes a key.
-func (t *TimedMap) Remove(key any) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+func (t *timedMap) Remove(key any) {
+	defer t.profile(ProfileRemove, t.profStart())
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		return
+	}
 
 	if el, ok := t.items[key]; ok {
-		delete(t.items, key)
-		if el.ExpiresAt != ElementPermanent && el.index >= 0 && el.index < len(t.expHeap) {
-			heap.Remove(&t.expHeap, el.index)
-		}
-		t.stats.removed++
+		t.delete(el)
+		t.countRemoved(el)
+		t.notify(EventDel, el)
 	}
 }
 
-// RemoveAll clears all entries.
-func (t *TimedMap) RemoveAll() {
-	t.mu.Lock()
-	t.items = make(map[any]*element)
-	t.expHeap = expiryHeap{}
-	heap.Init(&t.expHeap)
-	t.mu.Unlock()
+// RemoveSilently deletes a key like Remove, except that no event is
+// emitted, so neither subscribers nor the audit log hear of it. Use it
+// when the caller has already dealt with the value.
+func (t *timedMap) RemoveSilently(key any) {
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		return
+	}
+
+	if el, ok := t.items[key]; ok {
+		t.delete(el)
+		t.countRemoved(el)
+	}
 }
 
-// Size returns current number of items.
-func (t *TimedMap) Size() int {
-	t.mu.RLock()
+// RemoveAll clears all entries silently: no events are emitted and no
+// callbacks run, but the entries are counted in the "removed" stat. It
+// holds the lock only to swap in empty storage, allocated beforehand.
+// See Flush.
+func (t *timedMap) RemoveAll() {
+	items, sched := t.freshStorage()
+
+	t.lock()
+	if !t.rejectWrite() {
+		t.clear(items, sched)
+	}
+	t.unlock()
+}
+
+// Flush clears all entries like RemoveAll, but emits EventDel and runs
+// the expiry callback for each of them, on the callback workers if
+// configured, so resources released by the callback are not leaked.
+// Returns the number of entries removed.
+func (t *timedMap) Flush() int {
+	items, sched := t.freshStorage()
+
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		return 0
+	}
+
+	els := make([]*element, 0, len(t.items))
+	for _, el := range t.clear(items, sched) {
+		els = append(els, el)
+		t.notify(EventDel, el)
+	}
+	if len(els) > 0 && t.onExpire != nil {
+		t.after(func() {
+			t.dispatchOrder(els)
+			for _, el := range els {
+				t.dispatch(el.Key, el.Value, el.priority)
+			}
+		})
+	}
+	return len(els)
+}
+
+// Size returns current number of items. It takes no lock: the count is
+// kept in an atomic counter updated along with the map.
+func (t *timedMap) Size() int {
+	return int(t.size.Load())
+}
+
+// SizeApprox returns the number of items for hot paths and metrics,
+// where an eventually consistent count will do. On a TimedMap it is
+// Size; on a ShardedMap it skips locking the shards.
+func (t *timedMap) SizeApprox() int {
+	return int(t.size.Load())
+}
+
+// CountTemporary returns the number of entries with a deadline.
+func (t *timedMap) CountTemporary() int {
+	t.rlock()
 	defer t.mu.RUnlock()
-	return len(t.items)
+	return t.sched.len()
+}
+
+// CountPermanent returns the number of entries that never expire.
+func (t *timedMap) CountPermanent() int {
+	t.rlock()
+	defer t.mu.RUnlock()
+	return len(t.items) - t.sched.len()
 }
 
 // MakePermanent marks an existing key as permanent (non-expiring).
 // Returns true if the key existed and was made permanent, false otherwise.
-func (t *TimedMap) MakePermanent(key any) bool {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+func (t *timedMap) MakePermanent(key any) bool {
+	t.lock()
+	defer t.unlock()
 
-	el, ok := t.items[key]
-	if !ok || el == nil {
+	if t.rejectWrite() {
 		return false
 	}
 
-	// Already permanent
-	if el.ExpiresAt == ElementPermanent {
-		return true
-	}
-
-	// Remove from heap if it was scheduled for expiry
-	if el.index >= 0 && el.index < len(t.expHeap) {
-		heap.Remove(&t.expHeap, el.index)
+	el, ok := t.items[key]
+	if !ok || el == nil {
+		return false
 	}
 
-	el.ExpiresAt = ElementPermanent
-	t.stats.permanent++
+	t.setDeadline(el, ElementPermanent)
 	return true
 }
 
 // SetExpiry updates the expiry time of an existing key.
 // Returns true if the key exists and the expiry was updated successfully, false otherwise.
 //
-// If expiresAt.IsZero(), the key is made permanent.
-// If the key is already expired, it will be removed and false is returned.
-func (t *TimedMap) SetExpiry(key any, expiresAt time.Time) bool {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+// If expiresAt.IsZero(), the key is made permanent. If expiresAt has
+// already passed, the key is handled as set by WithPastExpiry (removed
+// by default) and false is returned; see UpdateExpiry.
+func (t *timedMap) SetExpiry(key any, expiresAt time.Time) bool {
+	return t.UpdateExpiry(key, expiresAt) == ExpiryUpdated
+}
+
+// ExtendTTL pushes the deadline of an existing temporary key back by d.
+// Returns false if the key does not exist or is permanent.
+func (t *timedMap) ExtendTTL(key any, d time.Duration) bool {
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		return false
+	}
 
 	el, ok := t.items[key]
-	if !ok || el == nil {
+	if !ok || el == nil || el.ExpiresAt == ElementPermanent {
 		return false
 	}
 
-	// Handle permanent conversion
-	if expiresAt.IsZero() {
-		// Already permanent — nothing to do
-		if el.ExpiresAt == ElementPermanent {
-			return true
+	t.setDeadline(el, t.ticks(t.deadline(el.ExpiresAt).Add(d)))
+	return true
+}
+
+// SetExpiryMany applies SetExpiry to every key under a single lock. With
+// the heap backend the heap is rebuilt once at the end instead of being
+// fixed per key. Returns the number of keys whose expiry was updated.
+func (t *timedMap) SetExpiryMany(keys []any, expiresAt time.Time) int {
+	exp := int64(ElementPermanent)
+	if !expiresAt.IsZero() {
+		exp = t.ticks(expiresAt)
+	}
+	expired := exp != ElementPermanent && exp <= t.nowTicks()
+
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		return 0
+	}
+
+	defer t.batch()()
+
+	updated := 0
+	for _, key := range keys {
+		el, ok := t.items[key]
+		if !ok {
+			continue
 		}
-		// Remove from heap if previously expiring
-		if el.index >= 0 && el.index < len(t.expHeap) {
-			heap.Remove(&t.expHeap, el.index)
+		if expired {
+			t.pastDeadline(el)
+			continue
 		}
-		el.ExpiresAt = ElementPermanent
+		t.setDeadline(el, exp)
+		updated++
+	}
+	return updated
+}
+
+// --------------------------------------------------------------------
+// Internal helpers (callers must hold mu)
+// --------------------------------------------------------------------
+
+// lock write-locks mu, counting the calls that had to wait and timing
+// a sample of them.
+func (t *timedMap) lock() {
+	if t.mu.TryLock() {
+		return
+	}
+	if t.lockWaits.Add(1)%lockWaitSampleEvery != 0 {
+		t.mu.Lock()
+		return
+	}
+	start := time.Now()
+	t.mu.Lock()
+	t.waits.write.sample(time.Since(start))
+}
+
+// rlock read-locks mu, counting the calls that had to wait and timing a
+// sample of them.
+func (t *timedMap) rlock() {
+	if t.mu.TryRLock() {
+		return
+	}
+	if t.lockWaits.Add(1)%lockWaitSampleEvery != 0 {
+		t.mu.RLock()
+		return
+	}
+	start := time.Now()
+	t.mu.RLock()
+	t.waits.read.sample(time.Since(start))
+}
+
+// set inserts or overwrites key, giving it the deadline exp.
+func (t *timedMap) set(key, value any, exp int64) {
+	el, ok := t.items[key]
+	t.version++
+	if ok {
+		t.beforeWrite(el)
+		t.untie(el)
+		t.unrefresh(el)
+		t.unindexValue(el)
+		t.free(el.Value)
+		el.Value = value
+		el.version = t.version
+		// A plain overwrite clears the per-entry flags; callers that
+		// want them set them again after set.
+		el.silent, el.priority = false, PriorityNormal
+		t.indexValue(el)
+		t.notify(EventSet, el)
+		t.setDeadline(el, exp)
+		return
+	}
+
+	now := t.nowNano()
+	el = &element{
+		Key:       key,
+		Value:     value,
+		ExpiresAt: t.lifetimeCap(now, exp),
+		index:     -1,
+		version:   t.version,
+		createdAt: now,
+		gen:       t.gen,
+		class:     t.classOf(key),
+	}
+	if el.class != nil {
+		el.class.added++
+		el.class.current++
+	}
+	if exp != ElementPermanent {
+		el.ttl = exp - t.nowTicks()
+	}
+	t.items[key] = el
+	t.size.Add(1)
+	t.slots.put(el)
+	t.inserted(el)
+	t.indexKey(key)
+	t.indexValue(el)
+	if t.filter != nil {
+		t.filter.add(key)
+	}
+	t.unbury(key)
+	if t.ordered {
+		t.order.pushBack(el)
+	}
+	if len(t.items) > t.peak {
+		t.peak = len(t.items)
+	}
+	t.checkSize()
+	t.stats.added++
+	t.notify(EventSet, el)
+	if exp == ElementPermanent {
 		t.stats.permanent++
-		return true
+		return
 	}
+	start := t.profStart()
+	t.sched.add(el)
+	t.profile(ProfileSchedule, start)
+	t.scheduled(el)
+	t.notify(EventExpire, el)
+}
 
-	newExp := expiresAt.UnixNano()
-	now := time.Now().UnixNano()
+// setDeadline moves an existing element between the permanent and
+// temporary states, keeping the scheduler in sync.
+func (t *timedMap) setDeadline(el *element, exp int64) {
+	t.beforeWrite(el)
+	prev := el.ExpiresAt
+	wasPermanent := prev == ElementPermanent
+	unscheduled := wasPermanent || el.deciding
+	el.deciding, el.stale = false, false
+	if exp != ElementPermanent {
+		el.ttl = exp - t.nowTicks()
+		exp = t.lifetimeCap(el.createdAt, exp)
+	}
+	el.ExpiresAt = exp
 
-	// If already expired relative to now, remove immediately
-	if newExp <= now {
-		if el.ExpiresAt != ElementPermanent && el.index >= 0 {
-			heap.Remove(&t.expHeap, el.index)
+	if exp == ElementPermanent {
+		if wasPermanent {
+			return
 		}
-		delete(t.items, key)
-		t.stats.removed++
-		return false
+		t.sched.cancel(el)
+		t.stats.permanent++
+		t.notifyDeadline(EventPersist, el, prev)
+		return
 	}
 
-	// If previously permanent, now becomes expiring — push into heap
-	if el.ExpiresAt == ElementPermanent {
-		el.ExpiresAt = newExp
-		heap.Push(&t.expHeap, el)
-		return true
+	start := t.profStart()
+	if unscheduled {
+		t.sched.add(el)
+	} else {
+		t.sched.update(el)
 	}
+	t.profile(ProfileSchedule, start)
+	t.scheduled(el)
+	t.notifyDeadline(EventExpire, el, prev)
+}
 
-	// If already in heap, adjust its position
-	el.ExpiresAt = newExp
-	if el.index >= 0 && el.index < len(t.expHeap) {
-		heap.Fix(&t.expHeap, el.index)
+// batch lets the scheduler apply the following changes in bulk if it
+// supports that, and returns the func that ends the batch.
+func (t *timedMap) batch() (end func()) {
+	b, ok := t.sched.(batchScheduler)
+	if !ok {
+		return func() {}
 	}
-	return true
+	b.beginBatch()
+	return b.endBatch
+}
+
+// newStorage allocates the entry map and the scheduler for capacity
+// entries. It only reads settings fixed by New.
+func (t *timedMap) newStorage(capacity int) (map[any]*element, expiryScheduler) {
+	items, sched := make(map[any]*element, capacity), t.newScheduler()
+	if g, ok := sched.(growableScheduler); ok {
+		g.grow(capacity)
+	}
+	return items, sched
+}
+
+// freshStorage is newStorage for the current capacity, for callers of
+// clear that allocate before taking mu.
+func (t *timedMap) freshStorage() (map[any]*element, expiryScheduler) {
+	t.rlock()
+	capacity := t.capacity
+	t.mu.RUnlock()
+	return t.newStorage(capacity)
+}
+
+// clear drops every entry at once, without events or callbacks, by
+// switching to the empty items and sched and starting a new generation,
+// and returns the dropped entries. They are counted as removed but not
+// walked: they keep their stale scheduler positions, which nothing
+// consults again, and release finishes with them once mu is released.
+// Callers must hold mu.
+func (t *timedMap) clear(items map[any]*element, sched expiryScheduler) map[any]*element {
+	t.beforeClear()
+	old, oldSched := t.items, t.sched
+	t.items, t.sched = items, sched
+	t.gen++
+	t.after(func() { release(old, oldSched) })
+
+	t.stats.removed += uint64(len(old))
+	for _, c := range t.classes {
+		c.removed += c.current
+		c.current = 0
+	}
+	if t.arena != nil {
+		t.arena.reset()
+	}
+	if t.index != nil {
+		t.index.reset()
+	}
+	if t.values != nil {
+		clear(t.values.keys)
+	}
+	if t.filter != nil {
+		t.filter.reset()
+	}
+	t.size.Store(0)
+	t.slots.reset()
+	t.order = orderList{}
+	t.peak = 0
+	t.checkSize()
+	return old
+}
+
+// release stops the context watches, refreshes and, with BackendTimers,
+// the timers of the entries of a past generation, see clear. Nothing else can reach
+// them, so it needs no lock.
+func release(items map[any]*element, sched expiryScheduler) {
+	for _, el := range items {
+		if el.tie != nil {
+			el.tie.stop()
+		}
+		if el.refresh != nil {
+			el.refresh.timer.Stop()
+		}
+	}
+	if s, ok := sched.(*timerScheduler); ok {
+		s.reset()
+	}
+}
+
+// live reports whether el belongs to the current generation and still
+// holds its key, so that work started on it before a RemoveAll or a
+// removal, such as a pending verdict, does not resurrect it. Callers
+// must hold mu.
+func (t *timedMap) live(el *element) bool {
+	return el.gen == t.gen && t.items[el.Key] == el
+}
+
+// delete drops el from the map and, if scheduled, from the scheduler.
+func (t *timedMap) delete(el *element) {
+	t.forget(el)
+	t.sched.cancel(el)
+}
+
+// forget drops el from the map and the insertion-order list, leaving the
+// scheduler to the caller.
+func (t *timedMap) forget(el *element) {
+	t.beforeWrite(el)
+	delete(t.items, el.Key)
+	t.size.Add(-1)
+	t.slots.drop(el)
+	if el.class != nil {
+		el.class.current--
+	}
+	t.unindexKey(el.Key)
+	t.unindexValue(el)
+	if t.filter != nil {
+		t.filter.remove(el.Key)
+	}
+	t.untie(el)
+	t.unrefresh(el)
+	t.free(el.Value)
+	if t.ordered {
+		t.order.unlink(el)
+	}
+	t.checkSize()
 }
@@ -17,12 +17,30 @@
 package temap
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-var tmap = New(time.Second * 10, func(key, val interface{}){
+var tmap = New(func(key, val interface{}) {
 	log.Print("timeout")
 })
 var expiresAt = time.Now().Add(time.Minute)
@@ -47,3 +65,4251 @@ func BenchmarkTimedMap_Get(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkTimedMap_SetTemporaryBatch(b *testing.B) {
+	entries := make([]Entry, 100000)
+	for i := range entries {
+		entries[i] = Entry{Key: i, Value: i, ExpiresAt: time.Now().Add(time.Hour + time.Duration(i)*time.Millisecond)}
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m := New(nil)
+		m.SetTemporaryBatch(entries)
+		m.Close()
+	}
+}
+
+func BenchmarkTimedMap_SetWithTTLCoarseClock(b *testing.B) {
+	m := New(nil, WithCoarseClock(time.Millisecond))
+	defer m.Close()
+
+	for i := 0; i < b.N; i++ {
+		m.SetWithTTL("some key", "some value", time.Minute)
+	}
+}
+
+func BenchmarkReadMap_Get(b *testing.B) {
+	m := NewReadMap(nil)
+	defer m.Close()
+	m.SetPermanent("some key", "some value")
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, _, ok := m.Get("some key"); !ok {
+				b.Fail()
+			}
+		}
+	})
+}
+
+func BenchmarkTimedMap_GetParallel(b *testing.B) {
+	tmap.SetTemporary("some key", "some value", expiresAt)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, _, ok := tmap.Get("some key"); !ok {
+				b.Fail()
+			}
+		}
+	})
+}
+
+func TestTimedMap_Subscribe(t *testing.T) {
+	m := New(nil)
+	defer m.StopCleaner()
+
+	var got []EventType
+	cancel := m.Subscribe(func(ev Event) {
+		got = append(got, ev.Type)
+	})
+
+	m.SetWithTTL("k", 1, time.Minute)
+	m.MakePermanent("k")
+	m.SetExpiry("k", time.Now().Add(time.Minute))
+	m.Remove("k")
+	cancel()
+	m.SetPermanent("k", 2)
+
+	want := []EventType{EventSet, EventExpire, EventPersist, EventExpire, EventDel}
+	if len(got) != len(want) {
+		t.Fatalf("got events %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got events %v, want %v", got, want)
+		}
+	}
+}
+
+func TestTimedMap_SubscribeFilter(t *testing.T) {
+	m := New(nil)
+	defer m.StopCleaner()
+
+	var dels int
+	m.Subscribe(func(ev Event) {
+		if ev.Type != EventDel {
+			t.Errorf("unexpected event %v", ev.Type)
+		}
+		dels++
+	}, EventDel)
+
+	m.SetPermanent("a", 1)
+	m.Remove("a")
+	if dels != 1 {
+		t.Fatalf("got %d del events, want 1", dels)
+	}
+}
+
+func TestTimedMap_DeadlineEvents(t *testing.T) {
+	m := New(nil)
+	defer m.StopCleaner()
+
+	var got []Event
+	m.Subscribe(func(ev Event) {
+		got = append(got, ev)
+	}, EventExpire, EventPersist)
+
+	m.SetWithTTL("k", 1, time.Minute)
+	if !m.ExtendTTL("k", time.Hour) {
+		t.Fatal("ExtendTTL failed on a temporary key")
+	}
+	m.MakePermanent("k")
+	if m.ExtendTTL("k", time.Hour) {
+		t.Fatal("ExtendTTL succeeded on a permanent key")
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("got %d events, want 3", len(got))
+	}
+	if !got[0].PrevDeadline.IsZero() || got[0].Deadline.IsZero() {
+		t.Fatalf("set: got %v -> %v, want zero -> deadline", got[0].PrevDeadline, got[0].Deadline)
+	}
+	if d := got[1].Deadline.Sub(got[1].PrevDeadline); got[1].PrevDeadline != got[0].Deadline || d != time.Hour {
+		t.Fatalf("extend: got %v -> %v, want +1h from %v", got[1].PrevDeadline, got[1].Deadline, got[0].Deadline)
+	}
+	if got[2].Type != EventPersist || got[2].PrevDeadline != got[1].Deadline || !got[2].Deadline.IsZero() {
+		t.Fatalf("persist: got %v %v -> %v", got[2].Type, got[2].PrevDeadline, got[2].Deadline)
+	}
+}
+
+type countingObserver struct {
+	NopObserver
+	calls []string
+}
+
+func (o *countingObserver) add(event string, key any) {
+	o.calls = append(o.calls, fmt.Sprint(event, " ", key))
+}
+
+func (o *countingObserver) OnSet(key, _ any)    { o.add("set", key) }
+func (o *countingObserver) OnHit(key any)       { o.add("hit", key) }
+func (o *countingObserver) OnMiss(key any)      { o.add("miss", key) }
+func (o *countingObserver) OnExpire(key, _ any) { o.add("expire", key) }
+func (o *countingObserver) OnEvict(key, _ any)  { o.add("evict", key) }
+func (o *countingObserver) OnRemove(key, _ any) { o.add("remove", key) }
+
+func TestTimedMap_Observer(t *testing.T) {
+	o := &countingObserver{}
+	m := New(nil, WithObserver(o), WithPastExpiry(PastExpiryExpire))
+	defer m.StopCleaner()
+
+	m.SetPermanent("a", 1)
+	m.Get("a")
+	m.GetEntry("b")
+	m.Remove("a")
+	m.SetPermanent("c", 3)
+	m.SetExpiry("c", time.Now().Add(-time.Second))
+	m.SetPermanent("d", 4)
+	time.Sleep(time.Millisecond)
+	m.RemoveOlderThan(0)
+
+	want := "[set a hit a miss b remove a set c expire c set d evict d]"
+	if got := fmt.Sprint(o.calls); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestTimedMap_HitStats(t *testing.T) {
+	m := New(nil)
+	defer m.StopCleaner()
+
+	if r := HitRatio(m.Stats()); r != 0 {
+		t.Fatalf("got hit ratio %v before any lookup, want 0", r)
+	}
+	m.SetPermanent("a", 1)
+	m.Get("a")
+	m.GetWithTTL("a")
+	m.GetEntry("a")
+	m.Get("b")
+
+	stats := m.Stats()
+	if stats["hits"] != 3 || stats["misses"] != 1 {
+		t.Fatalf("got %d hits %d misses, want 3 and 1", stats["hits"], stats["misses"])
+	}
+	if r := HitRatio(stats); r != 0.75 {
+		t.Fatalf("got hit ratio %v, want 0.75", r)
+	}
+}
+
+func TestTimedMap_RecentOps(t *testing.T) {
+	m := New(nil, WithAuditLog(3))
+	defer m.StopCleaner()
+
+	plain := New(nil)
+	defer plain.StopCleaner()
+	if ops := plain.RecentOps(10); ops != nil {
+		t.Fatalf("got %v without audit log, want nil", ops)
+	}
+
+	m.SetPermanent("a", 1)
+	m.SetPermanent("b", 2)
+	m.Remove("a")
+	m.SetWithTTL("c", 3, time.Minute)
+
+	ops := m.RecentOps(10)
+	want := []Op{{Type: EventDel, Key: "a"}, {Type: EventSet, Key: "c"}, {Type: EventExpire, Key: "c"}}
+	if len(ops) != len(want) {
+		t.Fatalf("got %d ops, want %d", len(ops), len(want))
+	}
+	for i := range want {
+		if ops[i].Type != want[i].Type || ops[i].Key != want[i].Key {
+			t.Fatalf("op %d: got %v %v, want %v %v", i, ops[i].Type, ops[i].Key, want[i].Type, want[i].Key)
+		}
+	}
+	if last := m.RecentOps(1); len(last) != 1 || last[0].Key != "c" || last[0].Type != EventExpire {
+		t.Fatalf("got %v, want the most recent op", last)
+	}
+}
+
+func TestTimedMap_GetWithVersion(t *testing.T) {
+	m := New(nil)
+	defer m.StopCleaner()
+
+	if _, _, ok := m.GetWithVersion("k"); ok {
+		t.Fatal("missing key reported as present")
+	}
+
+	m.SetPermanent("k", 1)
+	_, v1, _ := m.GetWithVersion("k")
+	m.MakePermanent("k")
+	if _, v, _ := m.GetWithVersion("k"); v != v1 {
+		t.Fatalf("version changed from %d to %d without a value write", v1, v)
+	}
+
+	m.SetWithTTL("k", 2, time.Minute)
+	val, v2, ok := m.GetWithVersion("k")
+	if !ok || val != 2 || v2 <= v1 {
+		t.Fatalf("got (%v, %d, %v), want (2, >%d, true)", val, v2, ok, v1)
+	}
+
+	m.Remove("k")
+	m.SetPermanent("k", 3)
+	if _, v3, _ := m.GetWithVersion("k"); v3 <= v2 {
+		t.Fatalf("re-inserted key got version %d, want >%d", v3, v2)
+	}
+}
+
+func TestTimedMap_SetIfVersion(t *testing.T) {
+	m := New(nil)
+	defer m.StopCleaner()
+
+	if m.SetIfVersion("k", 1, 0) {
+		t.Fatal("SetIfVersion succeeded on a missing key")
+	}
+
+	m.SetWithTTL("k", 1, time.Minute)
+	_, exp, _ := m.Get("k")
+	_, v, _ := m.GetWithVersion("k")
+
+	if !m.SetIfVersion("k", 2, v) {
+		t.Fatal("SetIfVersion failed with the current version")
+	}
+	if m.SetIfVersion("k", 3, v) {
+		t.Fatal("SetIfVersion succeeded with a stale version")
+	}
+
+	val, newExp, _ := m.Get("k")
+	if val != 2 || newExp != exp {
+		t.Fatalf("got (%v, %d), want (2, %d)", val, newExp, exp)
+	}
+}
+
+func TestTimedMap_GetEntry(t *testing.T) {
+	m := New(nil)
+	defer m.StopCleaner()
+
+	before := time.Now()
+	m.SetPermanent("p", "perm")
+	exp := time.Now().Add(time.Minute)
+	m.SetTemporary("t", "temp", exp)
+
+	e, ok := m.GetEntry("p")
+	if !ok || !e.Permanent || !e.ExpiresAt.IsZero() || e.Value != "perm" {
+		t.Fatalf("got %+v for permanent entry", e)
+	}
+	if e.CreatedAt.Before(before) || e.Version == 0 {
+		t.Fatalf("got %+v, want creation time and version set", e)
+	}
+
+	e, ok = m.GetEntry("t")
+	if !ok || e.Permanent || !e.ExpiresAt.Equal(exp) {
+		t.Fatalf("got %+v, want expiry %v", e, exp)
+	}
+
+	if _, ok := m.GetEntry("missing"); ok {
+		t.Fatal("missing key reported as present")
+	}
+}
+
+func TestTimedMap_SetExpiryMany(t *testing.T) {
+	m := New(nil)
+	defer m.StopCleaner()
+
+	m.SetWithTTL("a", 1, time.Hour)
+	m.SetWithTTL("b", 2, time.Second)
+	m.SetPermanent("c", 3)
+	m.SetWithTTL("d", 4, time.Millisecond*100)
+
+	exp := time.Now().Add(time.Minute)
+	if n := m.SetExpiryMany([]any{"a", "b", "c", "missing"}, exp); n != 3 {
+		t.Fatalf("updated %d keys, want 3", n)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if e, _ := m.GetEntry(k); e.Permanent || !e.ExpiresAt.Equal(exp) {
+			t.Fatalf("%s: got %+v, want expiry %v", k, e, exp)
+		}
+	}
+	if m.sched.(*heapScheduler).h[0].Key != "d" {
+		t.Fatalf("heap root is %v, want d", m.sched.(*heapScheduler).h[0].Key)
+	}
+
+	if n := m.SetExpiryMany([]any{"a", "b"}, time.Time{}); n != 2 {
+		t.Fatalf("updated %d keys, want 2", n)
+	}
+	if n := m.SetExpiryMany([]any{"c", "d"}, time.Now().Add(-time.Second)); n != 0 {
+		t.Fatalf("updated %d keys, want 0 for past expiry", n)
+	}
+	if m.Size() != 2 || m.CountTemporary() != 0 {
+		t.Fatalf("got size %d heap %d, want 2 and 0", m.Size(), m.CountTemporary())
+	}
+}
+
+func TestTimedMap_TTLPolicy(t *testing.T) {
+	m := New(nil, WithDefaultTTL(time.Minute), WithTTLPolicy(func(_, value any) time.Duration {
+		switch v := value.(type) {
+		case string:
+			return time.Duration(len(v)) * time.Hour
+		case bool:
+			return NoExpiry
+		}
+		return 0
+	}))
+	defer m.StopCleaner()
+
+	m.Set("s", "abc")
+	m.Set("b", true)
+	m.Set("i", 1)
+
+	if _, ttl, _ := m.GetWithTTL("s"); ttl <= 2*time.Hour || ttl > 3*time.Hour {
+		t.Fatalf("string: got TTL %v, want 3h", ttl)
+	}
+	if _, ttl, _ := m.GetWithTTL("b"); ttl != NoExpiry {
+		t.Fatalf("bool: got TTL %v, want permanent", ttl)
+	}
+	if _, ttl, _ := m.GetWithTTL("i"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("int: got TTL %v, want the 1m default", ttl)
+	}
+}
+
+func TestTimedMap_EpochDeadline(t *testing.T) {
+	m := New(nil, WithPrecision(time.Second))
+	m.StopCleaner()
+
+	m.SetTemporary("epoch", 1, time.Unix(0, 0))
+	m.SetTemporary("rounded", 2, time.Unix(0, -1))
+	m.SetTemporary("zero", 3, time.Time{})
+	if n := m.CountTemporary(); n != 2 {
+		t.Fatalf("got %d temporary entries, want 2", n)
+	}
+	if e, _ := m.GetEntry("zero"); !e.Permanent {
+		t.Fatalf("zero time: got %+v, want permanent", e)
+	}
+
+	r := NewReadMap(nil)
+	defer r.Close()
+	r.SetTemporary("epoch", 1, time.Unix(0, 0))
+	if _, _, ok := r.Get("epoch"); ok {
+		t.Fatal("ReadMap: epoch deadline made the key permanent")
+	}
+}
+
+func TestTimedMap_PastExpiry(t *testing.T) {
+	past := time.Now().Add(-time.Second)
+
+	m := New(nil)
+	defer m.StopCleaner()
+	m.SetPermanent("k", 1)
+	if r := m.UpdateExpiry("missing", past); r != ExpiryNotFound {
+		t.Fatalf("missing key: got %v, want %v", r, ExpiryNotFound)
+	}
+	if r := m.UpdateExpiry("k", past); r != ExpiryRemoved || m.Size() != 0 {
+		t.Fatalf("default policy: got %v, want %v and the key gone", r, ExpiryRemoved)
+	}
+
+	expired := make(chan any, 1)
+	e := New(func(key, _ any) { expired <- key }, WithPastExpiry(PastExpiryExpire))
+	defer e.StopCleaner()
+	e.SetPermanent("k", 1)
+	if r := e.UpdateExpiry("k", past); r != ExpiryExpired || e.Size() != 0 {
+		t.Fatalf("expire policy: got %v, want %v and the key gone", r, ExpiryExpired)
+	}
+	select {
+	case key := <-expired:
+		if key != "k" {
+			t.Fatalf("got expiry callback for %v, want k", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expiry callback did not run")
+	}
+
+	r := New(nil, WithPastExpiry(PastExpiryReject))
+	defer r.StopCleaner()
+	r.SetWithTTL("k", 1, time.Hour)
+	if res := r.UpdateExpiry("k", past); res != ExpiryRejected {
+		t.Fatalf("reject policy: got %v, want %v", res, ExpiryRejected)
+	}
+	if e, ok := r.GetEntry("k"); !ok || time.Until(e.ExpiresAt) < time.Minute {
+		t.Fatalf("reject policy changed the entry: %+v", e)
+	}
+}
+
+func TestTimedMap_WithCompression(t *testing.T) {
+	m := New(nil, WithCompression(NewFlateCodec(flate.BestSpeed), 64))
+	defer m.StopCleaner()
+
+	long := strings.Repeat(`{"name":"value"},`, 100)
+	m.SetPermanent("s", long)
+	m.SetPermanent("b", []byte(long))
+	m.SetPermanent("short", "tiny")
+
+	if _, ok := m.items["s"].Value.(*storedValue); !ok {
+		t.Fatalf("long string stored as %T, want compressed", m.items["s"].Value)
+	}
+	if _, ok := m.items["short"].Value.(string); !ok {
+		t.Fatalf("short string stored as %T, want plain", m.items["short"].Value)
+	}
+
+	if v, _, _ := m.Get("s"); v != long {
+		t.Fatal("string value did not round-trip")
+	}
+	if v, _, _ := m.Get("b"); !bytes.Equal(v.([]byte), []byte(long)) {
+		t.Fatal("[]byte value did not round-trip")
+	}
+	if v := m.ToMap()["s"]; v != long {
+		t.Fatal("ToMap returned a compressed value")
+	}
+}
+
+func TestTimedMap_WithEncryption(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(nil, WithEncryption(aead), WithCompression(NewFlateCodec(flate.BestSpeed), 16))
+	defer m.StopCleaner()
+
+	secret := strings.Repeat("4111-1111-1111-1111 ", 8)
+	m.SetPermanent("card", secret)
+	m.SetPermanent("raw", []byte("pii"))
+	m.SetPermanent("n", 42)
+
+	sv, ok := m.items["card"].Value.(*storedValue)
+	if !ok || !sv.encrypted || !sv.compressed || bytes.Contains(sv.data, []byte("4111")) {
+		t.Fatalf("value stored as %#v, want compressed and encrypted", m.items["card"].Value)
+	}
+
+	if v, _, _ := m.Get("card"); v != secret {
+		t.Fatal("encrypted string did not round-trip")
+	}
+	if v, _, _ := m.Get("raw"); !bytes.Equal(v.([]byte), []byte("pii")) {
+		t.Fatal("encrypted []byte did not round-trip")
+	}
+	if v, _, _ := m.Get("n"); v != 42 {
+		t.Fatal("non-byte value was altered")
+	}
+
+	sv.data[len(sv.data)-1] ^= 0xff
+	if v, _, _ := m.Get("card"); v != nil || m.Stats()["decode_errors"] != 1 {
+		t.Fatalf("tampered value returned %v, want nil and a decode error", v)
+	}
+}
+
+func TestTimedMap_WithPrecision(t *testing.T) {
+	m := New(nil, WithPrecision(time.Millisecond))
+	defer m.StopCleaner()
+
+	base := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	m.SetTemporary("k", 1, base.Add(time.Nanosecond))
+
+	e, _ := m.GetEntry("k")
+	if want := base.Add(time.Millisecond); !e.ExpiresAt.Equal(want) {
+		t.Fatalf("got expiry %v, want %v", e.ExpiresAt, want)
+	}
+	if got := m.Stats()["precision_ns"]; got != uint64(time.Millisecond) {
+		t.Fatalf("got precision %d, want %d", got, time.Millisecond)
+	}
+}
+
+func TestTimedMap_ForEachByExpiry(t *testing.T) {
+	m := New(nil)
+	defer m.StopCleaner()
+
+	for i := 0; i < 50; i++ {
+		m.SetWithTTL(i, i, time.Minute+time.Duration((i*7919)%50)*time.Second)
+	}
+	m.SetPermanent("p", "perm")
+
+	var last time.Time
+	n := 0
+	m.ForEachByExpiry(func(e Entry) bool {
+		if e.Permanent || e.ExpiresAt.Before(last) {
+			t.Fatalf("entry %v out of order", e.Key)
+		}
+		last = e.ExpiresAt
+		n++
+		return true
+	})
+	if n != 50 {
+		t.Fatalf("visited %d entries, want 50", n)
+	}
+
+	n = 0
+	m.ForEachByExpiry(func(e Entry) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Fatalf("visited %d entries after stopping, want 3", n)
+	}
+}
+
+func TestTimedMap_ForEachOrdered(t *testing.T) {
+	for _, opts := range [][]Option{{WithInsertionOrder()}, nil} {
+		m := New(nil, opts...)
+
+		for i := 0; i < 5; i++ {
+			m.SetPermanent(i, i)
+			time.Sleep(time.Microsecond)
+		}
+		m.Remove(0)
+		m.Remove(3)
+		m.SetWithTTL(1, "overwritten", time.Minute)
+		m.SetPermanent(5, 5)
+
+		var keys []any
+		m.ForEachOrdered(func(key, value any) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if want := []any{1, 2, 4, 5}; len(keys) != len(want) || keys[0] != 1 || keys[1] != 2 || keys[2] != 4 || keys[3] != 5 {
+			t.Fatalf("got order %v, want %v", keys, want)
+		}
+		m.StopCleaner()
+	}
+}
+
+func TestTimedMap_RemoveOlderThan(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+
+	m.SetPermanent("old", 1)
+	m.SetWithTTL("old-temp", 2, time.Hour)
+	time.Sleep(30 * time.Millisecond)
+	m.SetPermanent("new", 3)
+	m.SetPermanent("old", 4) // overwriting keeps the age
+
+	if age, ok := m.Age("old"); !ok || age < 30*time.Millisecond {
+		t.Fatalf("got age %v %v, want at least 30ms", age, ok)
+	}
+	if _, ok := m.Age("missing"); ok {
+		t.Fatal("got an age for a missing key")
+	}
+
+	if n := m.RemoveOlderThan(20 * time.Millisecond); n != 2 {
+		t.Fatalf("removed %d, want 2", n)
+	}
+	if _, _, ok := m.Get("new"); !ok || m.Size() != 1 || m.HeapLen() != 0 {
+		t.Fatalf("got size %d and heap %d, want only new left", m.Size(), m.HeapLen())
+	}
+	if got := m.Stats()["removed"]; got != 2 {
+		t.Fatalf("got %d removed, want 2", got)
+	}
+}
+
+func TestTimedMap_CountsAndKeys(t *testing.T) {
+	m := New(nil)
+	defer m.StopCleaner()
+
+	m.SetPermanent("p1", 1)
+	m.SetPermanent("p2", 2)
+	m.SetWithTTL("t1", 3, time.Minute)
+	m.SetWithTTL("t2", 4, time.Minute)
+	m.MakePermanent("t2")
+	m.SetExpiry("p1", time.Now().Add(time.Minute))
+	m.Remove("p2")
+
+	if got := m.CountTemporary(); got != 2 {
+		t.Fatalf("got %d temporary, want 2", got)
+	}
+	if got := m.CountPermanent(); got != 1 {
+		t.Fatalf("got %d permanent, want 1", got)
+	}
+	if keys := m.PermanentKeys(); len(keys) != 1 || keys[0] != "t2" {
+		t.Fatalf("got permanent keys %v, want [t2]", keys)
+	}
+	if keys := m.TemporaryKeys(); len(keys) != 2 {
+		t.Fatalf("got temporary keys %v, want 2 keys", keys)
+	}
+	if s := m.Stats(); s["current_permanent"] != 1 || s["current_temporary"] != 2 {
+		t.Fatalf("got stats %v", s)
+	}
+}
+
+func TestTimedMap_WithSizeAlarm(t *testing.T) {
+	var highs, lows []int
+	m := New(nil, WithSizeAlarm(3, 1,
+		func(size int) { highs = append(highs, size) },
+		func(size int) { lows = append(lows, size) },
+	))
+	defer m.StopCleaner()
+
+	for i := 0; i < 4; i++ {
+		m.SetPermanent(i, i)
+	}
+	m.Remove(3)
+	m.SetPermanent(3, 3)
+	m.Remove(3)
+	m.Remove(2)
+	m.Remove(1)
+	m.SetPermanent(1, 1)
+	m.SetPermanent(2, 2)
+
+	if len(highs) != 2 || highs[0] != 3 || highs[1] != 3 {
+		t.Fatalf("got high alarms %v, want [3 3]", highs)
+	}
+	if len(lows) != 1 || lows[0] != 1 {
+		t.Fatalf("got low alarms %v, want [1]", lows)
+	}
+}
+
+func TestTimedMap_Reserve(t *testing.T) {
+	m := New(nil, WithCapacity(10))
+	defer m.StopCleaner()
+
+	if got := m.Cap(); got != 10 {
+		t.Fatalf("got cap %d, want 10", got)
+	}
+
+	for i := 0; i < 20; i++ {
+		m.SetWithTTL(i, i, time.Minute)
+	}
+	if got := m.Cap(); got != 20 {
+		t.Fatalf("got cap %d after growing, want 20", got)
+	}
+
+	m.Reserve(1000)
+	if got := m.Cap(); got != 1000 || cap(m.sched.(*heapScheduler).h) < 1000 {
+		t.Fatalf("got cap %d heap cap %d, want 1000", got, cap(m.sched.(*heapScheduler).h))
+	}
+	if m.Size() != 20 || m.CountTemporary() != 20 {
+		t.Fatal("Reserve lost entries")
+	}
+}
+
+func TestTimedMap_CleanerLifecycleConcurrent(t *testing.T) {
+	m := New(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				switch (i + j) % 3 {
+				case 0:
+					m.StopCleaner()
+				case 1:
+					m.StartCleaner()
+				default:
+					m.RestartCleaner()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	m.Close()
+	m.StartCleaner()
+	m.RestartCleaner()
+	if m.state != cleanerClosed || m.stopCh != nil {
+		t.Fatal("cleaner restarted after Close")
+	}
+	m.StopCleaner()
+	m.Close()
+}
+
+func TestTimedMap_CleanerHealth(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+
+	m.StopCleaner()
+	if m.CleanerRunning() {
+		t.Fatal("stopped cleaner reported as running")
+	}
+
+	past := time.Now().Add(-time.Second)
+	for i := 0; i < 5; i++ {
+		m.SetWithTTL(i, i, time.Hour)
+	}
+	m.SetExpiryMany([]any{0, 1, 2}, time.Now().Add(time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+	if got := m.PendingExpirations(); got != 3 {
+		t.Fatalf("got %d pending expirations, want 3", got)
+	}
+
+	m.StartCleaner()
+	deadline := time.Now().Add(time.Second)
+	for m.PendingExpirations() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !m.CleanerRunning() || m.PendingExpirations() != 0 || !m.LastSweepAt().After(past) {
+		t.Fatalf("cleaner running %v, pending %d, last sweep %v", m.CleanerRunning(), m.PendingExpirations(), m.LastSweepAt())
+	}
+}
+
+type logRecorder struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *logRecorder) Printf(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestTimedMap_CleanerRecoversPanics(t *testing.T) {
+	logs := &logRecorder{}
+	expired := make(chan any, 2)
+	m := New(func(key, val any) { expired <- key }, WithLogger(logs))
+	defer m.Close()
+
+	m.Subscribe(func(ev Event) {
+		if ev.Key == "boom" {
+			panic("subscriber failure")
+		}
+	}, EventExpired)
+
+	m.SetWithTTL("boom", 1, time.Millisecond)
+	m.SetWithTTL("ok", 2, 150*time.Millisecond)
+
+	timeout := time.After(3 * time.Second)
+	for _, want := range []any{"boom", "ok"} {
+		select {
+		case got := <-expired:
+			if got != want {
+				t.Fatalf("got expiry of %v, want %v", got, want)
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v to expire", want)
+		}
+	}
+
+	if got := m.Stats()["cleaner_panics"]; got != 1 {
+		t.Fatalf("got %d cleaner panics, want 1", got)
+	}
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	if len(logs.lines) != 1 || !strings.Contains(logs.lines[0], "subscriber failure") {
+		t.Fatalf("got logs %q", logs.lines)
+	}
+}
+
+func TestTimedMap_BackendTimers(t *testing.T) {
+	expired := make(chan any, 10)
+	m := New(func(key, val any) { expired <- key }, WithBackend(BackendTimers))
+	defer m.Close()
+
+	m.SetWithTTL("a", 1, 20*time.Millisecond)
+	m.SetWithTTL("b", 2, 10*time.Millisecond)
+	m.SetWithTTL("c", 3, 10*time.Millisecond)
+	m.MakePermanent("c")
+
+	for _, want := range []any{"b", "a"} {
+		select {
+		case got := <-expired:
+			if got != want {
+				t.Fatalf("got expiry of %v, want %v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+
+	m.StopCleaner()
+	m.SetWithTTL("d", 4, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if _, _, ok := m.Get("d"); !ok {
+		t.Fatal("entry expired while the cleaner was stopped")
+	}
+
+	m.StartCleaner()
+	select {
+	case got := <-expired:
+		if got != "d" {
+			t.Fatalf("got expiry of %v, want d", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("overdue entry not expired after StartCleaner")
+	}
+	if m.Size() != 1 {
+		t.Fatalf("got size %d, want only the permanent entry", m.Size())
+	}
+}
+
+func TestTimedMap_Backends(t *testing.T) {
+	for _, b := range []Backend{BackendHeap, BackendTimers, BackendWheel, BackendBucket} {
+		t.Run(b.String(), func(t *testing.T) {
+			expired := make(chan any, 10)
+			m := New(func(key, val any) { expired <- key },
+				WithBackend(b), WithBackendResolution(time.Millisecond, 16))
+			defer m.Close()
+
+			m.SetWithTTL("a", 1, 40*time.Millisecond)
+			m.SetWithTTL("b", 2, 10*time.Millisecond)
+			m.SetWithTTL("c", 3, 10*time.Millisecond)
+			m.SetWithTTL("d", 4, 10*time.Millisecond)
+			m.MakePermanent("c")
+			m.Remove("d")
+			m.SetExpiry("a", time.Now().Add(20*time.Millisecond))
+
+			if got := m.CountTemporary(); got != 2 {
+				t.Fatalf("got %d temporary, want 2", got)
+			}
+			var order []any
+			m.ForEachByExpiry(func(e Entry) bool {
+				order = append(order, e.Key)
+				return true
+			})
+			if len(order) != 2 || order[0] != "b" || order[1] != "a" {
+				t.Fatalf("got expiry order %v, want [b a]", order)
+			}
+
+			// Callbacks of one sweep run concurrently, so only the set of
+			// keys is checked here; the order is checked above.
+			got := map[any]bool{}
+			for i := 0; i < 2; i++ {
+				select {
+				case k := <-expired:
+					got[k] = true
+				case <-time.After(3 * time.Second):
+					t.Fatalf("timed out, expired so far: %v", got)
+				}
+			}
+			if !got["a"] || !got["b"] {
+				t.Fatalf("got expiries of %v, want a and b", got)
+			}
+			if m.Size() != 1 || m.CountTemporary() != 0 {
+				t.Fatalf("got size %d temporary %d, want 1 and 0", m.Size(), m.CountTemporary())
+			}
+
+			m.SetWithTTL("e", 5, time.Hour)
+			m.SetExpiryMany([]any{"c", "e"}, time.Now().Add(10*time.Millisecond))
+			for i := 0; i < 2; i++ {
+				select {
+				case <-expired:
+				case <-time.After(3 * time.Second):
+					t.Fatal("timed out waiting for SetExpiryMany deadlines")
+				}
+			}
+			if m.Size() != 0 {
+				t.Fatalf("got size %d, want 0", m.Size())
+			}
+		})
+	}
+}
+
+func TestReadMap(t *testing.T) {
+	expired := make(chan any, 10)
+	m := NewReadMap(func(key, val any) { expired <- key })
+	defer m.Close()
+
+	m.SetPermanent("p", 1)
+	m.SetWithTTL("a", 2, time.Hour)
+	m.SetWithTTL("b", 3, 10*time.Millisecond)
+	m.SetPermanent("a", 4)
+	m.SetWithTTL("c", 5, 10*time.Millisecond)
+	m.Remove("c")
+
+	if v, exp, ok := m.Get("a"); !ok || v != 4 || exp != ElementPermanent {
+		t.Fatalf("got %v %d %v, want permanent 4", v, exp, ok)
+	}
+	select {
+	case got := <-expired:
+		if got != "b" {
+			t.Fatalf("got expiry of %v, want b", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for b")
+	}
+	if _, _, ok := m.Get("b"); ok {
+		t.Fatal("expired entry still readable")
+	}
+	if m.Size() != 2 {
+		t.Fatalf("got size %d, want 2", m.Size())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				m.Get("p")
+				m.SetWithTTL(j%10, j, time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTimedMap_ToMap(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+
+	m.SetPermanent("a", 1)
+	m.SetWithTTL("b", 2, time.Hour)
+
+	snap := m.ToMap()
+	if len(snap) != 2 || snap["a"] != 1 || snap["b"] != 2 {
+		t.Fatalf("got %v, want map[a:1 b:2]", snap)
+	}
+
+	m.Remove("a")
+	snap["b"] = 3
+	if _, ok := snap["a"]; !ok {
+		t.Fatal("snapshot changed after Remove")
+	}
+	if v, _, _ := m.Get("b"); v != 2 {
+		t.Fatalf("got %v, want 2; writing the snapshot leaked into the map", v)
+	}
+}
+
+func TestTimedMap_DumpJSON(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+
+	m.SetPermanent("b", map[string]int{"n": 1})
+	m.SetWithTTL("a", func() {}, time.Hour)
+
+	var buf bytes.Buffer
+	if err := m.DumpJSON(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var dump struct {
+		Stats   map[string]uint64
+		Entries []struct {
+			Key       string
+			Value     any
+			Permanent bool
+			TTL       string
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &dump); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.String())
+	}
+	if dump.Stats["current"] != 2 || len(dump.Entries) != 2 {
+		t.Fatalf("got %+v, want 2 entries", dump)
+	}
+	a, b := dump.Entries[0], dump.Entries[1]
+	if a.Key != "a" || a.Permanent || a.TTL == "" {
+		t.Fatalf("got %+v, want temporary a with a TTL", a)
+	}
+	if _, ok := a.Value.(string); !ok {
+		t.Fatalf("got %v, want the unmarshallable value as a string", a.Value)
+	}
+	if b.Key != "b" || !b.Permanent || b.TTL != "" {
+		t.Fatalf("got %+v, want permanent b", b)
+	}
+	if !strings.Contains(buf.String(), "\n  ") {
+		t.Fatal("pretty dump is not indented")
+	}
+}
+
+func TestTimedMap_Load(t *testing.T) {
+	expired := make(chan any, 10)
+	m := New(func(key, val any) { expired <- key })
+	defer m.Close()
+
+	m.SetPermanent("a", 0)
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	n := m.Load([]Entry{
+		{Key: "a", Value: 1, ExpiresAt: time.Now().Add(time.Hour)},
+		{Key: "b", Value: 2, Permanent: true, CreatedAt: created},
+		{Key: "c", Value: 3, ExpiresAt: time.Now().Add(time.Minute)},
+		{Key: "d", Value: 4, ExpiresAt: time.Now().Add(-time.Second)},
+	}, true)
+	if n != 3 || m.Size() != 3 || m.CountTemporary() != 2 {
+		t.Fatalf("got loaded %d size %d temporary %d, want 3 3 2", n, m.Size(), m.CountTemporary())
+	}
+	if e, _ := m.GetEntry("b"); !e.Permanent || !e.CreatedAt.Equal(created) {
+		t.Fatalf("got %+v, want permanent b created at %v", e, created)
+	}
+	if e, _ := m.GetEntry("a"); e.Value != 1 || e.Permanent {
+		t.Fatalf("got %+v, want a overwritten with a deadline", e)
+	}
+
+	var order []any
+	m.ForEachByExpiry(func(e Entry) bool {
+		order = append(order, e.Key)
+		return true
+	})
+	if len(order) != 2 || order[0] != "c" || order[1] != "a" {
+		t.Fatalf("got expiry order %v, want [c a]", order)
+	}
+
+	select {
+	case got := <-expired:
+		if got != "d" {
+			t.Fatalf("got expiry of %v, want d", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expired entry did not fire its callback")
+	}
+}
+
+func TestTimedMap_ExportImport(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := New(nil, WithEncryption(aead))
+	defer src.Close()
+
+	for i := 0; i < 3000; i++ {
+		src.SetWithTTL(i, i*2, time.Hour)
+	}
+	src.SetPermanent("secret", "hunter2")
+	src.SetWithTTL("soon", 1, 20*time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("hunter2")) {
+		t.Fatal("export contains an encrypted value in plaintext")
+	}
+	plain := New(nil)
+	defer plain.Close()
+	if err := plain.Import(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("importing encrypted values without a key succeeded")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	dst := New(nil, WithEncryption(aead))
+	defer dst.Close()
+	if err := dst.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if dst.Size() != 3001 {
+		t.Fatalf("got size %d, want 3001 without the expired entry", dst.Size())
+	}
+	want, _ := src.GetEntry(1234)
+	if got, _ := dst.GetEntry(1234); got.Value != 2468 || !got.ExpiresAt.Equal(want.ExpiresAt) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if v, _, _ := dst.Get("secret"); v != "hunter2" {
+		t.Fatalf("got %v, want hunter2", v)
+	}
+
+	if err := dst.Import(strings.NewReader("garbage")); err == nil {
+		t.Fatal("importing garbage succeeded")
+	}
+}
+
+func TestTimedMap_WithTombstones(t *testing.T) {
+	m := New(nil, WithTombstones(50*time.Millisecond))
+	defer m.Close()
+
+	m.SetWithTTL("a", 1, time.Millisecond)
+	m.SetWithTTL("b", 2, time.Hour)
+	m.Remove("b")
+
+	deadline := time.Now().Add(3 * time.Second)
+	for m.Size() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	at, ok := m.WasExpired("a")
+	if !ok || time.Since(at) > time.Second {
+		t.Fatalf("got %v %v, want a recent tombstone for a", at, ok)
+	}
+	if _, ok := m.WasExpired("b"); ok {
+		t.Fatal("removed key has a tombstone")
+	}
+
+	m.SetPermanent("a", 3)
+	if _, ok := m.WasExpired("a"); ok {
+		t.Fatal("tombstone survived setting the key again")
+	}
+
+	m.SetWithTTL("c", 1, time.Millisecond)
+	for m.Size() != 1 && time.Now().Before(deadline.Add(3*time.Second)) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := m.WasExpired("c"); !ok {
+		t.Fatal("no tombstone for c")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := m.WasExpired("c"); ok {
+		t.Fatal("tombstone outlived its window")
+	}
+}
+
+func TestTimedMap_GetStale(t *testing.T) {
+	m := New(nil, WithStaleRetention(time.Minute), WithCompression(NewFlateCodec(flate.BestSpeed), 0))
+	defer m.Close()
+
+	long := strings.Repeat("stale ", 64)
+	m.SetWithTTL("a", long, time.Millisecond)
+	m.SetPermanent("b", 2)
+
+	if v, stale, ok := m.GetStale("b"); !ok || stale || v != 2 {
+		t.Fatalf("got %v %v %v, want live 2", v, stale, ok)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for m.Size() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if v, stale, ok := m.GetStale("a"); !ok || !stale || v != long {
+		t.Fatalf("got %v %v %v, want the stale value of a", v, stale, ok)
+	}
+	if _, _, ok := m.GetStale("c"); ok {
+		t.Fatal("got a value for a key that never existed")
+	}
+}
+
+func TestTimedMap_GetOrLoad(t *testing.T) {
+	var calls atomic.Int32
+	down := errors.New("backend down")
+	var failing atomic.Bool
+	loader := func(ctx context.Context, key any) (any, time.Duration, error) {
+		calls.Add(1)
+		if failing.Load() {
+			return nil, 0, down
+		}
+		time.Sleep(10 * time.Millisecond)
+		return fmt.Sprint("loaded ", key), time.Millisecond, nil
+	}
+
+	m := New(nil, WithLoader(loader), WithStaleRetention(time.Minute), WithServeStale())
+	defer m.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, stale, err := m.GetOrLoad("k"); err != nil || stale || v != "loaded k" {
+				t.Errorf("got %v %v %v, want a fresh load", v, stale, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("loader called %d times, want 1", n)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for m.Size() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	failing.Store(true)
+	if v, stale, err := m.GetOrLoad("k"); err != nil || !stale || v != "loaded k" {
+		t.Fatalf("got %v %v %v, want the stale value", v, stale, err)
+	}
+	if _, _, err := m.GetOrLoad("other"); !errors.Is(err, down) {
+		t.Fatalf("got %v, want the loader error", err)
+	}
+
+	plain := New(nil)
+	defer plain.Close()
+	if _, _, err := plain.GetOrLoad("k"); !errors.Is(err, ErrNoLoader) {
+		t.Fatalf("got %v, want ErrNoLoader", err)
+	}
+}
+
+func TestTimedMap_GetOrLoadCtxCancel(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	m := New(nil, WithLoader(func(ctx context.Context, key any) (any, time.Duration, error) {
+		close(started)
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		return "v", 0, nil
+	}))
+	defer m.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, _, err := m.GetOrLoadCtx(ctx, "k")
+		first <- err
+	}()
+	<-started
+	second := make(chan any, 1)
+	go func() {
+		v, _, err := m.GetOrLoadCtx(context.Background(), "k")
+		if err != nil {
+			t.Errorf("second caller got %v", err)
+		}
+		second <- v
+	}()
+	time.Sleep(10 * time.Millisecond) // let the second caller join the load
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("first caller got %v, want context.Canceled", err)
+	}
+	close(release)
+	if v := <-second; v != "v" {
+		t.Fatalf("second caller got %v, want v", v)
+	}
+	if v, _, ok := m.Get("k"); !ok || v != "v" {
+		t.Fatalf("got %v %v, want the loaded value stored", v, ok)
+	}
+}
+
+func TestTimedMap_GetOrLoadCtxAbandoned(t *testing.T) {
+	deadlines := make(chan bool, 1)
+	cancelled := make(chan error, 1)
+	m := New(nil, WithLoader(func(ctx context.Context, key any) (any, time.Duration, error) {
+		_, ok := ctx.Deadline()
+		deadlines <- ok
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return nil, 0, ctx.Err()
+	}))
+	defer m.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := m.GetOrLoadCtx(ctx, "k")
+		done <- err
+	}()
+	if !<-deadlines {
+		t.Fatal("loader did not get the waiter's deadline")
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("waiter got %v, want context.Canceled", err)
+	}
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("loader context ended with %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("loader was not cancelled after its only waiter gave up")
+	}
+}
+
+func TestTimedMap_SlidingExpiration(t *testing.T) {
+	m := New(nil, WithSlidingExpiration(), WithMaxLifetime(150*time.Millisecond))
+	defer m.Close()
+
+	m.SetWithTTL("s", 1, 50*time.Millisecond)
+	_, first, _ := m.Get("s")
+	time.Sleep(20 * time.Millisecond)
+	_, slid, _ := m.Get("s")
+	if slid <= first {
+		t.Fatalf("deadline %d did not move past %d", slid, first)
+	}
+
+	e, _ := m.GetEntry("s")
+	limit := e.CreatedAt.Add(150 * time.Millisecond)
+	m.SetWithTTL("s", 2, time.Hour)
+	if _, exp, _ := m.Get("s"); time.Unix(0, exp).After(limit) {
+		t.Fatal("overwrite extended the entry past its max lifetime")
+	}
+	m.SetWithTTL("s", 1, 50*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if _, exp, ok := m.Get("s"); ok && time.Unix(0, exp).After(limit) {
+			t.Fatalf("deadline %v slid past the max lifetime %v", time.Unix(0, exp), limit)
+		}
+	}
+}
+
+func TestTimedMap_SetTemporaryBatch(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+
+	m.SetPermanent(3, "old")
+	now := time.Now()
+	entries := make([]Entry, 0, 100)
+	for i := 99; i >= 0; i-- {
+		entries = append(entries, Entry{Key: i, Value: i, ExpiresAt: now.Add(time.Hour + time.Duration(i)*time.Second)})
+	}
+	entries = append(entries, Entry{Key: "p", Value: "p", Permanent: true})
+	m.SetTemporaryBatch(entries)
+
+	if m.Size() != 101 || m.CountTemporary() != 100 {
+		t.Fatalf("got size %d temporary %d, want 101 and 100", m.Size(), m.CountTemporary())
+	}
+	if v, _, _ := m.Get(3); v != 3 {
+		t.Fatalf("got %v, want the batch to overwrite 3", v)
+	}
+	i := 0
+	m.ForEachByExpiry(func(e Entry) bool {
+		if e.Key != i {
+			t.Fatalf("got %v at position %d", e.Key, i)
+		}
+		i++
+		return true
+	})
+}
+
+func TestTimedMap_SetAsync(t *testing.T) {
+	m := New(nil)
+
+	var wg sync.WaitGroup
+	var applied atomic.Int32
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				m.SetAsync(g*1000+i, i, time.Hour, func(err error) {
+					if err == nil {
+						applied.Add(1)
+					}
+				})
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	done := make(chan error, 1)
+	m.SetAsync("last", 1, 0, func(err error) { done <- err })
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if v, exp, ok := m.Get("last"); !ok || v != 1 || exp != ElementPermanent {
+		t.Fatalf("got %v %d %v, want permanent 1", v, exp, ok)
+	}
+
+	m.Freeze()
+	m.SetAsync("frozen", 1, 0, func(err error) { done <- err })
+	if err := <-done; err != ErrFrozen {
+		t.Fatalf("SetAsync on a frozen map: got %v, want ErrFrozen", err)
+	}
+	m.Unfreeze()
+
+	m.Close()
+	if m.Size() != 4001 || applied.Load() != 4000 {
+		t.Fatalf("got size %d applied %d after Close, want 4001 and 4000", m.Size(), applied.Load())
+	}
+
+	var after error
+	m.SetAsync("after", 2, 0, func(err error) { after = err })
+	if _, _, ok := m.Get("after"); ok || after != ErrClosed {
+		t.Fatalf("SetAsync after Close: stored %v, done got %v", ok, after)
+	}
+}
+
+func TestTimedMap_ContextOps(t *testing.T) {
+	release := make(chan struct{})
+	m := New(nil, WithLoader(func(ctx context.Context, key any) (any, time.Duration, error) {
+		select {
+		case <-release:
+			return key, 0, nil
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}))
+	defer m.Close()
+
+	bg := context.Background()
+	if err := m.SetCtx(bg, "a", 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.GetCtx(bg, "a"); err != nil || v != 1 {
+		t.Fatalf("got %v %v, want 1", v, err)
+	}
+
+	cancelled, cancel := context.WithCancel(bg)
+	cancel()
+	if err := m.SetCtx(cancelled, "b", 1, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if _, _, ok := m.Get("b"); ok {
+		t.Fatal("SetCtx wrote with a cancelled context")
+	}
+	if err := m.RemoveCtx(cancelled, "a"); !errors.Is(err, context.Canceled) || m.Size() != 1 {
+		t.Fatalf("got %v size %d, want context.Canceled and no removal", err, m.Size())
+	}
+
+	short, cancel := context.WithTimeout(bg, 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.GetCtx(short, "slow"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	close(release)
+	if v, _, err := m.GetOrLoadCtx(bg, "slow"); err != nil || v != "slow" {
+		t.Fatalf("got %v %v, want slow", v, err)
+	}
+
+	plain := New(nil)
+	defer plain.Close()
+	if _, err := plain.GetCtx(bg, "x"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestTimedMap_SetUntilDone(t *testing.T) {
+	expired := make(chan any, 10)
+	m := New(func(key, val any) { expired <- key })
+	defer m.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.SetUntilDone(ctx, "req-1", "state")
+	m.SetUntilDone(ctx, "req-2", "state")
+	m.SetUntilDone(ctx, "req-3", "state")
+	m.SetPermanent("req-2", "overwritten")
+	m.Remove("req-3")
+
+	cancel()
+	select {
+	case got := <-expired:
+		if got != "req-1" {
+			t.Fatalf("got expiry of %v, want req-1", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("entry not removed after its context was cancelled")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, _, ok := m.Get("req-1"); ok {
+		t.Fatal("req-1 still present")
+	}
+	if v, _, ok := m.Get("req-2"); !ok || v != "overwritten" {
+		t.Fatalf("got %v %v, want overwritten req-2 kept", v, ok)
+	}
+	select {
+	case got := <-expired:
+		t.Fatalf("unexpected expiry of %v", got)
+	default:
+	}
+}
+
+func TestTimedMap_Range(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+
+	for i := 0; i < 100; i++ {
+		m.SetWithTTL(i, i, time.Hour)
+	}
+
+	seen := 0
+	m.Range(func(key, value any) bool {
+		seen++
+		if key.(int)%2 == 0 {
+			m.Remove(key)
+		} else {
+			m.SetExpiry(key, time.Time{})
+			m.Remove(key.(int) - 1)
+		}
+		return true
+	})
+	if m.Size() != 50 || m.CountPermanent() != 50 {
+		t.Fatalf("got size %d permanent %d, want 50 and 50", m.Size(), m.CountPermanent())
+	}
+	if seen < 50 || seen > 100 {
+		t.Fatalf("visited %d entries", seen)
+	}
+
+	n := 0
+	m.Range(func(key, value any) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Fatalf("Range went on after fn returned false: %d calls", n)
+	}
+}
+
+func TestTimedMap_WakesForEarlierDeadline(t *testing.T) {
+	expired := make(chan time.Time, 1)
+	m := New(func(key, val any) { expired <- time.Now() })
+	defer m.Close()
+
+	// Let the cleaner go idle first.
+	time.Sleep(20 * time.Millisecond)
+	deadline := time.Now().Add(10 * time.Millisecond)
+	m.SetTemporary("a", 1, deadline)
+
+	select {
+	case at := <-expired:
+		if late := at.Sub(deadline); late > 200*time.Millisecond {
+			t.Fatalf("expired %v late; the idle cleaner was not woken", late)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestTimedMap_WithExpiryBound(t *testing.T) {
+	const bound = 20 * time.Millisecond
+	type firing struct {
+		key any
+		at  time.Time
+	}
+	fired := make(chan firing, 20)
+	m := New(func(key, val any) { fired <- firing{key, time.Now()} }, WithExpiryBound(bound))
+	defer m.Close()
+
+	deadlines := make(map[any]time.Time)
+	for i := 0; i < 20; i++ {
+		d := time.Now().Add(time.Duration(5+i*3) * time.Millisecond)
+		deadlines[i] = d
+		m.SetTemporary(i, i, d)
+	}
+
+	for i := 0; i < 20; i++ {
+		select {
+		case f := <-fired:
+			late := f.at.Sub(deadlines[f.key])
+			if late < 0 {
+				t.Fatalf("%v fired %v early", f.key, -late)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out")
+		}
+	}
+	if n := m.Stats()["expiry_bound_misses"]; n != 0 {
+		t.Fatalf("%d expirations missed the %v bound", n, bound)
+	}
+}
+
+func TestTimedMap_WithCoarseClock(t *testing.T) {
+	expired := make(chan any, 1)
+	m := New(func(key, val any) { expired <- key }, WithCoarseClock(5*time.Millisecond))
+
+	before := time.Now()
+	m.SetWithTTL("a", 1, 20*time.Millisecond)
+	_, exp, _ := m.Get("a")
+	if d := time.Unix(0, exp).Sub(before); d < 20*time.Millisecond-10*time.Millisecond || d > 20*time.Millisecond+10*time.Millisecond {
+		t.Fatalf("deadline %v after the write, want about 20ms", d)
+	}
+
+	select {
+	case <-expired:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	m.Close()
+	done := make(chan struct{})
+	go func() {
+		m.clock.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("clock goroutine still running after Close")
+	}
+}
+
+func TestTypedMaps(t *testing.T) {
+	expired := make(chan int64, 1)
+	im := NewInt64Map[string](func(key int64, val string) { expired <- key })
+	defer im.Close()
+
+	im.SetWithTTL(1, "one", 10*time.Millisecond)
+	im.SetPermanent(2, "two")
+	im.SetWithTTL(3, "three", time.Hour)
+	im.Remove(3)
+	if v, exp, ok := im.Get(2); !ok || v != "two" || exp != ElementPermanent {
+		t.Fatalf("got %q %d %v, want permanent two", v, exp, ok)
+	}
+	select {
+	case k := <-expired:
+		if k != 1 {
+			t.Fatalf("got expiry of %d, want 1", k)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out")
+	}
+	if im.Size() != 1 {
+		t.Fatalf("got size %d, want 1", im.Size())
+	}
+
+	if n := testing.AllocsPerRun(100, func() {
+		im.SetWithTTL(2, "two", time.Hour)
+		im.Get(2)
+	}); n != 0 {
+		t.Fatalf("got %v allocs per overwrite and read, want 0", n)
+	}
+
+	sm := NewStringMap[int](nil)
+	defer sm.Close()
+	sm.SetWithTTL("a", 1, time.Hour)
+	if v, _, ok := sm.Get("a"); !ok || v != 1 {
+		t.Fatalf("got %d %v, want 1", v, ok)
+	}
+	if _, _, ok := sm.Get("b"); ok {
+		t.Fatal("got a missing key")
+	}
+}
+
+func TestTimedMap_WithArena(t *testing.T) {
+	m := New(nil, WithArena(64))
+	defer m.Close()
+
+	payload := []byte("0123456789abcdef")
+	for i := 0; i < 8; i++ {
+		m.SetPermanent(i, payload)
+	}
+	m.SetPermanent("big", make([]byte, 100))
+	payload[0] = 'X'
+
+	v, _, _ := m.Get(3)
+	if !bytes.Equal(v.([]byte), []byte("0123456789abcdef")) {
+		t.Fatalf("got %q, want the value as written", v)
+	}
+	v.([]byte)[1] = 'Y'
+	if v, _, _ := m.Get(3); v.([]byte)[1] != '1' {
+		t.Fatal("mutating a returned value changed the stored one")
+	}
+
+	stats := m.Stats()
+	if stats["arena_bytes"] != 128 || stats["arena_live_bytes"] != 128 {
+		t.Fatalf("got %d held %d live, want 128 and 128", stats["arena_bytes"], stats["arena_live_bytes"])
+	}
+	if _, ok := m.items[3].Value.(*arenaRef); !ok {
+		t.Fatal("value not stored in the arena")
+	}
+	if _, ok := m.items["big"].Value.([]byte); !ok {
+		t.Fatal("value larger than a slab stored in the arena")
+	}
+
+	// Freeing the whole first slab releases it.
+	for i := 0; i < 4; i++ {
+		m.Remove(i)
+	}
+	m.SetPermanent(4, []byte("short"))
+	stats = m.Stats()
+	if stats["arena_bytes"] != 128 || stats["arena_live_bytes"] != 53 {
+		t.Fatalf("got %d held %d live, want 128 and 53", stats["arena_bytes"], stats["arena_live_bytes"])
+	}
+
+	m.RemoveAll()
+	if stats := m.Stats(); stats["arena_bytes"] != 0 {
+		t.Fatalf("got %d held after RemoveAll, want 0", stats["arena_bytes"])
+	}
+}
+
+func TestTimedMap_WithArenaConcurrent(t *testing.T) {
+	m := New(nil, WithArena(1<<16))
+	defer m.Close()
+
+	m.SetPermanent("k", []byte("first"))
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			m.SetPermanent(i%16, []byte("0123456789"))
+			runtime.Gosched()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if v, _, _ := m.Get("k"); string(v.([]byte)) != "first" {
+				t.Errorf("got %q, want first", v)
+				return
+			}
+			runtime.Gosched()
+		}
+	}()
+	wg.Wait()
+}
+
+func TestShardedMap(t *testing.T) {
+	expired := make(chan any, 10)
+	m := NewSharded(4, func(key, val any) { expired <- key })
+	defer m.Close()
+
+	for i := 0; i < 1000; i++ {
+		m.SetPermanent(i, i)
+	}
+	m.SetWithTTL("t", "x", 10*time.Millisecond)
+	if v, _, ok := m.Get(500); !ok || v != 500 {
+		t.Fatalf("got %v %v, want 500", v, ok)
+	}
+	select {
+	case k := <-expired:
+		if k != "t" {
+			t.Fatalf("got expiry of %v, want t", k)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	detailed := m.StatsDetailed()
+	if len(detailed) != 4 {
+		t.Fatalf("got %d shards, want 4", len(detailed))
+	}
+	total := 0
+	for _, s := range detailed {
+		if s.Size == 0 || s.Size > 500 {
+			t.Fatalf("shard %d holds %d of 1000 keys", s.Shard, s.Size)
+		}
+		total += s.Size
+	}
+	if total != 1000 || m.Size() != 1000 {
+		t.Fatalf("got %d over shards and size %d, want 1000", total, m.Size())
+	}
+	if got := m.Stats()["added"]; got != 1001 {
+		t.Fatalf("got %d added, want 1001", got)
+	}
+
+	m.Remove(1)
+	m.RemoveAll()
+	if m.Size() != 0 {
+		t.Fatalf("got size %d after RemoveAll", m.Size())
+	}
+}
+
+func TestShardedMap_Resize(t *testing.T) {
+	fixed := NewSharded(2, nil)
+	defer fixed.Close()
+	if err := fixed.Resize(4); err != ErrFixedShards {
+		t.Fatalf("got %v resizing a fixed map", err)
+	}
+
+	m := NewAutoscaledSharded(ShardAutoscale{Min: 2, Max: 8, Every: time.Hour}, nil)
+	defer m.Close()
+	for i := 0; i < 2000; i++ {
+		m.SetWithTTL(i, i, time.Hour)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			k := i % 2000
+			m.SetWithTTL(k, k, time.Hour)
+			if v, _, ok := m.Get(k); !ok || v != k {
+				t.Errorf("got %v %v for %d during resize", v, ok, k)
+				return
+			}
+		}
+	}()
+	for _, n := range []int{8, 3} {
+		if err := m.Resize(n); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(m.StatsDetailed()); got != n {
+			t.Fatalf("got %d shards, want %d", got, n)
+		}
+	}
+	close(stop)
+	<-done
+
+	if n := m.Size(); n != 2000 {
+		t.Fatalf("got size %d after resizing, want 2000", n)
+	}
+	// Moving entries is not counted as adding them.
+	before := m.Stats()
+	if err := m.Resize(5); err != nil {
+		t.Fatal(err)
+	}
+	after := m.Stats()
+	if after["current"] != 2000 || after["added"] != before["added"] {
+		t.Fatalf("got %d current and %d added after resizing, want 2000 and %d",
+			after["current"], after["added"], before["added"])
+	}
+	if _, exp, ok := m.Get(1999); !ok || exp == ElementPermanent {
+		t.Fatalf("got %v %v, want a temporary entry", exp, ok)
+	}
+}
+
+func TestShardedMap_PointerKeys(t *testing.T) {
+	m := NewSharded(16, nil)
+	defer m.Close()
+
+	type session struct{ hits int }
+	type ref struct {
+		s    *session
+		name string
+	}
+	keys := make([]*session, 64)
+	for i := range keys {
+		keys[i] = &session{}
+		m.SetPermanent(keys[i], i)
+		m.SetPermanent(ref{keys[i], "r"}, i)
+	}
+	// Pointer keys compare by address, so changing what they point to
+	// must not move them to another shard.
+	for _, k := range keys {
+		k.hits += 1000
+	}
+	for i, k := range keys {
+		if v, _, ok := m.Get(k); !ok || v != i {
+			t.Fatalf("Get(pointer %d) = %v, %v after mutating its target", i, v, ok)
+		}
+		if v, _, ok := m.Get(ref{k, "r"}); !ok || v != i {
+			t.Fatalf("Get(struct %d) = %v, %v after mutating its pointer's target", i, v, ok)
+		}
+	}
+}
+
+func TestShardedMap_ResizeSkipsSizeAlarms(t *testing.T) {
+	var highs, lows atomic.Int32
+	m := NewAutoscaledSharded(ShardAutoscale{Min: 2, Max: 8, Every: time.Hour}, nil,
+		WithSizeAlarm(400, 50, func(int) { highs.Add(1) }, func(int) { lows.Add(1) }))
+	defer m.Close()
+
+	for i := 0; i < 1000; i++ {
+		m.SetPermanent(i, i)
+	}
+	if highs.Load() != 2 || lows.Load() != 0 {
+		t.Fatalf("got %d high and %d low alarms filling 2 shards, want 2 and 0", highs.Load(), lows.Load())
+	}
+	if err := m.Resize(8); err != nil {
+		t.Fatal(err)
+	}
+	if highs.Load() != 2 || lows.Load() != 0 {
+		t.Fatalf("got %d high and %d low alarms after resizing, want 2 and 0", highs.Load(), lows.Load())
+	}
+}
+
+func TestShardedMap_ResizeKeepsEntryState(t *testing.T) {
+	m := NewAutoscaledSharded(ShardAutoscale{Min: 2, Max: 8, Every: time.Hour}, nil, WithSlidingExpiration())
+	defer m.Close()
+	shard := func(key any) *TimedMap { return m.layout.Load().shard(key) }
+
+	m.SetWithTTL("sliding", 1, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shard("tied").SetUntilDone(ctx, "tied", 1)
+	shard("refreshed").SetRefreshing("refreshed", 0, 5*time.Millisecond, func(ctx context.Context, key, current any) (any, error) {
+		return current.(int) + 1, nil
+	})
+	ttl := shard("sliding").items["sliding"].ttl
+
+	if err := m.Resize(8); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := shard("sliding").items["sliding"].ttl; got != ttl {
+		t.Fatalf("sliding TTL is %d after resizing, want %d", got, ttl)
+	}
+
+	v, _, _ := m.Get("refreshed")
+	deadline := time.Now().Add(time.Second)
+	for {
+		if w, _, _ := m.Get("refreshed"); w.(int) > v.(int) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refreshing stopped after resizing")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	for {
+		if _, _, ok := m.Get("tied"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("entry outlived its context after resizing")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTimedMap_SyncCallbacks(t *testing.T) {
+	var mu sync.Mutex
+	var got []any
+	m := New(func(key, _ any) {
+		mu.Lock()
+		got = append(got, key)
+		mu.Unlock()
+	}, WithSyncCallbacks(), WithBackend(BackendWheel))
+	m.StopCleaner()
+
+	m.SetWithPriority("c", 3, 30*time.Millisecond, PriorityHigh)
+	m.SetWithTTL("b", 2, 20*time.Millisecond)
+	m.SetWithTTL("a", 1, 10*time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+
+	m.StartCleaner()
+	defer m.Close()
+	deadline := time.Now().Add(time.Second)
+	for (m.ExpireQueueDepth() > 0 || m.Size() > 0) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(got) != "[a b c]" {
+		t.Fatalf("got callbacks %v, want [a b c]", got)
+	}
+}
+
+func TestTimedMap_SyncCallbacksStopCleaner(t *testing.T) {
+	group := NewCleanerGroup()
+	defer group.Close()
+
+	cases := []struct {
+		name string
+		opts []Option
+		stop func(m *TimedMap)
+	}{
+		{"close", nil, func(m *TimedMap) { m.Close() }},
+		{"restart", nil, func(m *TimedMap) { m.RestartCleaner() }},
+		{"group", []Option{WithCleanerGroup(group)}, func(m *TimedMap) { m.StopCleaner() }},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			done := make(chan struct{})
+			var m *TimedMap
+			m = New(func(_, _ any) {
+				c.stop(m)
+				close(done)
+			}, append(c.opts, WithSyncCallbacks())...)
+			defer m.Close()
+
+			m.SetWithTTL("k", 1, time.Millisecond)
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("callback stopping the cleaner it runs on deadlocked")
+			}
+		})
+	}
+}
+
+func TestTimedMap_SubscriberClosesMap(t *testing.T) {
+	m := New(nil)
+	closed := make(chan struct{})
+	m.Subscribe(func(ev Event) {
+		// Expiry events arrive on the cleaner, which Close waits for, so
+		// the subscriber has to close the map from another goroutine.
+		m.SetPermanent("seen", ev.Key)
+		go func() {
+			m.Close()
+			close(closed)
+		}()
+	}, EventExpired)
+
+	m.SetWithTTL("k", 1, time.Millisecond)
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close started by a subscriber did not return")
+	}
+	if v, _, ok := m.Get("seen"); !ok || v != "k" {
+		t.Fatalf("got %v %v, want the subscriber's write", v, ok)
+	}
+}
+
+func TestTimedMap_SyncCallbackClosesOtherMap(t *testing.T) {
+	// b's cleaner is busy delivering an event when a's callback closes
+	// b; Close must still wait for it.
+	other := New(nil)
+	inSweep, swept := make(chan struct{}), make(chan struct{})
+	other.Subscribe(func(Event) {
+		close(inSweep)
+		time.Sleep(50 * time.Millisecond)
+		close(swept)
+	}, EventExpired)
+	other.SetWithTTL("k", 1, time.Millisecond)
+
+	done := make(chan bool, 1)
+	m := New(func(_, _ any) {
+		<-inSweep
+		other.Close()
+		select {
+		case <-swept:
+			done <- true
+		default:
+			done <- false
+		}
+	}, WithSyncCallbacks())
+	defer m.Close()
+	m.SetWithTTL("k", 1, time.Millisecond)
+
+	select {
+	case waited := <-done:
+		if !waited {
+			t.Fatal("Close from another map's sync callback did not wait for the cleaner")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("callback closing another map deadlocked")
+	}
+}
+
+func TestTimedMap_Tick(t *testing.T) {
+	var got []any
+	m := New(func(key, _ any) { got = append(got, key) }, WithManualExpiry(), WithSyncCallbacks())
+	defer m.Close()
+
+	if m.CleanerRunning() {
+		t.Fatal("cleaner running with WithManualExpiry")
+	}
+	m.SetWithTTL("a", 1, time.Hour)
+	m.SetWithTTL("b", 2, 2*time.Hour)
+	m.SetPermanent("c", 3)
+
+	now := time.Now()
+	if n := m.Tick(now); n != 0 {
+		t.Fatalf("Tick(now) expired %d entries, want 0", n)
+	}
+	if n := m.Tick(now.Add(90 * time.Minute)); n != 1 || fmt.Sprint(got) != "[a]" {
+		t.Fatalf("Tick(+90m) expired %d entries with callbacks %v, want 1 and [a]", n, got)
+	}
+	if n := m.Tick(now.Add(24 * time.Hour)); n != 1 || m.Size() != 1 {
+		t.Fatalf("Tick(+24h) expired %d entries leaving %d, want 1 and 1", n, m.Size())
+	}
+}
+
+func TestTimedMap_Run(t *testing.T) {
+	done := make(chan struct{})
+	m := New(func(key, _ any) {
+		time.Sleep(20 * time.Millisecond)
+		close(done)
+	}, WithManualExpiry())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- m.Run(ctx) }()
+
+	m.SetWithTTL("k", 1, time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for m.ExpireQueueDepth() == 0 && m.Size() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("Run returned %v, want nil", err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatal("Run returned before the expiry callback finished")
+	}
+	if err := m.Run(context.Background()); err != ErrClosed {
+		t.Fatalf("Run on a closed map returned %v, want ErrClosed", err)
+	}
+}
+
+func TestFairCallbacks(t *testing.T) {
+	gate := make(chan struct{})
+	var (
+		mu  sync.Mutex
+		got []any
+		wg  sync.WaitGroup
+	)
+	m := New(func(key, _ any) {
+		if key == "a1" {
+			<-gate
+		}
+		mu.Lock()
+		got = append(got, key)
+		mu.Unlock()
+		wg.Done()
+	}, WithManualExpiry(), WithCallbackWorkers(1, 16), WithFairCallbacks(func(key any) string {
+		return key.(string)[:1]
+	}))
+	defer m.Close()
+
+	keys := []string{"a1", "a2", "a3", "a4", "a5", "b1"}
+	for i, k := range keys {
+		m.SetWithTTL(k, i, time.Duration(i+1)*time.Millisecond)
+	}
+	wg.Add(len(keys))
+	m.Tick(time.Now().Add(time.Hour))
+	close(gate)
+	wg.Wait()
+
+	// a1 may have been taken before or after a2 was queued, so b1 is
+	// second or third, but not stuck behind all of a.
+	if got[1] != "b1" && got[2] != "b1" {
+		t.Fatalf("got callbacks in order %v, want b1 among the first three", got)
+	}
+}
+
+func TestFairCallbacksBounded(t *testing.T) {
+	partition := func(key any) string { return fmt.Sprint(key.(int) % 3) }
+
+	// A queue size of 0 means the default, not a queue that is always
+	// full, so writers are not held up by WithBackpressure.
+	m := New(func(key, _ any) {}, WithCallbackWorkers(1, 0), WithBackpressure(time.Second), WithFairCallbacks(partition))
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		m.SetWithTTL(i, i, time.Hour)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("10 writes took %v with an empty fair queue", d)
+	}
+	m.Close()
+
+	release := make(chan struct{})
+	m = New(func(key, _ any) { <-release }, WithManualExpiry(), WithCallbackWorkers(1, 4), WithFairCallbacks(partition))
+	defer m.Close()
+	defer close(release)
+	for i := 0; i < 20; i++ {
+		m.SetWithTTL(i, i, time.Millisecond)
+	}
+	m.Tick(time.Now().Add(time.Hour))
+	// Four callbacks wait, one more runs if the worker took it in time,
+	// and the rest overflow.
+	if n := m.Stats()["callback_overflow"]; n != 15 && n != 16 {
+		t.Fatalf("got %d overflowing callbacks, want 15 or 16", n)
+	}
+}
+
+func TestCallbackAutoscale(t *testing.T) {
+	release := make(chan struct{})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	m := New(func(key, val any) { <-release }, WithCallbackWorkers(1, 8), WithCallbackAutoscale(1, 4))
+	defer m.Close()
+	defer unblock()
+
+	for i := 0; i < 20; i++ {
+		m.SetWithTTL(i, i, time.Millisecond)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for m.Stats()["callback_workers"] < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := m.Stats()["callback_workers"]; n != 4 {
+		t.Fatalf("got %d workers under load, want 4", n)
+	}
+
+	unblock()
+	deadline = time.Now().Add(5 * time.Second)
+	for m.Stats()["callback_workers"] > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := m.Stats()["callback_workers"]; n != 1 {
+		t.Fatalf("got %d workers when idle, want 1", n)
+	}
+}
+
+func TestTimedMap_LockWaits(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+
+	m.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		m.Size()
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	m.mu.Unlock()
+	<-done
+
+	if n := m.Stats()["lock_waits"]; n == 0 {
+		t.Fatal("a blocked read was not counted")
+	}
+}
+
+func TestTimedMap_ExpireQueueDepth(t *testing.T) {
+	release := make(chan struct{})
+	m := New(func(key, val any) { <-release })
+	defer m.Close()
+
+	m.SetWithTTL("a", 1, time.Millisecond)
+	m.SetWithTTL("b", 2, time.Millisecond)
+	m.SetWithTTL("c", 3, time.Hour)
+	if n := m.HeapLen(); n != 3 {
+		t.Fatalf("got heap length %d, want 3", n)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for m.ExpireQueueDepth() != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := m.Stats()["expire_queue_depth"]; n != 2 {
+		t.Fatalf("got queue depth %d, want 2 blocked callbacks", n)
+	}
+	if n := m.HeapLen(); n != 1 {
+		t.Fatalf("got heap length %d, want 1", n)
+	}
+
+	close(release)
+	for m.ExpireQueueDepth() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := m.ExpireQueueDepth(); n != 0 {
+		t.Fatalf("got queue depth %d after the callbacks returned", n)
+	}
+}
+
+func TestTimedMap_Backpressure(t *testing.T) {
+	release := make(chan struct{})
+	var ran atomic.Int32
+	m := New(func(key, val any) {
+		<-release
+		ran.Add(1)
+	}, WithCallbackWorkers(1, 2), WithBackpressure(50*time.Millisecond))
+
+	// One callback blocks the worker and two fill the queue.
+	for i := 0; i < 3; i++ {
+		m.SetWithTTL(i, i, time.Millisecond)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for m.Size() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for !m.pool.full() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	m.SetPermanent("p", 1)
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Fatalf("writer waited %v with a full callback queue, want about 50ms", waited)
+	}
+
+	close(release)
+	m.Close()
+	if n := ran.Load(); n != 3 {
+		t.Fatalf("got %d callbacks run, want 3", n)
+	}
+	if s := m.Stats(); s["backpressure_waits"] == 0 || s["callback_overflow"] != 0 {
+		t.Fatalf("got %d waits and %d overflows, want some waits and no overflow", s["backpressure_waits"], s["callback_overflow"])
+	}
+}
+
+func TestTimedMap_Priority(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var order []any
+	m := New(func(key, val any) {
+		if key == "block" {
+			<-release
+			return
+		}
+		mu.Lock()
+		order = append(order, key)
+		mu.Unlock()
+	}, WithCallbackWorkers(1, 100))
+
+	m.SetWithTTL("block", 0, time.Millisecond)
+	deadline := time.Now().Add(3 * time.Second)
+	for m.ExpireQueueDepth() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	exp := time.Now().Add(5 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		m.SetTemporary(fmt.Sprint("low", i), i, exp)
+		m.SetTemporary(fmt.Sprint("high", i), i, exp)
+		m.SetPriority(fmt.Sprint("high", i), PriorityHigh)
+	}
+	m.SetWithPriority("low-late", 0, time.Millisecond, PriorityLow)
+	for m.Size() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	m.Close()
+	if len(order) != 21 {
+		t.Fatalf("got %d callbacks, want 21", len(order))
+	}
+	for i, k := range order[:10] {
+		if !strings.HasPrefix(k.(string), "high") {
+			t.Fatalf("callback %d was %v before all high-priority keys ran: %v", i, k, order)
+		}
+	}
+}
+
+func TestTimedMap_SerializedCallbacks(t *testing.T) {
+	var running [4]atomic.Int32
+	var overlaps, fired atomic.Int32
+	var m *TimedMap
+	m = New(func(key, val any) {
+		k := key.(int)
+		if running[k].Add(1) != 1 {
+			overlaps.Add(1)
+		}
+		if n := val.(int); n < 5 {
+			m.SetWithTTL(k, n+1, time.Millisecond)
+		}
+		time.Sleep(5 * time.Millisecond)
+		running[k].Add(-1)
+		fired.Add(1)
+	}, WithSerializedCallbacks())
+
+	for k := 0; k < 4; k++ {
+		m.SetWithTTL(k, 0, time.Millisecond)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fired.Load() != 24 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	m.Close()
+
+	if n := fired.Load(); n != 24 {
+		t.Fatalf("got %d callbacks, want 24", n)
+	}
+	if n := overlaps.Load(); n != 0 {
+		t.Fatalf("callbacks for the same key overlapped %d times", n)
+	}
+}
+
+func TestTimedMap_SerializedCallbacksPointerKey(t *testing.T) {
+	type job struct{ runs int }
+	var running, overlaps atomic.Int32
+	got := make(chan any, 8)
+	m := New(func(key, val any) {
+		if running.Add(1) != 1 {
+			overlaps.Add(1)
+		}
+		time.Sleep(2 * time.Millisecond)
+		running.Add(-1)
+		got <- val
+	}, WithManualExpiry(), WithCallbackWorkers(8, 16), WithSerializedCallbacks())
+	defer m.Close()
+
+	// The key's target changes between expirations; its callbacks must
+	// still stay on one worker, in order.
+	key := &job{}
+	for i := 0; i < 8; i++ {
+		key.runs = i
+		m.SetWithTTL(key, i, time.Millisecond)
+		m.Tick(time.Now().Add(time.Hour))
+	}
+	for i := 0; i < 8; i++ {
+		select {
+		case v := <-got:
+			if v != i {
+				t.Fatalf("callback %d got value %v, want %d", i, v, i)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d callbacks, want 8", i)
+		}
+	}
+	if n := overlaps.Load(); n != 0 {
+		t.Fatalf("callbacks for the same key overlapped %d times", n)
+	}
+}
+
+func TestTimedMap_CallbackRouter(t *testing.T) {
+	var running [2]atomic.Int32
+	var overlaps, fired atomic.Int32
+	tenant := func(key any) uint64 {
+		if strings.HasPrefix(key.(string), "a/") {
+			return 0
+		}
+		return 1
+	}
+	m := New(func(key, val any) {
+		r := &running[tenant(key)]
+		if r.Add(1) != 1 {
+			overlaps.Add(1)
+		}
+		time.Sleep(2 * time.Millisecond)
+		r.Add(-1)
+		fired.Add(1)
+	}, WithCallbackWorkers(4, 64), WithCallbackRouter(tenant))
+
+	for i := 0; i < 10; i++ {
+		m.SetWithTTL(fmt.Sprint("a/", i), i, time.Millisecond)
+		m.SetWithTTL(fmt.Sprint("b/", i), i, time.Millisecond)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fired.Load() != 20 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	m.Close()
+
+	if n := fired.Load(); n != 20 {
+		t.Fatalf("got %d callbacks, want 20", n)
+	}
+	if n := overlaps.Load(); n != 0 {
+		t.Fatalf("callbacks for the same tenant overlapped %d times", n)
+	}
+}
+
+func TestTimedMap_Flush(t *testing.T) {
+	var mu sync.Mutex
+	released := map[any]any{}
+	m := New(func(key, val any) {
+		mu.Lock()
+		released[key] = val
+		mu.Unlock()
+	}, WithCallbackWorkers(2, 16))
+
+	var dels atomic.Int32
+	m.Subscribe(func(e Event) { dels.Add(1) }, EventDel)
+
+	m.SetPermanent("a", 1)
+	m.SetWithTTL("b", 2, time.Hour)
+	m.RemoveAll()
+	m.SetPermanent("c", 3)
+	m.SetWithTTL("d", 4, time.Hour)
+
+	if n := m.Flush(); n != 2 || m.Size() != 0 || m.CountTemporary() != 0 {
+		t.Fatalf("got %d flushed, size %d, temporary %d, want 2 0 0", n, m.Size(), m.CountTemporary())
+	}
+	m.Close()
+
+	if len(released) != 2 || released["c"] != 3 || released["d"] != 4 {
+		t.Fatalf("got callbacks for %v, want c and d only", released)
+	}
+	if n := dels.Load(); n != 2 {
+		t.Fatalf("got %d del events, want 2", n)
+	}
+}
+
+func TestTimedMap_RemoveMatching(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+
+	for i := 0; i < 10; i++ {
+		m.SetWithTTL(fmt.Sprint("tenant-x:", i), i, time.Hour)
+		m.SetPermanent(fmt.Sprint("tenant-y:", i), i)
+	}
+	n := m.RemoveMatching(func(key, value any) bool {
+		return strings.HasPrefix(key.(string), "tenant-x:") || value == 3
+	})
+	if n != 11 || m.Size() != 9 || m.CountTemporary() != 0 {
+		t.Fatalf("got %d removed, size %d, temporary %d, want 11 9 0", n, m.Size(), m.CountTemporary())
+	}
+	if got := m.Stats()["removed"]; got != 11 {
+		t.Fatalf("got %d in the removed stat, want 11", got)
+	}
+}
+
+func TestTimedMap_RemoveByPrefix(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithPrefixIndex()}} {
+		m := New(nil, opts...)
+
+		for i := 0; i < 50; i++ {
+			m.SetWithTTL(fmt.Sprintf("session:user%d:%d", i%5, i), i, time.Hour)
+		}
+		m.SetPermanent("session:user1", "not a child")
+		m.SetPermanent(1, "not a string")
+
+		if n := m.RemoveByPrefix("session:user1:"); n != 10 {
+			t.Fatalf("got %d removed, want 10", n)
+		}
+		if n := m.RemoveByPrefix("session:user1:"); n != 0 {
+			t.Fatalf("got %d removed on the second pass, want 0", n)
+		}
+		if m.Size() != 42 || m.CountTemporary() != 40 {
+			t.Fatalf("got size %d temporary %d, want 42 and 40", m.Size(), m.CountTemporary())
+		}
+		if n := m.RemoveByPrefix(""); n != 41 {
+			t.Fatalf("got %d removed by the empty prefix, want every string key", n)
+		}
+		m.Close()
+	}
+}
+
+func TestSkipIndex(t *testing.T) {
+	s := newSkipIndex()
+	want := map[string]bool{}
+	for i := 0; i < 2000; i++ {
+		k := fmt.Sprintf("%04d", (i*7919)%1000)
+		if i%3 == 0 {
+			s.remove(k)
+			delete(want, k)
+		} else {
+			s.insert(k)
+			want[k] = true
+		}
+	}
+	if s.n != len(want) {
+		t.Fatalf("got %d keys, want %d", s.n, len(want))
+	}
+
+	prev, n := "", 0
+	s.ascend("0500", func(key string) bool {
+		if key < "0500" || key <= prev || !want[key] {
+			t.Fatalf("got %q after %q", key, prev)
+		}
+		prev = key
+		n++
+		return true
+	})
+	for k := range want {
+		if k >= "0500" {
+			n--
+		}
+	}
+	if n != 0 {
+		t.Fatalf("ascend missed or repeated %d keys", n)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "a/b/c", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hello world", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"user:[0-9]*:session", "user:42:session", true},
+		{"a[", "a[", true},
+		{"*a*b", "xaybzb", true},
+		{"*a*b", "xaybzc", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestTimedMap_KeysMatching(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithPrefixIndex()}} {
+		m := New(nil, opts...)
+		for _, k := range []string{"user:1:name", "user:2:name", "user:10:mail", "order:1"} {
+			m.SetPermanent(k, 1)
+		}
+		m.SetPermanent(7, 1)
+
+		got := m.KeysMatching("user:?:*")
+		sort.Slice(got, func(i, j int) bool { return got[i].(string) < got[j].(string) })
+		if fmt.Sprint(got) != "[user:1:name user:2:name]" {
+			t.Fatalf("got %v", got)
+		}
+		if n := len(m.KeysMatching("*")); n != 4 {
+			t.Fatalf("got %d keys for *, want the 4 string keys", n)
+		}
+		m.Close()
+	}
+}
+
+func TestTimedMap_Scan(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+
+	for i := 0; i < 100; i++ {
+		m.SetPermanent(fmt.Sprintf("keep:%d", i), i)
+		m.SetPermanent(fmt.Sprintf("drop:%d", i), i)
+	}
+
+	seen := map[any]int{}
+	var cursor uint64
+	for calls := 0; ; calls++ {
+		var keys []any
+		keys, cursor = m.Scan(cursor, "keep:*", 7)
+		for _, k := range keys {
+			seen[k]++
+		}
+		// Churn between calls must not make the walk skip stable keys.
+		m.Remove(fmt.Sprintf("drop:%d", calls))
+		m.SetPermanent(fmt.Sprintf("new:%d", calls), calls)
+		if cursor == 0 {
+			break
+		}
+		if calls > 1000 {
+			t.Fatal("scan did not terminate")
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if seen[fmt.Sprintf("keep:%d", i)] == 0 {
+			t.Fatalf("keep:%d was never returned", i)
+		}
+	}
+	if len(seen) != 100 {
+		t.Fatalf("got %d distinct keys, want 100", len(seen))
+	}
+
+	m.RemoveAll()
+	if keys, next := m.Scan(0, "", 0); len(keys) != 0 || next != 0 {
+		t.Fatalf("scan of empty map = %v, %d", keys, next)
+	}
+}
+
+func TestTimedMap_BulkCtxCancel(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+	for i := 0; i < 2000; i++ {
+		m.SetWithTTL(i, i, time.Hour)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	visited := 0
+	err := m.RangeCtx(ctx, func(key, value any) bool {
+		if visited++; visited == 10 {
+			cancel()
+		}
+		return true
+	})
+	if !errors.Is(err, context.Canceled) || visited != 10 {
+		t.Fatalf("RangeCtx: err %v after %d entries", err, visited)
+	}
+
+	if out, err := m.FilterCtx(ctx, func(key, value any) bool { return true }); err == nil || len(out) != 0 {
+		t.Fatalf("FilterCtx: %d entries, err %v", len(out), err)
+	}
+	if n, err := m.RemoveMatchingCtx(ctx, func(key, value any) bool { return true }); err == nil || n != 0 {
+		t.Fatalf("RemoveMatchingCtx: removed %d, err %v", n, err)
+	}
+	var buf bytes.Buffer
+	if err := m.ExportCtx(ctx, &buf); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ExportCtx: err %v", err)
+	}
+	if err := m.ForEachByExpiryCtx(ctx, func(e Entry) bool { return true }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ForEachByExpiryCtx: err %v", err)
+	}
+	if err := m.ForEachOrderedCtx(ctx, func(key, value any) bool { return true }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ForEachOrderedCtx: err %v", err)
+	}
+	if keys, err := m.KeysMatchingCtx(ctx, "*"); err == nil || len(keys) != 0 {
+		t.Fatalf("KeysMatchingCtx: %d keys, err %v", len(keys), err)
+	}
+	if n, err := m.RemoveByPrefixCtx(ctx, ""); err == nil || n != 0 {
+		t.Fatalf("RemoveByPrefixCtx: removed %d, err %v", n, err)
+	}
+	if n, err := m.RemoveOlderThanCtx(ctx, 0); err == nil || n != 0 {
+		t.Fatalf("RemoveOlderThanCtx: removed %d, err %v", n, err)
+	}
+	if m.Size() != 2000 {
+		t.Fatalf("size %d after cancelled operations", m.Size())
+	}
+
+	even := m.Filter(func(key, value any) bool { return key.(int)%2 == 0 })
+	if len(even) != 1000 {
+		t.Fatalf("Filter returned %d entries", len(even))
+	}
+}
+
+func TestTimedMap_LongestLived(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+
+	for i := 1; i <= 20; i++ {
+		m.SetWithTTL(i, i, time.Duration(i)*time.Minute)
+	}
+	m.SetWithTTL("absurd", 0, 1000*time.Hour)
+	m.SetPermanent("p1", 1)
+	m.SetPermanent("p2", 2)
+
+	got, permanent := m.LongestLived(3)
+	if permanent != 2 {
+		t.Fatalf("permanent = %d, want 2", permanent)
+	}
+	var keys []any
+	for _, e := range got {
+		keys = append(keys, e.Key)
+	}
+	if fmt.Sprint(keys) != "[absurd 20 19]" {
+		t.Fatalf("got %v", keys)
+	}
+
+	if got, _ := m.LongestLived(100); len(got) != 21 {
+		t.Fatalf("got %d entries, want all 21 temporary ones", len(got))
+	}
+}
+
+func TestTimedMap_KeyClassifier(t *testing.T) {
+	m := New(nil, WithKeyClassifier(ClassifyByPrefix("session:", "otp:", "otp:admin:")))
+	defer m.Close()
+
+	m.SetPermanent("session:1", 1)
+	m.SetPermanent("session:2", 2)
+	m.SetPermanent("session:2", 3) // overwrite, not an add
+	m.SetWithTTL("otp:1", 1, 10*time.Millisecond)
+	m.SetPermanent("otp:admin:1", 1)
+	m.SetPermanent("other", 1)
+	m.Remove("session:1")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for m.Size() > 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	stats := m.Stats()
+	want := map[string]uint64{
+		"class.session:.added":     2,
+		"class.session:.removed":   1,
+		"class.session:.current":   1,
+		"class.otp:.added":         1,
+		"class.otp:.expired":       1,
+		"class.otp:.current":       0,
+		"class.otp:admin:.current": 1,
+		"class.otp:admin:.expired": 0,
+	}
+	for k, v := range want {
+		if stats[k] != v {
+			t.Errorf("%s = %d, want %d", k, stats[k], v)
+		}
+	}
+	for k := range stats {
+		if strings.HasPrefix(k, "class.other") {
+			t.Errorf("unclassified key reported as %s", k)
+		}
+	}
+
+	m.RemoveAll()
+	if n := m.Stats()["class.session:.current"]; n != 0 {
+		t.Fatalf("current = %d after RemoveAll", n)
+	}
+}
+
+func TestTimedMap_Profiler(t *testing.T) {
+	var mu sync.Mutex
+	counts := map[ProfileOp]int{}
+	m := New(nil, WithProfiler(1, func(op ProfileOp, d time.Duration) {
+		mu.Lock()
+		counts[op]++
+		mu.Unlock()
+	}))
+	defer m.Close()
+
+	m.SetWithTTL("a", 1, time.Hour)
+	m.SetPermanent("b", 2)
+	m.Get("a")
+	m.Remove("b")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if counts[ProfileSet] != 2 || counts[ProfileGet] != 1 || counts[ProfileRemove] != 1 || counts[ProfileSchedule] != 1 {
+		t.Fatalf("counts %v", counts)
+	}
+
+	var sampled atomic.Int64
+	s := New(nil, WithProfiler(10, func(ProfileOp, time.Duration) { sampled.Add(1) }))
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		s.Get(i)
+	}
+	if n := sampled.Load(); n < 9 || n > 11 {
+		t.Fatalf("sampled %d of 100 operations at rate 10", n)
+	}
+}
+
+func TestTimedMap_GoroutineLabels(t *testing.T) {
+	m := New(nil, WithName("sessions"), WithCallbackWorkers(1, 1))
+	defer m.Close()
+
+	if m.Name() != "sessions" {
+		t.Fatalf("Name() = %q", m.Name())
+	}
+
+	// Workers label themselves once they run, so give them a moment.
+	missing := func() []string {
+		var buf bytes.Buffer
+		if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, role := range []string{"cleaner", "callback"} {
+			want := `"temap.map":"sessions", "temap.role":"` + role + `"`
+			if !strings.Contains(buf.String(), want) {
+				out = append(out, want)
+			}
+		}
+		return out
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(missing()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if miss := missing(); len(miss) > 0 {
+		t.Fatalf("goroutine profile lacks %v", miss)
+	}
+}
+
+func TestNewNamed_AllStats(t *testing.T) {
+	a := NewNamed("test.sessions", nil)
+	b := NewNamed("test.otps", nil)
+	a.SetPermanent("k", 1)
+
+	all := AllStats()
+	if all["test.sessions"]["current"] != 1 || all["test.otps"]["current"] != 0 {
+		t.Fatalf("AllStats: %v / %v", all["test.sessions"], all["test.otps"])
+	}
+	if a.Name() != "test.sessions" {
+		t.Fatalf("Name() = %q", a.Name())
+	}
+
+	a.Close()
+	b.Close()
+	all = AllStats()
+	if _, ok := all["test.sessions"]; ok {
+		t.Fatal("closed map still registered")
+	}
+	if _, ok := all["test.otps"]; ok {
+		t.Fatal("closed map still registered")
+	}
+}
+
+func TestCleanerGroup(t *testing.T) {
+	g := NewCleanerGroup()
+	defer g.Close()
+
+	var expired atomic.Int64
+	maps := make([]*TimedMap, 20)
+	for i := range maps {
+		maps[i] = New(func(key, val any) { expired.Add(1) }, WithCleanerGroup(g))
+		defer maps[i].Close()
+	}
+	if g.Size() != len(maps) {
+		t.Fatalf("group cleans %d maps, want %d", g.Size(), len(maps))
+	}
+
+	before := runtime.NumGoroutine()
+	for i, m := range maps {
+		m.SetWithTTL("a", i, time.Duration(10+i)*time.Millisecond)
+		m.SetPermanent("b", i)
+	}
+	if n := runtime.NumGoroutine(); n > before+1 {
+		t.Fatalf("goroutines grew from %d to %d", before, n)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for expired.Load() < int64(len(maps)) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := expired.Load(); n != int64(len(maps)) {
+		t.Fatalf("expired %d entries, want %d", n, len(maps))
+	}
+
+	// A stopped map leaves the group and keeps its due entries.
+	m := maps[0]
+	m.StopCleaner()
+	if g.Size() != len(maps)-1 {
+		t.Fatalf("group cleans %d maps after StopCleaner", g.Size())
+	}
+	m.SetWithTTL("c", 1, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if _, _, ok := m.Get("c"); !ok {
+		t.Fatal("stopped map expired an entry")
+	}
+	m.StartCleaner()
+	deadline = time.Now().Add(2 * time.Second)
+	for m.Size() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if m.Size() != 1 {
+		t.Fatalf("size %d after restarting the cleaner", m.Size())
+	}
+}
+
+func TestWorkerPool_Shared(t *testing.T) {
+	pool := NewWorkerPool(2, 16, 0)
+	defer pool.Close()
+
+	var running, peak, done atomic.Int64
+	onExpire := func(key, val any) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		running.Add(-1)
+		done.Add(1)
+	}
+
+	a := New(onExpire, WithWorkerPool(pool))
+	b := New(onExpire, WithWorkerPool(pool), WithCallbackWorkers(8, 8)) // ignored
+	for i := 0; i < 5; i++ {
+		a.SetWithTTL(i, i, time.Millisecond)
+		b.SetWithTTL(i, i, time.Millisecond)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for done.Load() < 10 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if done.Load() != 10 {
+		t.Fatalf("ran %d callbacks, want 10", done.Load())
+	}
+	if p := peak.Load(); p > 2 {
+		t.Fatalf("%d callbacks ran at once on a pool of 2", p)
+	}
+
+	// Closing a map leaves the shared pool running for the others.
+	a.Close()
+	b.SetWithTTL("late", 1, time.Millisecond)
+	deadline = time.Now().Add(2 * time.Second)
+	for done.Load() < 11 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	b.Close()
+	if done.Load() != 11 {
+		t.Fatal("shared pool stopped with the first map")
+	}
+	if s := pool.Stats(); s["callback_overflow"] != 0 {
+		t.Fatalf("pool stats %v", s)
+	}
+}
+
+func TestTimerWheel(t *testing.T) {
+	w := NewTimerWheel(time.Millisecond, 8)
+	defer w.Close()
+
+	fired := make(chan int, 4)
+	start := time.Now()
+	w.AfterFunc(20*time.Millisecond, func() { fired <- 2 }) // more than one rotation out
+	w.AfterFunc(2*time.Millisecond, func() { fired <- 1 })
+	stopped := w.AfterFunc(5*time.Millisecond, func() { fired <- 0 })
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatal("Stop should succeed exactly once")
+	}
+	if w.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", w.Len())
+	}
+	for _, want := range []int{1, 2} {
+		select {
+		case got := <-fired:
+			if got != want {
+				t.Fatalf("timer %d fired, want %d", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timer %d never fired", want)
+		}
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("timer fired early, after %v", d)
+	}
+
+	var expired atomic.Int64
+	m := New(func(key, val any) { expired.Add(1) }, WithTimerWheel(w))
+	defer m.Close()
+	m.SetWithTTL("a", 1, 5*time.Millisecond)
+	m.SetWithTTL("b", 1, time.Hour)
+	deadline := time.Now().Add(2 * time.Second)
+	for expired.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if expired.Load() != 1 || m.Size() != 1 {
+		t.Fatalf("expired %d, size %d", expired.Load(), m.Size())
+	}
+
+	m.StopCleaner()
+	if w.Len() != 0 {
+		t.Fatalf("stopped map left %d timers on the wheel", w.Len())
+	}
+}
+
+func TestTimedMap_AbandonedMapIsClosed(t *testing.T) {
+	before := LeakedMaps()
+
+	inner := func() *timedMap {
+		m := New(nil)
+		m.SetPermanent("k", 1)
+		return m.timedMap
+	}()
+	New(nil).Close() // closed maps are not leaks
+
+	deadline := time.Now().Add(5 * time.Second)
+	for inner.CleanerRunning() && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if inner.CleanerRunning() {
+		t.Fatal("cleaner of an abandoned map is still running")
+	}
+	if LeakedMaps() < before+1 {
+		t.Fatalf("LeakedMaps() = %d, want at least %d", LeakedMaps(), before+1)
+	}
+}
+
+func TestTimedMap_AbandonedCallbackMapIsClosed(t *testing.T) {
+	before := LeakedMaps()
+
+	fired := make(chan any, 1)
+	inner := func() *timedMap {
+		m := New(func(key, _ any) { fired <- key })
+		m.SetWithTTL("k", 1, time.Hour)
+		return m.timedMap
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for inner.CleanerRunning() && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if inner.CleanerRunning() {
+		t.Fatal("cleaner of an abandoned map with a callback is still running")
+	}
+	if LeakedMaps() < before+1 {
+		t.Fatalf("LeakedMaps() = %d, want at least %d", LeakedMaps(), before+1)
+	}
+	select {
+	case key := <-fired:
+		if key != "k" {
+			t.Fatalf("got callback for %v, want k", key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pending entry of an abandoned map did not expire")
+	}
+}
+
+func TestTimedMap_ReadOnlyKeepsMapAlive(t *testing.T) {
+	v := func() ROView {
+		m := New(nil)
+		m.SetPermanent("p", 1)
+		m.SetWithTTL("k", 2, 20*time.Millisecond)
+		return m.ReadOnly()
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for v.Size() != 1 && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, _, ok := v.Get("k"); ok {
+		t.Fatal("entry did not expire behind the view")
+	}
+	for i := 0; i < 3; i++ {
+		runtime.GC()
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !v.(roView).t.CleanerRunning() {
+		t.Fatal("map behind a live view was closed as abandoned")
+	}
+	if _, _, ok := v.Get("p"); !ok {
+		t.Fatal("permanent entry missing")
+	}
+}
+
+func TestTimedMap_Snapshot(t *testing.T) {
+	m := New(nil, WithCompression(nil, 1))
+	defer m.Close()
+
+	m.SetPermanent("a", "alpha")
+	m.SetWithTTL("b", "beta", time.Hour)
+	s := m.Snapshot()
+
+	m.SetPermanent("c", "gamma")
+	m.Remove("a")
+
+	if s.Len() != 2 || s.Stats()["current"] != 2 || s.Stats()["added"] != 2 {
+		t.Fatalf("snapshot has %d entries, stats %v", s.Len(), s.Stats())
+	}
+	if e, ok := s.Get("a"); !ok || e.Value != "alpha" || !e.Permanent {
+		t.Fatalf("Get(a) = %+v, %v", e, ok)
+	}
+	if e, ok := s.Get("b"); !ok || e.ExpiresAt.Sub(s.Time()) <= 59*time.Minute {
+		t.Fatalf("Get(b) = %+v, %v", e, ok)
+	}
+	if _, ok := s.Get("c"); ok {
+		t.Fatal("snapshot sees a later write")
+	}
+
+	s.Stats()["current"] = 99
+	if s.Stats()["current"] != 2 {
+		t.Fatal("Stats returned the snapshot's own map")
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteJSON(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"value":"alpha"`) {
+		t.Fatalf("WriteJSON: %s", buf.String())
+	}
+}
+
+func TestTimedMap_DumpJSONEncrypted(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(nil, WithEncryption(aead))
+	defer m.Close()
+
+	m.SetPermanent("card", "4111-1111-1111-1111")
+	m.SetPermanent("raw", []byte("4111-1111-1111-1111"))
+
+	var buf bytes.Buffer
+	if err := m.DumpJSON(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	// []byte values are marshalled as base64, so check that form too.
+	b64 := base64.StdEncoding.EncodeToString([]byte("4111-1111-1111-1111"))
+	if strings.Contains(buf.String(), "4111") || strings.Contains(buf.String(), b64) {
+		t.Fatalf("DumpJSON wrote the plaintext: %s", buf.String())
+	}
+}
+
+func TestTimedMap_SnapshotEncrypted(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(nil, WithEncryption(aead))
+	defer m.Close()
+
+	m.SetPermanent("card", "4111-1111-1111-1111")
+	s := m.Snapshot()
+
+	e, _ := s.Get("card")
+	if b, ok := e.Value.([]byte); !ok || bytes.Contains(b, []byte("4111")) {
+		t.Fatalf("snapshot value = %#v, want ciphertext", e.Value)
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteJSON(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "4111") {
+		t.Fatalf("WriteJSON wrote the plaintext: %s", buf.String())
+	}
+}
+
+func TestTimedMap_EntriesCopyOnWrite(t *testing.T) {
+	defer func(n int) { cowChunk = n }(cowChunk)
+	cowChunk = 128 // many chunks, for writers to get in between
+
+	m := New(nil)
+	defer m.Close()
+
+	// Key k starts at k-n. Write s touches key n-1-s%n, against the order
+	// of the copy: it sets the key to s in even rounds of n writes and
+	// removes it in odd ones, so the state after write S is known for
+	// every S.
+	const n = 2000
+	for k := 0; k < n; k++ {
+		m.SetPermanent(k, k-n)
+	}
+	expected := func(k, last int) (int, bool) {
+		j := n - 1 - k
+		if last < j {
+			return k - n, true
+		}
+		s := last - (last-j)%n
+		return s, (s/n)%2 == 0
+	}
+
+	var written atomic.Int64
+	written.Store(-1)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for s := 0; ; s++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if k := n - 1 - s%n; (s/n)%2 == 0 {
+				m.SetPermanent(k, s)
+			} else {
+				m.Remove(k)
+			}
+			written.Store(int64(s))
+		}
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for written.Load() < n {
+		runtime.Gosched()
+	}
+	for round := 0; round < 5; round++ {
+		lo := int(written.Load())
+		entries := m.Entries()
+		hi := int(written.Load()) + 1
+
+		// The copy must match the state after some single write S. Every
+		// value narrows down where S can be.
+		got := make(map[int]int, len(entries))
+		for _, e := range entries {
+			k, v := e.Key.(int), e.Value.(int)
+			got[k] = v
+			if v >= 0 {
+				lo, hi = max(lo, v), min(hi, v+n-1)
+			} else {
+				hi = min(hi, n-2-k)
+			}
+		}
+		consistent := false
+		for last := lo; last <= hi && !consistent; last++ {
+			consistent = true
+			for k := 0; k < n; k++ {
+				want, present := expected(k, last)
+				if v, ok := got[k]; ok != present || ok && v != want {
+					consistent = false
+					break
+				}
+			}
+		}
+		if !consistent {
+			t.Fatalf("round %d: copy matches no state between writes %d and %d", round, lo, hi)
+		}
+	}
+}
+
+func TestTimedMap_GetWithTTL(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+
+	m.SetWithTTL("t", 1, time.Minute)
+	m.SetPermanent("p", 2)
+
+	if v, ttl, ok := m.GetWithTTL("t"); !ok || v != 1 || ttl <= 59*time.Second || ttl > time.Minute {
+		t.Fatalf("GetWithTTL(t) = %v, %v, %v", v, ttl, ok)
+	}
+	if v, ttl, ok := m.GetWithTTL("p"); !ok || v != 2 || ttl != NoExpiry {
+		t.Fatalf("GetWithTTL(p) = %v, %v, %v", v, ttl, ok)
+	}
+	if _, _, ok := m.GetWithTTL("missing"); ok {
+		t.Fatal("GetWithTTL found a missing key")
+	}
+
+	m.StopCleaner()
+	m.SetWithTTL("due", 3, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, ttl, ok := m.GetWithTTL("due"); !ok || ttl != 0 {
+		t.Fatalf("overdue entry: ttl %v, ok %v", ttl, ok)
+	}
+}
+
+func TestTimedMap_RemoveSilently(t *testing.T) {
+	m := New(nil, WithAuditLog(8))
+	defer m.Close()
+
+	var events atomic.Int64
+	m.Subscribe(func(Event) { events.Add(1) }, EventDel)
+
+	m.SetPermanent("a", 1)
+	m.RemoveSilently("a")
+	m.RemoveSilently("missing")
+	if _, _, ok := m.Get("a"); ok {
+		t.Fatal("key still present")
+	}
+	if events.Load() != 0 {
+		t.Fatalf("%d del events for a silent removal", events.Load())
+	}
+	if ops := m.RecentOps(8); len(ops) != 1 || ops[0].Type != EventSet {
+		t.Fatalf("audit log %v", ops)
+	}
+	if n := m.Stats()["removed"]; n != 1 {
+		t.Fatalf("removed = %d", n)
+	}
+}
+
+func TestTimedMap_SilentExpiry(t *testing.T) {
+	var calls atomic.Int64
+	m := New(func(key, val any) { calls.Add(1) })
+	defer m.Close()
+
+	var events atomic.Int64
+	m.Subscribe(func(Event) { events.Add(1) }, EventExpired)
+
+	m.SetSilentWithTTL("quiet", 1, 5*time.Millisecond)
+	m.SetWithTTL("marked", 2, 5*time.Millisecond)
+	m.SetSilent("marked", true)
+	m.SetWithTTL("loud", 3, 5*time.Millisecond)
+	if m.SetSilent("missing", true) {
+		t.Fatal("SetSilent found a missing key")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for (m.Size() > 0 || calls.Load() == 0) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if calls.Load() != 1 || events.Load() != 1 {
+		t.Fatalf("%d callbacks and %d events, want 1 each", calls.Load(), events.Load())
+	}
+	if n := m.Stats()["expired"]; n != 3 {
+		t.Fatalf("expired = %d, want 3", n)
+	}
+}
+
+func TestTimedMap_OverwriteClearsFlags(t *testing.T) {
+	var calls atomic.Int64
+	m := New(func(key, val any) { calls.Add(1) })
+	defer m.Close()
+
+	m.SetSilentWithTTL("a", 1, time.Hour)
+	m.SetWithTTL("a", 2, 5*time.Millisecond)
+	m.SetWithPriority("b", 1, time.Hour, PriorityHigh)
+	m.Set("b", 2)
+
+	m.rlock()
+	p := m.items["b"].priority
+	m.mu.RUnlock()
+	if p != PriorityNormal {
+		t.Fatalf("priority after Set = %d, want PriorityNormal", p)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for calls.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if calls.Load() != 1 {
+		t.Fatal("overwriting a silent entry kept it silent")
+	}
+}
+
+func TestTimedMap_ExpiryDecider(t *testing.T) {
+	var expired sync.Map
+	var renewed atomic.Int64
+	deciding, release := make(chan struct{}), make(chan struct{})
+	m := New(func(key, val any) { expired.Store(key, val) }, WithExpiryDecider(func(key, val any) Verdict {
+		switch key {
+		case "renew":
+			if renewed.Add(1) == 1 {
+				return Renew(5 * time.Millisecond)
+			}
+		case "persist":
+			return Persist
+		case "raced":
+			close(deciding)
+			<-release
+			return Renew(time.Hour)
+		}
+		return Drop
+	}))
+	defer m.Close()
+
+	m.SetWithTTL("renew", 1, 5*time.Millisecond)
+	m.SetWithTTL("persist", 2, 5*time.Millisecond)
+	m.SetWithTTL("raced", 3, 5*time.Millisecond)
+
+	<-deciding
+	m.SetPermanent("raced", 4)
+	close(release)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for m.Size() > 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if renewed.Load() != 2 {
+		t.Fatalf("renew decided %d times, want 2", renewed.Load())
+	}
+	if v, ok := expired.Load("renew"); !ok || v != 1 {
+		t.Fatalf("renew callback got %v, %v", v, ok)
+	}
+	if _, exp, ok := m.Get("persist"); !ok || exp != ElementPermanent {
+		t.Fatalf("persist: ok=%v expiresAt=%v", ok, exp)
+	}
+	if v, exp, ok := m.Get("raced"); !ok || v != 4 || exp != ElementPermanent {
+		t.Fatalf("raced = %v, %v, %v; want the concurrent Set to win", v, exp, ok)
+	}
+	if _, ok := expired.Load("raced"); ok {
+		t.Fatal("overwritten entry expired")
+	}
+}
+
+func TestTimedMap_PreExpiryHook(t *testing.T) {
+	var refs atomic.Int64
+	refs.Store(1)
+	var expired atomic.Int64
+	m := New(func(key, val any) { expired.Add(1) }, WithPreExpiryHook(func(key, val any) (time.Duration, bool) {
+		return 5 * time.Millisecond, refs.Load() > 0
+	}))
+	defer m.Close()
+
+	m.SetWithTTL("a", 1, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if _, _, ok := m.Get("a"); !ok || expired.Load() != 0 {
+		t.Fatalf("referenced entry expired: ok=%v callbacks=%d", ok, expired.Load())
+	}
+
+	refs.Store(0)
+	deadline := time.Now().Add(2 * time.Second)
+	for expired.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, _, ok := m.Get("a"); ok || expired.Load() != 1 {
+		t.Fatalf("released entry: ok=%v callbacks=%d", ok, expired.Load())
+	}
+}
+
+func TestTimedMap_SlowCallbackThreshold(t *testing.T) {
+	logs := &logRecorder{}
+	done := make(chan any, 2)
+	m := New(func(key, val any) {
+		if key == "slow" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		done <- key
+	}, WithLogger(logs), WithSlowCallbackThreshold(10*time.Millisecond))
+	defer m.Close()
+
+	m.SetWithTTL("fast", 1, time.Millisecond)
+	m.SetWithTTL("slow", 2, time.Millisecond)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("callbacks did not run")
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	if n := m.Stats()["slow_callbacks"]; n != 1 {
+		t.Fatalf("slow_callbacks = %d, want 1", n)
+	}
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	if len(logs.lines) != 2 || !strings.Contains(logs.lines[0], "slow") || !strings.Contains(logs.lines[1], "took") {
+		t.Fatalf("logged %q", logs.lines)
+	}
+}
+
+func TestTimedMap_GracePeriod(t *testing.T) {
+	stale, expired := make(chan any, 4), make(chan any, 4)
+	m := New(func(key, val any) { expired <- key },
+		WithGracePeriod(50*time.Millisecond, func(key, val any) { stale <- key }))
+	defer m.Close()
+
+	var events atomic.Int64
+	m.Subscribe(func(Event) { events.Add(1) }, EventStale)
+
+	m.SetWithTTL("a", 1, 5*time.Millisecond)
+	m.SetWithTTL("b", 2, 5*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-stale:
+		case <-time.After(2 * time.Second):
+			t.Fatal("entries did not go stale")
+		}
+	}
+	if v, isStale, ok := m.GetStale("a"); !ok || !isStale || v != 1 {
+		t.Fatalf("GetStale(a) = %v, %v, %v", v, isStale, ok)
+	}
+	if events.Load() != 2 {
+		t.Fatalf("%d stale events, want 2", events.Load())
+	}
+
+	m.SetWithTTL("b", 3, time.Hour)
+	if _, isStale, _ := m.GetStale("b"); isStale {
+		t.Fatal("overwritten entry still stale")
+	}
+
+	select {
+	case key := <-expired:
+		if key != "a" {
+			t.Fatalf("%v expired", key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stale entry did not expire")
+	}
+	if _, _, ok := m.Get("a"); ok {
+		t.Fatal("expired entry still present")
+	}
+	if _, _, ok := m.Get("b"); !ok {
+		t.Fatal("refreshed entry expired")
+	}
+}
+
+func TestTimedMap_Warmup(t *testing.T) {
+	m := New(nil, WithWarmup(func(add func(key, value any, ttl time.Duration)) error {
+		add("a", 1, 0)
+		add("b", 2, time.Hour)
+		return nil
+	}))
+	defer m.Close()
+	select {
+	case <-m.Ready():
+	default:
+		t.Fatal("synchronous warm-up not ready after New")
+	}
+	if m.Size() != 2 || m.CountTemporary() != 1 {
+		t.Fatalf("size %d, temporary %d", m.Size(), m.CountTemporary())
+	}
+
+	release := make(chan struct{})
+	fail := errors.New("backend down")
+	m2 := New(nil, WithLogger(nil), WithAsyncWarmup(func(add func(key, value any, ttl time.Duration)) error {
+		<-release
+		add("a", "warm", 0)
+		add("b", "warm", 0)
+		return fail
+	}))
+	defer m2.Close()
+	if m2.WarmupErr() != nil {
+		t.Fatal("error before ready")
+	}
+	m2.SetPermanent("a", "live")
+	close(release)
+	<-m2.Ready()
+	if !errors.Is(m2.WarmupErr(), fail) {
+		t.Fatalf("WarmupErr = %v", m2.WarmupErr())
+	}
+	if v, _, _ := m2.Get("a"); v != "live" {
+		t.Fatalf("warm-up overwrote a live key with %v", v)
+	}
+	if v, _, _ := m2.Get("b"); v != "warm" {
+		t.Fatalf("b = %v", v)
+	}
+}
+
+func TestNewFromSnapshot(t *testing.T) {
+	src := New(nil)
+	src.SetPermanent("a", "old")
+	src.SetPermanent("b", "old")
+	src.SetWithTTL("c", "old", time.Hour)
+	src.SetWithTTL("gone", "old", 20*time.Millisecond)
+	path := filepath.Join(t.TempDir(), "snapshot")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Export(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	src.Close()
+	time.Sleep(30 * time.Millisecond)
+
+	m := NewFromSnapshot(path, nil)
+	defer m.Close()
+	m.SetPermanent("a", "new")
+	<-m.Ready()
+	if err := m.WarmupErr(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Size() != 3 {
+		t.Fatalf("size %d, want 3", m.Size())
+	}
+	if v, _, _ := m.Get("a"); v != "new" {
+		t.Fatalf("a = %v", v)
+	}
+	if v, _, _ := m.Get("b"); v != "old" {
+		t.Fatalf("b = %v", v)
+	}
+	if _, _, ok := m.Get("gone"); ok {
+		t.Fatal("expired entry imported")
+	}
+
+	missing := NewFromSnapshot(filepath.Join(t.TempDir(), "missing"), nil, WithLogger(nil))
+	defer missing.Close()
+	<-missing.Ready()
+	if !errors.Is(missing.WarmupErr(), os.ErrNotExist) {
+		t.Fatalf("WarmupErr = %v", missing.WarmupErr())
+	}
+}
+
+func TestConfig(t *testing.T) {
+	var cfg Config
+	err := json.Unmarshal([]byte(`{
+		"name": "sessions",
+		"default_ttl": "20ms",
+		"backend": "wheel",
+		"backend_resolution": "5ms",
+		"callback_workers": 2,
+		"callback_queue": 16
+	}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Backend != BackendWheel || time.Duration(cfg.DefaultTTL) != 20*time.Millisecond {
+		t.Fatalf("decoded %+v", cfg)
+	}
+
+	expired := make(chan any, 1)
+	m, err := NewFromConfig(cfg, func(key, val any) { expired <- key })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.Name() != "sessions" {
+		t.Fatalf("name %q", m.Name())
+	}
+	m.Set("a", 1)
+	select {
+	case <-expired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("entry with the default TTL did not expire")
+	}
+
+	if err := json.Unmarshal([]byte(`{"backend": "btree"}`), &cfg); err == nil {
+		t.Fatal("unknown backend accepted")
+	}
+	bad := Config{Capacity: -1, CallbackQueue: 8, WheelSlots: 64}
+	err = bad.Validate()
+	for _, want := range []string{"capacity is negative", "need callback_workers", "needs the wheel backend"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("Validate() = %v, want %q", err, want)
+		}
+	}
+	if _, err := NewFromConfig(bad, nil); err == nil {
+		t.Fatal("NewFromConfig accepted an invalid config")
+	}
+}
+
+func TestTimedMap_Freeze(t *testing.T) {
+	for _, b := range []Backend{BackendHeap, BackendTimers} {
+		t.Run(b.String(), func(t *testing.T) {
+			expired := make(chan any, 4)
+			m := New(func(key, val any) { expired <- key }, WithBackend(b))
+			defer m.Close()
+
+			m.SetPermanent("a", 1)
+			m.SetWithTTL("b", 2, 10*time.Millisecond)
+			m.Freeze()
+			if !m.Frozen() {
+				t.Fatal("not frozen")
+			}
+
+			m.SetPermanent("c", 3)
+			m.Remove("a")
+			if m.MakePermanent("b") {
+				t.Fatal("MakePermanent succeeded while frozen")
+			}
+			if _, err := m.RemoveMatchingCtx(context.Background(), func(any, any) bool { return true }); !errors.Is(err, ErrFrozen) {
+				t.Fatalf("RemoveMatchingCtx error %v", err)
+			}
+			m.RemoveAll()
+
+			time.Sleep(30 * time.Millisecond)
+			if m.Size() != 2 {
+				t.Fatalf("size %d while frozen, want 2", m.Size())
+			}
+			if v, _, ok := m.Get("b"); !ok || v != 2 {
+				t.Fatal("entry expired while frozen")
+			}
+			if n := m.Stats()["frozen_rejects"]; n != 5 {
+				t.Fatalf("frozen_rejects = %d, want 5", n)
+			}
+
+			m.Unfreeze()
+			select {
+			case key := <-expired:
+				if key != "b" {
+					t.Fatalf("%v expired", key)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("overdue entry did not expire after Unfreeze")
+			}
+			m.SetPermanent("c", 3)
+			if _, _, ok := m.Get("c"); !ok {
+				t.Fatal("write rejected after Unfreeze")
+			}
+		})
+	}
+}
+
+func TestTimedMap_ReadOnly(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+	m.SetPermanent("a", 1)
+
+	var view ROView = m.ReadOnly()
+	if v, _, ok := view.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get(a) = %v, %v", v, ok)
+	}
+	m.SetPermanent("b", 2)
+	if view.Size() != 2 || len(view.Keys()) != 2 || view.Stats()["current"] != 2 {
+		t.Fatal("view does not follow the map")
+	}
+	if _, ok := view.(interface{ Remove(key any) }); ok {
+		t.Fatal("view exposes Remove")
+	}
+	if _, ok := view.(*TimedMap); ok {
+		t.Fatal("view unwraps to the map")
+	}
+}
+
+func TestTimedMap_KeysInRange(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		var opts []Option
+		if indexed {
+			opts = append(opts, WithPrefixIndex())
+		}
+		m := New(nil, opts...)
+		for _, k := range []string{"user:3", "order:1", "user:1", "user:2", "zeta"} {
+			m.SetPermanent(k, 1)
+		}
+		m.SetPermanent(42, 1)
+		m.Remove("user:2")
+
+		if got := strings.Join(m.SortedKeys(), ","); got != "order:1,user:1,user:3,zeta" {
+			t.Fatalf("indexed=%v: SortedKeys = %s", indexed, got)
+		}
+		if got := strings.Join(m.KeysInRange("user:", "user;"), ","); got != "user:1,user:3" {
+			t.Fatalf("indexed=%v: KeysInRange = %s", indexed, got)
+		}
+		if got := m.KeysInRange("user:4", "zeta"); len(got) != 0 {
+			t.Fatalf("indexed=%v: empty range gave %v", indexed, got)
+		}
+		m.Close()
+	}
+}
+
+func TestTimedMap_KeysForValue(t *testing.T) {
+	type session struct {
+		user string
+		tags []string
+	}
+	m := New(nil, WithValueIndex(func(v any) any { return v.(session).user }))
+	defer m.Close()
+
+	m.SetPermanent("s1", session{user: "ann"})
+	m.SetPermanent("s2", session{user: "bob", tags: []string{"x"}})
+	m.SetWithTTL("s3", session{user: "ann"}, time.Hour)
+	m.SetPermanent("s2", session{user: "ann"})
+	m.Remove("s1")
+
+	keys := m.KeysForValue("ann")
+	sort.Slice(keys, func(i, j int) bool { return keys[i].(string) < keys[j].(string) })
+	if fmt.Sprint(keys) != "[s2 s3]" {
+		t.Fatalf("KeysForValue(ann) = %v", keys)
+	}
+	if keys := m.KeysForValue("bob"); len(keys) != 0 {
+		t.Fatalf("KeysForValue(bob) = %v", keys)
+	}
+	m.RemoveAll()
+	if keys := m.KeysForValue("ann"); len(keys) != 0 {
+		t.Fatalf("after RemoveAll: %v", keys)
+	}
+
+	plain := New(nil)
+	defer plain.Close()
+	plain.SetPermanent("a", 1)
+	plain.SetPermanent("b", []int{1})
+	if keys := plain.KeysForValue(1); fmt.Sprint(keys) != "[a]" {
+		t.Fatalf("scan gave %v", keys)
+	}
+	if keys := plain.KeysForValue([]int{1}); keys != nil {
+		t.Fatalf("uncomparable value gave %v", keys)
+	}
+}
+
+func TestSet(t *testing.T) {
+	expired := make(chan any, 4)
+	s := NewSet(func(member any) { expired <- member })
+	defer s.Close()
+
+	s.Add("a", 0)
+	s.Add("b", 20*time.Millisecond)
+	if !s.AddIfAbsent("c", time.Hour) || s.AddIfAbsent("a", time.Hour) {
+		t.Fatal("AddIfAbsent")
+	}
+	if !s.Contains("a") || !s.Contains("b") || s.Contains("d") || s.Len() != 3 {
+		t.Fatal("membership")
+	}
+	s.Remove("c")
+
+	select {
+	case m := <-expired:
+		if m != "b" {
+			t.Fatalf("%v expired", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("member did not expire")
+	}
+	if s.Contains("b") || fmt.Sprint(s.Members()) != "[a]" {
+		t.Fatalf("members %v", s.Members())
+	}
+	if !s.AddIfAbsent("b", time.Hour) {
+		t.Fatal("expired member not re-added")
+	}
+}
+
+func TestSet_LenSkipsOverdue(t *testing.T) {
+	s := NewSet(nil, WithManualExpiry())
+	defer s.Close()
+
+	s.Add("a", 0)
+	s.Add("b", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if s.Map().Size() != 2 || s.Len() != 1 || len(s.Members()) != 1 {
+		t.Fatalf("size %d, Len %d, members %v; want the overdue member left out",
+			s.Map().Size(), s.Len(), s.Members())
+	}
+}
+
+func TestSet_ContainsIsALookup(t *testing.T) {
+	s := NewSet(nil, WithSlidingExpiration())
+	defer s.Close()
+
+	s.Add("a", 100*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		time.Sleep(40 * time.Millisecond)
+		if !s.Contains("a") {
+			t.Fatalf("member expired after %d reads, want its deadline to slide", i)
+		}
+	}
+	s.Contains("b")
+	if st := s.Map().Stats(); st["hits"] != 4 || st["misses"] != 1 {
+		t.Fatalf("got %d hits and %d misses, want 4 and 1", st["hits"], st["misses"])
+	}
+}
+
+func TestWindow(t *testing.T) {
+	w := NewWindow(10*time.Millisecond, 100*time.Millisecond)
+	defer w.Close()
+
+	for i := 0; i < 5; i++ {
+		w.Incr("ip")
+	}
+	w.IncrBy("other", 7)
+	if n := w.Count("ip", 50*time.Millisecond); n != 5 {
+		t.Fatalf("count %d, want 5", n)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	w.Incr("ip")
+	if n := w.Count("ip", time.Hour); n != 6 {
+		t.Fatalf("count over the span %d, want 6", n)
+	}
+	if n := w.Count("ip", 15*time.Millisecond); n != 1 {
+		t.Fatalf("count over the last bucket %d, want 1", n)
+	}
+	if n := w.Map().Size(); n != 2 {
+		t.Fatalf("%d entries for 2 keys, want one per key", n)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for w.Map().Size() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w.Map().Size() != 0 || w.Count("ip", time.Hour) != 0 {
+		t.Fatalf("%d keys left after the span", w.Map().Size())
+	}
+}
+
+func TestTimedMap_MissFilterEqualKeys(t *testing.T) {
+	m := New(nil, WithMissFilter(1000, 0.01))
+	defer m.Close()
+
+	type point struct{ x, y float64 }
+	negZero := math.Copysign(0, -1)
+	m.SetPermanent(negZero, 1)
+	m.SetPermanent(point{negZero, 1}, 2)
+
+	if v, _, ok := m.Get(0.0); !ok || v != 1 {
+		t.Fatalf("Get(+0.0) = %v, %v after setting -0.0", v, ok)
+	}
+	if v, _, ok := m.Get(point{0, 1}); !ok || v != 2 {
+		t.Fatalf("Get(point{+0.0, 1}) = %v, %v after setting point{-0.0, 1}", v, ok)
+	}
+}
+
+func TestWindow_FrozenAndClosed(t *testing.T) {
+	w := NewWindow(time.Hour, time.Hour)
+	defer w.Close()
+
+	w.Incr("ip")
+	w.Map().Freeze()
+	if n := w.IncrBy("ip", 5); n != 0 || w.Count("ip", time.Hour) != 1 {
+		t.Fatalf("IncrBy on a frozen window returned %d, count %d", n, w.Count("ip", time.Hour))
+	}
+	w.Map().Unfreeze()
+
+	w.Close()
+	if n := w.Incr("ip"); n != 0 || w.Count("ip", time.Hour) != 1 {
+		t.Fatalf("Incr on a closed window returned %d, count %d", n, w.Count("ip", time.Hour))
+	}
+}
+
+func TestTimedMap_MissFilter(t *testing.T) {
+	m := New(nil, WithMissFilter(1000, 0.01))
+	defer m.Close()
+
+	for i := 0; i < 1000; i++ {
+		m.SetPermanent(i, i)
+	}
+	for i := 0; i < 1000; i++ {
+		if v, _, ok := m.Get(i); !ok || v != i {
+			t.Fatalf("Get(%d) = %v, %v", i, v, ok)
+		}
+	}
+	if n := m.Stats()["filter_rejects"]; n != 0 {
+		t.Fatalf("%d present keys rejected", n)
+	}
+
+	for i := 1000; i < 2000; i++ {
+		m.Get(i)
+	}
+	if n := m.Stats()["filter_rejects"]; n < 900 {
+		t.Fatalf("only %d of 1000 misses rejected", n)
+	}
+
+	for i := 0; i < 1000; i++ {
+		m.Remove(i)
+	}
+	m.SetPermanent("x", 1)
+	if _, _, ok := m.Get("x"); !ok {
+		t.Fatal("key re-added after removals is missing")
+	}
+	m.RemoveAll()
+	before := m.Stats()["filter_rejects"]
+	m.Get("x")
+	if m.Stats()["filter_rejects"] != before+1 {
+		t.Fatal("RemoveAll did not reset the filter")
+	}
+}
+
+func TestTimedMap_SizeWithoutLock(t *testing.T) {
+	m := New(nil)
+	defer m.Close()
+
+	m.SetPermanent("a", 1)
+	m.SetWithTTL("b", 2, 5*time.Millisecond)
+	m.SetPermanent("a", 3)
+	if m.Size() != 2 || m.SizeApprox() != 2 {
+		t.Fatalf("size %d, approx %d", m.Size(), m.SizeApprox())
+	}
+
+	m.mu.Lock() // Size must not wait for the lock
+	n := m.Size()
+	m.mu.Unlock()
+	if n != 2 {
+		t.Fatalf("size %d under lock", n)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for m.Size() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	m.Remove("a")
+	m.SetPermanent("c", 1)
+	m.RemoveAll()
+	if m.Size() != 0 {
+		t.Fatalf("size %d after RemoveAll", m.Size())
+	}
+
+	s := NewSharded(4, nil)
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		s.SetPermanent(i, i)
+	}
+	if s.Size() != 100 || s.SizeApprox() != 100 {
+		t.Fatalf("sharded size %d, approx %d", s.Size(), s.SizeApprox())
+	}
+}
+
+func TestTimedMap_LockWaitStats(t *testing.T) {
+	m := NewSharded(1, nil)
+	defer m.Close()
+	s := m.Shard("k")
+	s.StopCleaner() // only the writers below may wait
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4*lockWaitSampleEvery; i++ {
+		s.mu.Lock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.SetPermanent("k", 1)
+		}()
+		for s.lockWaits.Load() <= uint64(i) {
+			runtime.Gosched()
+		}
+		time.Sleep(100 * time.Microsecond)
+		s.mu.Unlock()
+		wg.Wait()
+	}
+
+	stats := m.Stats()
+	if stats["lock_wait_write_samples"] != 4 || stats["lock_wait_write_ns_max"] < uint64(100*time.Microsecond) {
+		t.Fatalf("samples %d, max %dns", stats["lock_wait_write_samples"], stats["lock_wait_write_ns_max"])
+	}
+	d := m.StatsDetailed()[0]
+	if d.WriteWaitAvg < 100*time.Microsecond || d.WriteWaitMax < d.WriteWaitAvg || d.ReadWaitMax != 0 {
+		t.Fatalf("detailed %+v", d)
+	}
+}
+
+func TestTimedMap_CheckIntegrity(t *testing.T) {
+	for _, b := range []Backend{BackendHeap, BackendTimers, BackendWheel, BackendBucket} {
+		m := New(nil, WithBackend(b), WithPrefixIndex(), WithLogger(nil),
+			WithValueIndex(func(v any) any { return v }), WithConsistencyChecks())
+		for i := 0; i < 100; i++ {
+			m.SetWithTTL(fmt.Sprint(i), i%7, time.Hour)
+		}
+		m.SetPermanent(1, "one")
+		m.SetPermanent("5", 5) // temporary to permanent
+		m.SetWithTTL(1, "one", time.Hour)
+		m.Remove("6")
+		if err := m.CheckIntegrity(); err != nil {
+			t.Fatalf("%v: %v", b, err)
+		}
+
+		// Unschedule an entry behind the map's back.
+		m.mu.Lock()
+		m.sched.cancel(m.items["7"])
+		m.mu.Unlock()
+		err := m.CheckIntegrity()
+		if !errors.Is(err, ErrInconsistent) || !strings.Contains(err.Error(), "key 7") {
+			t.Fatalf("%v: got %v for an unscheduled entry", b, err)
+		}
+		if err := m.Repair(); !errors.Is(err, ErrInconsistent) {
+			t.Fatalf("%v: Repair returned %v", b, err)
+		}
+		if err := m.CheckIntegrity(); err != nil {
+			t.Fatalf("%v: %v after Repair", b, err)
+		}
+		m.Close()
+	}
+}
+
+func TestTimedMap_SelfHealing(t *testing.T) {
+	expired := make(chan any, 2)
+	m := New(func(key, val any) { expired <- key }, WithLogger(nil), WithConsistencyChecks())
+	defer m.Close()
+
+	// An entry the scheduler lost and a deadline the map lost.
+	m.SetWithTTL("lost", 1, 50*time.Millisecond)
+	m.SetWithTTL("orphan", 2, time.Hour)
+	m.mu.Lock()
+	m.sched.cancel(m.items["lost"])
+	delete(m.items, "orphan")
+	m.size.Add(-1)
+	m.lastCheck = time.Time{} // check on the next sweep
+	m.mu.Unlock()
+
+	select {
+	case k := <-expired:
+		if k != "lost" {
+			t.Fatalf("got expiry of %v, want lost", k)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the lost entry never expired")
+	}
+	stats := m.Stats()
+	if stats["integrity_errors"] == 0 || stats["integrity_repairs"] == 0 {
+		t.Fatalf("got %d errors and %d repairs", stats["integrity_errors"], stats["integrity_repairs"])
+	}
+	if n := m.HeapLen(); n != 0 {
+		t.Fatalf("got %d scheduled entries after the repair, want 0", n)
+	}
+}
+
+func TestTimedMap_Closed(t *testing.T) {
+	var expired atomic.Int32
+	m := New(func(key, val any) { expired.Add(1) })
+	m.SetPermanent("kept", 1)
+	m.SetWithTTL("due", 2, 20*time.Millisecond)
+
+	// Cleaner controls in any order never panic or hang.
+	m.StopCleaner()
+	m.StartCleaner()
+	m.StopCleaner()
+	m.SetWithTTL("x", 3, time.Hour)
+	m.StopCleaner()
+	m.RestartCleaner()
+	m.Close()
+	m.Close()
+	m.StartCleaner()
+	m.StopCleaner()
+	m.RestartCleaner()
+	if m.CleanerRunning() {
+		t.Fatal("cleaner restarted after Close")
+	}
+
+	m.SetWithTTL("new", 4, time.Hour)
+	m.SetPermanent("kept", 5)
+	m.Remove("x")
+	if m.MakePermanent("due") || m.SetExpiry("kept", time.Now().Add(time.Hour)) {
+		t.Fatal("a closed map accepted a change")
+	}
+	if _, err := m.RemoveMatchingCtx(context.Background(), func(any, any) bool { return true }); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v from RemoveMatchingCtx, want ErrClosed", err)
+	}
+	m.RemoveAll()
+
+	if v, _, ok := m.Get("kept"); !ok || v != 1 {
+		t.Fatalf("got %v %v for kept, want 1", v, ok)
+	}
+	if _, _, ok := m.Get("new"); ok || m.Size() != 3 {
+		t.Fatalf("closed map stored a new key, size %d", m.Size())
+	}
+	time.Sleep(40 * time.Millisecond)
+	if expired.Load() != 0 || m.Size() != 3 {
+		t.Fatal("an entry expired after Close")
+	}
+}
+
+func TestTimedMap_RemoveAllGeneration(t *testing.T) {
+	var expired atomic.Int32
+	asked, answer := make(chan struct{}), make(chan Verdict)
+	m := New(func(key, val any) { expired.Add(1) }, WithExpiryDecider(func(key, value any) Verdict {
+		asked <- struct{}{}
+		return <-answer
+	}))
+	defer m.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.SetUntilDone(ctx, "ctx", 0)
+	for i := 0; i < 8; i++ {
+		m.SetPermanent(i, i)
+	}
+	m.SetWithTTL("a", "old", time.Millisecond)
+	<-asked // the cleaner now waits for a verdict on the old "a"
+
+	m.RemoveAll()
+	m.SetPermanent("a", "new")
+	answer <- Renew(time.Hour)
+	cancel()
+
+	if got := m.Stats()["removed"]; got != 10 {
+		t.Fatalf("got %d removed, want 10", got)
+	}
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if v, exp, ok := m.Get("a"); !ok || v != "new" || exp != ElementPermanent {
+			t.Fatalf("got %v %d %v, want the new permanent a", v, exp, ok)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if m.Size() != 1 || expired.Load() != 0 {
+		t.Fatalf("got size %d and %d expiries, want 1 and none", m.Size(), expired.Load())
+	}
+	if err := m.CheckIntegrity(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimedMap_LazyCleaner(t *testing.T) {
+	expired := make(chan any, 2)
+	m := New(func(key, val any) { expired <- key }, WithLazyCleaner(20*time.Millisecond), WithCallbackWorkers(2, 8))
+	defer m.Close()
+
+	m.SetPermanent("p", 1)
+	if m.CleanerRunning() || m.Stats()["callback_workers"] != 0 {
+		t.Fatal("goroutines started without temporary entries")
+	}
+
+	for _, key := range []string{"a", "b"} {
+		m.SetWithTTL(key, 1, 5*time.Millisecond)
+		if !m.CleanerRunning() {
+			t.Fatalf("cleaner not started for %s", key)
+		}
+		select {
+		case k := <-expired:
+			if k != key {
+				t.Fatalf("got expiry of %v, want %s", k, key)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%s never expired", key)
+		}
+
+		deadline := time.Now().Add(3 * time.Second)
+		for m.CleanerRunning() && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if m.CleanerRunning() {
+			t.Fatal("idle cleaner did not stop")
+		}
+	}
+	if m.Stats()["callback_workers"] != 2 {
+		t.Fatalf("got %d callback workers, want 2", m.Stats()["callback_workers"])
+	}
+
+	m.StopCleaner()
+	m.SetWithTTL("c", 1, time.Millisecond)
+	if m.CleanerRunning() {
+		t.Fatal("stopped cleaner started by a write")
+	}
+	m.StartCleaner()
+	if !m.CleanerRunning() {
+		t.Fatal("cleaner with a scheduled entry not started")
+	}
+}
+
+func TestTimedMap_SetRefreshing(t *testing.T) {
+	m := New(nil, WithLogger(nil))
+	defer m.Close()
+
+	var calls atomic.Int32
+	m.SetRefreshing("cfg", 1, 5*time.Millisecond, func(ctx context.Context, key, current any) (any, error) {
+		if calls.Add(1) == 2 {
+			return nil, errors.New("unavailable")
+		}
+		return current.(int) + 1, nil
+	})
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if v, _, _ := m.Get("cfg"); v.(int) >= 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	v, exp, ok := m.Get("cfg")
+	if !ok || v.(int) < 3 || exp != ElementPermanent {
+		t.Fatalf("got %v %d %v, want a permanent value of at least 3", v, exp, ok)
+	}
+	if calls.Load() < 3 {
+		t.Fatalf("got %d refreshes for %v, one of them failed", calls.Load(), v)
+	}
+
+	m.SetPermanent("cfg", 100) // stops refreshing
+	n := calls.Load()
+	time.Sleep(30 * time.Millisecond)
+	if v, _, _ := m.Get("cfg"); v != 100 || calls.Load() > n+1 {
+		t.Fatalf("got %v after %d more refreshes, want 100 and none", v, calls.Load()-n)
+	}
+}
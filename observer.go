@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+// --------------------------------------------------------------------
+// Observers
+// --------------------------------------------------------------------
+
+// Observer receives every lifecycle event of a map, for instrumentation
+// packages (metrics, tracing, audit) that would otherwise need a hook per
+// event. Embed NopObserver to implement only some of the methods.
+//
+// OnHit and OnMiss run on the reading goroutine after the lookup; the
+// other methods run like Subscribe callbacks, once the map lock has been
+// released. None of them should block.
+type Observer interface {
+	OnSet(key, value any)    // key written
+	OnHit(key any)           // Get, GetWithVersion or GetEntry found key
+	OnMiss(key any)          // ... and did not
+	OnExpire(key, value any) // key removed after its deadline
+	OnEvict(key, value any)  // key dropped by RemoveOlderThan
+	OnRemove(key, value any) // key removed by the caller
+}
+
+// NopObserver implements Observer with methods that do nothing.
+type NopObserver struct{}
+
+func (NopObserver) OnSet(key, value any)    {}
+func (NopObserver) OnHit(key any)           {}
+func (NopObserver) OnMiss(key any)          {}
+func (NopObserver) OnExpire(key, value any) {}
+func (NopObserver) OnEvict(key, value any)  {}
+func (NopObserver) OnRemove(key, value any) {}
+
+// WithObserver registers o for the lifetime of the map. It may be given
+// more than once.
+func WithObserver(o Observer) Option {
+	return func(t *TimedMap) {
+		t.observers = append(t.observers, o)
+		t.subs = append(t.subs, subscriber{
+			mask: 1<<EventSet | 1<<EventDel | 1<<EventExpired | 1<<EventEvicted,
+			fn: func(ev Event) {
+				switch ev.Type {
+				case EventSet:
+					o.OnSet(ev.Key, ev.Value)
+				case EventDel:
+					o.OnRemove(ev.Key, ev.Value)
+				case EventExpired:
+					o.OnExpire(ev.Key, ev.Value)
+				case EventEvicted:
+					o.OnEvict(ev.Key, ev.Value)
+				}
+			},
+		})
+	}
+}
+
+// looked counts the outcome of a lookup and reports it to the observers.
+func (t *timedMap) looked(key any, hit bool) {
+	if hit {
+		t.hits.Add(1)
+	} else {
+		t.misses.Add(1)
+	}
+	for _, o := range t.observers {
+		if hit {
+			o.OnHit(key)
+		} else {
+			o.OnMiss(key)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Insertion order
+// --------------------------------------------------------------------
+
+// orderList is an intrusive doubly-linked list of elements, oldest first.
+type orderList struct {
+	head, tail *element
+}
+
+func (l *orderList) pushBack(el *element) {
+	el.prev, el.next = l.tail, nil
+	if l.tail != nil {
+		l.tail.next = el
+	} else {
+		l.head = el
+	}
+	l.tail = el
+}
+
+func (l *orderList) unlink(el *element) {
+	if el.prev != nil {
+		el.prev.next = el.next
+	} else if l.head == el {
+		l.head = el.next
+	}
+	if el.next != nil {
+		el.next.prev = el.prev
+	} else if l.tail == el {
+		l.tail = el.prev
+	}
+	el.prev, el.next = nil, nil
+}
+
+// WithInsertionOrder keeps entries in a linked list in the order they
+// were first inserted, making ForEachOrdered O(n) without sorting.
+// Overwriting a key keeps its position.
+func WithInsertionOrder() Option {
+	return func(t *TimedMap) {
+		t.ordered = true
+	}
+}
+
+// ForEachOrdered calls fn for every entry, oldest insert first, until fn
+// returns false. Without WithInsertionOrder the order is reconstructed by
+// sorting on creation time.
+//
+// The map is read-locked while fn runs; fn must not modify the map.
+func (t *timedMap) ForEachOrdered(fn func(key, value any) bool) {
+	_ = t.ForEachOrderedCtx(context.Background(), fn)
+}
+
+// ForEachOrderedCtx is ForEachOrdered, except that it stops and returns
+// ctx.Err() once ctx is done.
+func (t *timedMap) ForEachOrderedCtx(ctx context.Context, fn func(key, value any) bool) error {
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	check := ctxChecker(ctx)
+	if t.ordered {
+		for el := t.order.head; el != nil; el = el.next {
+			if err := check(); err != nil {
+				return err
+			}
+			if !fn(el.Key, t.decode(el.Value)) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	els := make([]*element, 0, len(t.items))
+	for _, el := range t.items {
+		els = append(els, el)
+	}
+	sort.Slice(els, func(i, j int) bool { return els[i].createdAt < els[j].createdAt })
+	for _, el := range els {
+		if err := check(); err != nil {
+			return err
+		}
+		if !fn(el.Key, t.decode(el.Value)) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Age returns how long ago key was first inserted; overwriting a key does
+// not reset its age. It reports false if key is not present.
+func (t *timedMap) Age(key any) (time.Duration, bool) {
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	el, ok := t.items[key]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(time.Now().UnixNano() - el.createdAt), true
+}
+
+// RemoveOlderThan removes every entry first inserted more than age ago,
+// permanent ones included, and returns the number removed. Removals emit
+// EventEvicted; no expiry callbacks run. Meant for
+// maintenance windows, as it walks the whole map under the lock.
+func (t *timedMap) RemoveOlderThan(age time.Duration) int {
+	n, _ := t.RemoveOlderThanCtx(context.Background(), age)
+	return n
+}
+
+// RemoveOlderThanCtx is RemoveOlderThan, except that it stops once ctx is
+// done and returns the number removed so far along with ctx.Err().
+func (t *timedMap) RemoveOlderThanCtx(ctx context.Context, age time.Duration) (int, error) {
+	cutoff := time.Now().Add(-age).UnixNano()
+
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		return 0, t.writeErr()
+	}
+
+	defer t.batch()()
+
+	n, check := 0, ctxChecker(ctx)
+	for _, el := range t.items {
+		if err := check(); err != nil {
+			return n, err
+		}
+		if el.createdAt >= cutoff {
+			continue
+		}
+		t.delete(el)
+		t.countRemoved(el)
+		t.notify(EventEvicted, el)
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Load inserts entries in bulk, keeping their absolute deadlines and
+// overwriting existing keys. Entries whose deadline has passed are
+// skipped; if fireExpired is set the expiry callback still runs for
+// them. Entry.CreatedAt is kept when set, Entry.Version is ignored.
+//
+// With the heap backend the heap is built once in O(n) rather than with
+// a push per entry. Returns the number of entries inserted.
+func (t *timedMap) Load(entries []Entry, fireExpired bool) int {
+	values := make([]any, len(entries))
+	for i, e := range entries {
+		values[i] = t.encode(e.Value)
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		for _, v := range values {
+			t.free(v)
+		}
+		return 0
+	}
+
+	defer t.batch()()
+
+	now := t.nowTicks()
+	var expired []Entry
+	loaded := 0
+	for i, e := range entries {
+		exp := int64(ElementPermanent)
+		if !e.Permanent && !e.ExpiresAt.IsZero() {
+			exp = t.ticks(e.ExpiresAt)
+			if exp <= now {
+				t.free(values[i])
+				expired = append(expired, e)
+				continue
+			}
+		}
+
+		t.set(e.Key, values[i], exp)
+		if !e.CreatedAt.IsZero() {
+			t.items[e.Key].createdAt = e.CreatedAt.UnixNano()
+		}
+		loaded++
+	}
+
+	if fireExpired && len(expired) > 0 && t.onExpire != nil {
+		t.after(func() {
+			for _, e := range expired {
+				t.dispatch(e.Key, e.Value, PriorityNormal)
+			}
+		})
+	}
+	return loaded
+}
+
+// --------------------------------------------------------------------
+// Streaming export / import
+// --------------------------------------------------------------------
+
+// exportFormat is bumped whenever exportRecord changes incompatibly.
+const exportFormat = 1
+
+// exportChunk is how many entries Export and Import handle per lock
+// acquisition.
+const exportChunk = 1024
+
+// exportHeader starts every export stream.
+type exportHeader struct {
+	Format int
+}
+
+// exportRecord is one entry of an export stream. Compressed or encrypted
+// values are written in their stored form, so secrets never leave the
+// map in plaintext.
+type exportRecord struct {
+	Key       any
+	Value     any    // set unless Stored
+	Data      []byte // stored form, see storedValue
+	Stored    bool
+	Str       bool
+	Packed    bool // compressed
+	Encrypted bool
+	ExpiresAt int64 // UnixNano, 0 for permanent
+	CreatedAt int64 // UnixNano
+}
+
+// Export streams all entries to w with encoding/gob. Entries are read in
+// chunks, so writers are only blocked briefly and the map is never
+// copied in full; entries changed while Export runs may or may not be
+// included. Key and value types other than Go's basic types must be
+// registered with gob.Register.
+func (t *timedMap) Export(w io.Writer) error {
+	return t.ExportCtx(context.Background(), w)
+}
+
+// ExportCtx is Export, except that it stops between chunks once ctx is
+// done and returns ctx.Err(), leaving a truncated stream in w.
+func (t *timedMap) ExportCtx(ctx context.Context, w io.Writer) error {
+	t.rlock()
+	keys := make([]any, 0, len(t.items))
+	for k := range t.items {
+		keys = append(keys, k)
+	}
+	t.mu.RUnlock()
+
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(exportHeader{Format: exportFormat}); err != nil {
+		return err
+	}
+
+	recs := make([]exportRecord, 0, exportChunk)
+	for len(keys) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk := keys[:min(exportChunk, len(keys))]
+		keys = keys[len(chunk):]
+
+		recs = recs[:0]
+		t.rlock()
+		for _, k := range chunk {
+			if el, ok := t.items[k]; ok {
+				recs = append(recs, t.exportRecord(el))
+			}
+		}
+		t.mu.RUnlock()
+
+		for i := range recs {
+			if err := enc.Encode(&recs[i]); err != nil {
+				return fmt.Errorf("temap: exporting key %v: %w", recs[i].Key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Import reads a stream written by Export and inserts its entries,
+// overwriting existing keys and skipping entries that expired in the
+// meantime. Entries are applied in chunks as they are read, so on error
+// the chunks before the failure stay imported. A map
+// importing compressed or encrypted values must be configured with the
+// same codec and key as the exporting map.
+func (t *timedMap) Import(r io.Reader) error {
+	return t.importStream(r, true)
+}
+
+// importStream is Import; without overwrite, keys that exist are kept.
+func (t *timedMap) importStream(r io.Reader, overwrite bool) error {
+	dec := gob.NewDecoder(r)
+	var hdr exportHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return fmt.Errorf("temap: reading export header: %w", err)
+	}
+	if hdr.Format != exportFormat {
+		return fmt.Errorf("temap: unsupported export format %d", hdr.Format)
+	}
+
+	recs := make([]exportRecord, 0, exportChunk)
+	for {
+		recs = recs[:0]
+		var err error
+		for len(recs) < exportChunk {
+			var rec exportRecord
+			if err = dec.Decode(&rec); err != nil {
+				break
+			}
+			if rec.Packed && t.codec == nil || rec.Encrypted && t.aead == nil {
+				return fmt.Errorf("temap: key %v needs a codec or key this map lacks", rec.Key)
+			}
+			recs = append(recs, rec)
+		}
+		if err := t.importRecords(recs, overwrite); err != nil {
+			return err
+		}
+
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return fmt.Errorf("temap: reading export: %w", err)
+		}
+	}
+}
+
+// exportRecord converts el. Callers must hold mu.
+func (t *timedMap) exportRecord(el *element) exportRecord {
+	rec := exportRecord{
+		Key:       el.Key,
+		ExpiresAt: t.unixNano(el.ExpiresAt),
+		CreatedAt: el.createdAt,
+	}
+	if ref, ok := el.Value.(*arenaRef); ok {
+		rec.Value = ref.bytes()
+	} else if sv, ok := el.Value.(*storedValue); ok {
+		rec.Data, rec.Stored = sv.data, true
+		rec.Str, rec.Packed, rec.Encrypted = sv.str, sv.compressed, sv.encrypted
+	} else {
+		rec.Value = el.Value
+	}
+	return rec
+}
+
+// importRecords inserts one chunk of records under a single lock.
+func (t *timedMap) importRecords(recs []exportRecord, overwrite bool) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	for i := range recs {
+		if !recs[i].Stored {
+			recs[i].Value = t.encode(recs[i].Value)
+		}
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		for _, rec := range recs {
+			t.free(rec.Value)
+		}
+		return t.writeErr()
+	}
+
+	defer t.batch()()
+
+	now := t.nowTicks()
+	for _, rec := range recs {
+		exp := int64(ElementPermanent)
+		if rec.ExpiresAt != 0 {
+			if exp = t.ticks(time.Unix(0, rec.ExpiresAt)); exp <= now {
+				t.free(rec.Value)
+				continue
+			}
+		}
+		if _, ok := t.items[rec.Key]; ok && !overwrite {
+			t.free(rec.Value)
+			continue
+		}
+
+		value := rec.Value
+		if rec.Stored {
+			value = &storedValue{data: rec.Data, str: rec.Str, compressed: rec.Packed, encrypted: rec.Encrypted}
+		}
+		t.set(rec.Key, value, exp)
+		if rec.CreatedAt != 0 {
+			t.items[rec.Key].createdAt = rec.CreatedAt
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "time"
+
+// --------------------------------------------------------------------
+// Expiry precision
+// --------------------------------------------------------------------
+
+// WithPrecision stores deadlines as multiples of unit (typically
+// time.Nanosecond, time.Microsecond, time.Millisecond or time.Second)
+// instead of nanoseconds. Deadlines are rounded up, so entries never
+// expire early but may expire up to two units late. The default is
+// nanosecond precision.
+func WithPrecision(unit time.Duration) Option {
+	return func(t *TimedMap) {
+		if unit > 0 {
+			t.unit = int64(unit)
+		}
+	}
+}
+
+// ticks converts tm into a deadline in precision units, rounding up. It
+// never returns ElementPermanent: a deadline that lands on the Unix epoch
+// is moved one tick later, which is just as far in the past, instead of
+// making the entry permanent.
+func (t *timedMap) ticks(tm time.Time) int64 {
+	ns := tm.UnixNano()
+	d := ns / t.unit
+	if ns%t.unit > 0 {
+		d++
+	}
+	if d == ElementPermanent {
+		d++
+	}
+	return d
+}
+
+// deadlineNano converts expiresAt into a deadline in nanoseconds for the
+// maps without a precision setting, with the same rules as ticks: the
+// zero time means permanent and the epoch is moved off ElementPermanent.
+func deadlineNano(expiresAt time.Time) int64 {
+	if expiresAt.IsZero() {
+		return ElementPermanent
+	}
+	ns := expiresAt.UnixNano()
+	if ns == ElementPermanent {
+		ns++
+	}
+	return ns
+}
+
+// nowTicks returns the current time in precision units, rounding down.
+func (t *timedMap) nowTicks() int64 {
+	return t.floorTicks(t.nowNano())
+}
+
+// floorTicks converts ns into precision units, rounding down.
+func (t *timedMap) floorTicks(ns int64) int64 {
+	d := ns / t.unit
+	if ns%t.unit < 0 {
+		d--
+	}
+	return d
+}
+
+// unixNano converts a deadline in precision units back to nanoseconds.
+func (t *timedMap) unixNano(ticks int64) int64 {
+	if ticks == ElementPermanent {
+		return ElementPermanent
+	}
+	return ticks * t.unit
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"sort"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Expiry priorities
+// --------------------------------------------------------------------
+
+// Priority orders expiry callbacks when many entries expire at once.
+type Priority int8
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// SetWithPriority is SetWithTTL for an entry whose expiry callback has
+// priority p.
+func (t *timedMap) SetWithPriority(key, value any, ttl time.Duration, p Priority) {
+	t.throttle()
+	value = t.encode(value)
+
+	exp := int64(ElementPermanent)
+	if ttl > 0 {
+		exp = t.ticks(t.now().Add(ttl))
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		t.free(value)
+		return
+	}
+
+	t.set(key, value, exp)
+	t.items[key].priority = p
+}
+
+// SetPriority changes the expiry priority of an existing key. Returns
+// false if the key does not exist.
+func (t *timedMap) SetPriority(key any, p Priority) bool {
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		return false
+	}
+
+	el, ok := t.items[key]
+	if ok {
+		el.priority = p
+	}
+	return ok
+}
+
+// dispatchOrder sorts elements that expired together into the order
+// their callbacks are dispatched in.
+func (t *timedMap) dispatchOrder(els []*element) {
+	if t.inline {
+		byDeadline(els)
+		return
+	}
+	byPriority(els)
+}
+
+// byPriority sorts elements that expired together so that callbacks of
+// higher priority are dispatched first, keeping deadline order within a
+// priority.
+func byPriority(els []*element) {
+	sort.SliceStable(els, func(i, j int) bool {
+		return els[i].priority > els[j].priority
+	})
+}
+
+// byDeadline sorts elements that expired together by deadline, see
+// WithSyncCallbacks. Backends other than the heap hand them over only
+// roughly in order.
+func byDeadline(els []*element) {
+	sort.SliceStable(els, func(i, j int) bool {
+		return els[i].ExpiresAt < els[j].ExpiresAt
+	})
+}
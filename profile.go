@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "time"
+
+// --------------------------------------------------------------------
+// Sampling profiler hook
+// --------------------------------------------------------------------
+
+// ProfileOp is an internal operation timed by the hook of WithProfiler.
+type ProfileOp uint8
+
+const (
+	ProfileSet      ProfileOp = iota // SetTemporary, SetWithTTL, SetPermanent
+	ProfileGet                       // Get
+	ProfileRemove                    // Remove
+	ProfileSchedule                  // adding or moving a deadline in the scheduler
+	ProfileSweep                     // one cleaner pass, callbacks excluded
+)
+
+func (op ProfileOp) String() string {
+	switch op {
+	case ProfileSet:
+		return "set"
+	case ProfileGet:
+		return "get"
+	case ProfileRemove:
+		return "remove"
+	case ProfileSchedule:
+		return "schedule"
+	case ProfileSweep:
+		return "sweep"
+	default:
+		return "unknown"
+	}
+}
+
+// WithProfiler calls hook with the duration of one in every rate
+// operations (every operation if rate <= 1). Set, Get and Remove are
+// timed including lock waits. ProfileSchedule samples are reported while
+// the map is locked, so hook must be fast and must not call into the map.
+func WithProfiler(rate int, hook func(op ProfileOp, d time.Duration)) Option {
+	return func(t *TimedMap) {
+		t.profHook = hook
+		t.profRate = uint64(max(rate, 1))
+	}
+}
+
+// profStart returns the start time of an operation to sample, or 0 if it
+// is not sampled.
+func (t *timedMap) profStart() int64 {
+	if t.profHook == nil || t.profSeq.Add(1)%t.profRate != 0 {
+		return 0
+	}
+	return time.Now().UnixNano()
+}
+
+// profile reports op to the hook if start came from a sampling
+// profStart.
+func (t *timedMap) profile(op ProfileOp, start int64) {
+	if start != 0 {
+		t.profHook(op, time.Duration(time.Now().UnixNano()-start))
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Read-optimized variant
+// --------------------------------------------------------------------
+
+// ReadMap is a timed map for read-dominated workloads with a mostly
+// stable key set. Entries live in a sync.Map, so Get never takes a lock;
+// writes are serialized and only temporary entries are kept in the
+// expiry heap.
+//
+// Entries are immutable once stored: every write replaces the entry, so
+// readers never observe a value paired with another write's deadline.
+// An entry past its deadline is reported missing even before the cleaner
+// removes it.
+type ReadMap struct {
+	items sync.Map // key -> *element
+
+	mu       sync.Mutex // serializes writes and guards expHeap
+	expHeap  expiryHeap
+	size     atomic.Int64
+	onExpire func(key, val any)
+
+	wake      chan struct{}
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewReadMap creates a ReadMap with a background cleaner.
+func NewReadMap(onExpire func(key, val any)) *ReadMap {
+	m := &ReadMap{
+		onExpire: onExpire,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	m.wg.Add(1)
+	go m.runCleaner()
+	return m
+}
+
+// SetTemporary sets a key with explicit expiration time. The zero time
+// makes the key permanent.
+func (m *ReadMap) SetTemporary(key, value any, expiresAt time.Time) {
+	m.set(key, value, deadlineNano(expiresAt))
+}
+
+// SetWithTTL sets a key that expires after the given TTL duration.
+func (m *ReadMap) SetWithTTL(key, value any, ttl time.Duration) {
+	if ttl <= 0 {
+		m.SetPermanent(key, value)
+		return
+	}
+	m.SetTemporary(key, value, time.Now().Add(ttl))
+}
+
+// SetPermanent sets a key that never expires.
+func (m *ReadMap) SetPermanent(key, value any) {
+	m.set(key, value, ElementPermanent)
+}
+
+// Get retrieves a value and its expiration without locking.
+func (m *ReadMap) Get(key any) (any, int64, bool) {
+	v, ok := m.items.Load(key)
+	if !ok {
+		return nil, ElementDoesntExist, false
+	}
+	el := v.(*element)
+	if el.ExpiresAt != ElementPermanent && el.ExpiresAt <= time.Now().UnixNano() {
+		return nil, ElementDoesntExist, false
+	}
+	return el.Value, el.ExpiresAt, true
+}
+
+// Remove deletes a key.
+func (m *ReadMap) Remove(key any) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v, ok := m.items.LoadAndDelete(key); ok {
+		m.unschedule(v.(*element))
+		m.size.Add(-1)
+	}
+}
+
+// Size returns the current number of items, including expired entries
+// the cleaner has not removed yet.
+func (m *ReadMap) Size() int {
+	return int(m.size.Load())
+}
+
+// Range calls fn for every live entry until fn returns false. Like
+// sync.Map.Range, it does not see a consistent snapshot.
+func (m *ReadMap) Range(fn func(key, value any) bool) {
+	now := time.Now().UnixNano()
+	m.items.Range(func(k, v any) bool {
+		el := v.(*element)
+		if el.ExpiresAt != ElementPermanent && el.ExpiresAt <= now {
+			return true
+		}
+		return fn(k, el.Value)
+	})
+}
+
+// Close stops the cleaner and waits for it to exit. Entries stay
+// readable, but nothing expires afterwards.
+func (m *ReadMap) Close() {
+	m.closeOnce.Do(func() { close(m.stop) })
+	m.wg.Wait()
+}
+
+// set stores a fresh element for key and schedules it if temporary.
+func (m *ReadMap) set(key, value any, exp int64) {
+	el := &element{Key: key, Value: value, ExpiresAt: exp, index: -1}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if old, loaded := m.items.Swap(key, el); loaded {
+		m.unschedule(old.(*element))
+	} else {
+		m.size.Add(1)
+	}
+	if exp == ElementPermanent {
+		return
+	}
+	heap.Push(&m.expHeap, el)
+	if el.index == 0 {
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// unschedule drops el from the heap. Callers must hold mu.
+func (m *ReadMap) unschedule(el *element) {
+	if el.index >= 0 {
+		heap.Remove(&m.expHeap, el.index)
+	}
+}
+
+// runCleaner expires entries until Close is called. Writers wake it when
+// they schedule a new earliest deadline.
+func (m *ReadMap) runCleaner() {
+	defer m.wg.Done()
+
+	timer := time.NewTimer(cleanerIdleWait)
+	defer timer.Stop()
+
+	for {
+		wait := m.sweep()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-m.wake:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// sweep removes due entries, starts their callbacks and returns the time
+// until the next deadline.
+func (m *ReadMap) sweep() time.Duration {
+	m.mu.Lock()
+	now := time.Now().UnixNano()
+	var expired []*element
+	for len(m.expHeap) > 0 && m.expHeap[0].ExpiresAt <= now {
+		el := heap.Pop(&m.expHeap).(*element)
+		m.items.CompareAndDelete(el.Key, el)
+		m.size.Add(-1)
+		expired = append(expired, el)
+	}
+	wait := cleanerIdleWait
+	if len(m.expHeap) > 0 {
+		wait = time.Duration(m.expHeap[0].ExpiresAt - now)
+	}
+	m.mu.Unlock()
+
+	if m.onExpire != nil {
+		for _, el := range expired {
+			go m.onExpire(el.Key, el.Value)
+		}
+	}
+	return wait
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Background refresh
+// --------------------------------------------------------------------
+
+// RefreshFunc fetches a new value for key, given its current value.
+type RefreshFunc func(ctx context.Context, key, current any) (any, error)
+
+// refreshJob re-fetches one entry every interval, see SetRefreshing.
+type refreshJob struct {
+	fn    RefreshFunc
+	every time.Duration
+	timer *time.Timer
+}
+
+// SetRefreshing stores key permanently and calls refresh for it every
+// interval, on the callback workers if configured, replacing the value
+// with the result as an ordinary write would. A refresh that fails is
+// logged and the current value kept until the next one. Refreshing
+// stops when the key is removed or written by any other setter.
+func (t *timedMap) SetRefreshing(key, value any, every time.Duration, refresh RefreshFunc) {
+	t.throttle()
+	value = t.encode(value)
+
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		t.free(value)
+		return
+	}
+
+	t.set(key, value, ElementPermanent)
+	t.startRefresh(t.items[key], refresh, max(every, time.Millisecond))
+}
+
+// startRefresh arms the refresh of el. Callers must hold mu.
+func (t *timedMap) startRefresh(el *element, fn RefreshFunc, every time.Duration) {
+	job := &refreshJob{fn: fn, every: every}
+	job.timer = time.AfterFunc(every, func() { t.refreshDue(el, job) })
+	el.refresh = job
+}
+
+// refreshDue hands the refresh of el over to a callback goroutine.
+func (t *timedMap) refreshDue(el *element, job *refreshJob) {
+	t.rlock()
+	current := t.live(el) && el.refresh == job && !t.closed
+	value := el.Value
+	t.mu.RUnlock()
+
+	if current {
+		t.dispatchTo(func(key, value any) { t.refresh(el, job, value) }, el.Key, value, PriorityNormal)
+	}
+}
+
+// refresh runs job for el, stores the new value and rearms job, unless
+// el was removed or rewritten meanwhile.
+func (t *timedMap) refresh(el *element, job *refreshJob, current any) {
+	value, err := t.runRefresh(el.Key, job, current)
+	if err != nil {
+		t.logf("temap: refresh of key %v failed: %v", el.Key, err)
+	} else {
+		value = t.encode(value)
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	if !t.live(el) || el.refresh != job || t.closed {
+		if err == nil {
+			t.free(value)
+		}
+		return
+	}
+	if err == nil {
+		if t.rejectWrite() {
+			t.free(value)
+		} else {
+			silent, priority := el.silent, el.priority
+			t.set(el.Key, value, el.ExpiresAt)
+			el.refresh, el.silent, el.priority = job, silent, priority
+		}
+	}
+	job.timer.Reset(job.every)
+}
+
+// runRefresh calls job.fn, turning a panic into an error.
+func (t *timedMap) runRefresh(key any, job *refreshJob, current any) (value any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return job.fn(context.Background(), key, current)
+}
+
+// unrefresh stops refreshing el. Callers must hold mu.
+func (t *timedMap) unrefresh(el *element) {
+	if el.refresh != nil {
+		el.refresh.timer.Stop()
+		el.refresh = nil
+	}
+}
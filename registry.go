@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "sync"
+
+// --------------------------------------------------------------------
+// Named map registry
+// --------------------------------------------------------------------
+
+// registry holds the maps created with NewNamed until they are closed.
+var registry struct {
+	mu   sync.Mutex
+	maps map[string]*TimedMap
+}
+
+// NewNamed is New with WithName(name), and also registers the map in a
+// process-wide registry so that AllStats reports it. A later map with
+// the same name replaces it there; Close unregisters it.
+func NewNamed(name string, onExpire func(key, val any), opts ...Option) *TimedMap {
+	t := New(onExpire, append(opts[:len(opts):len(opts)], WithName(name))...)
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.maps == nil {
+		registry.maps = make(map[string]*TimedMap)
+	}
+	registry.maps[name] = t
+	t.registered = true
+	return t
+}
+
+// AllStats returns the Stats of every registered map by name, see
+// NewNamed.
+func AllStats() map[string]map[string]uint64 {
+	registry.mu.Lock()
+	maps := make(map[string]*TimedMap, len(registry.maps))
+	for name, t := range registry.maps {
+		maps[name] = t
+	}
+	registry.mu.Unlock()
+
+	out := make(map[string]map[string]uint64, len(maps))
+	for name, t := range maps {
+		out[name] = t.Stats()
+	}
+	return out
+}
+
+// unregister removes t from the registry if it is still registered
+// under its name.
+func (t *timedMap) unregister() {
+	if !t.registered {
+		return
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if m, ok := registry.maps[t.name]; ok && m.timedMap == t {
+		delete(registry.maps, t.name)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+// --------------------------------------------------------------------
+// Cursor-based scanning
+// --------------------------------------------------------------------
+
+// scanDefaultCount is how many slots Scan inspects when count <= 0, as
+// in Redis.
+const scanDefaultCount = 10
+
+// slotTable gives every entry a stable position for Scan to walk. An
+// entry keeps its slot until it is removed, and freed slots are reused,
+// so a cursor never skips an entry that was present for the whole scan.
+type slotTable struct {
+	els  []*element
+	free []int
+}
+
+// put gives el a slot.
+func (s *slotTable) put(el *element) {
+	for len(s.free) > 0 {
+		i := s.free[len(s.free)-1]
+		s.free = s.free[:len(s.free)-1]
+		if i < len(s.els) {
+			s.els[i] = el
+			el.pos = i
+			return
+		}
+	}
+	el.pos = len(s.els)
+	s.els = append(s.els, el)
+}
+
+// drop frees the slot of el. Trailing free slots are trimmed so that the
+// table shrinks back as the map does.
+func (s *slotTable) drop(el *element) {
+	s.els[el.pos] = nil
+	if el.pos < len(s.els)-1 {
+		s.free = append(s.free, el.pos)
+		return
+	}
+	n := len(s.els) - 1
+	for n > 0 && s.els[n-1] == nil {
+		n--
+	}
+	s.els = s.els[:n]
+	if n == 0 {
+		s.free = s.free[:0]
+	}
+}
+
+func (s *slotTable) reset() {
+	s.els = nil
+	s.free = nil
+}
+
+// Scan incrementally walks the map the way Redis SCAN does. Start with
+// cursor 0 and pass the returned cursor to the next call; a returned
+// cursor of 0 means the walk is over. Each call inspects about count
+// entries (10 if count <= 0) and returns the keys among them that match
+// the glob pattern match, see KeysMatching; an empty match returns every
+// key. The lock is only held for the duration of one call.
+//
+// An entry present for the whole walk is returned at least once; entries
+// added or removed meanwhile may or may not be returned, and a key that
+// is removed and re-added may be returned twice.
+func (t *timedMap) Scan(cursor uint64, match string, count int) (keys []any, next uint64) {
+	if count <= 0 {
+		count = scanDefaultCount
+	}
+
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	els := t.slots.els
+	i := cursor
+	for ; i < uint64(len(els)) && count > 0; i++ {
+		el := els[i]
+		if el == nil {
+			continue
+		}
+		count--
+		if match == "" {
+			keys = append(keys, el.Key)
+			continue
+		}
+		if s, ok := el.Key.(string); ok && globMatch(match, s) {
+			keys = append(keys, el.Key)
+		}
+	}
+	if i >= uint64(len(els)) {
+		return keys, 0
+	}
+	return keys, i
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"container/heap"
+	"fmt"
+	"slices"
+)
+
+// --------------------------------------------------------------------
+// Expiry schedulers
+// --------------------------------------------------------------------
+
+// expiryScheduler tracks the deadlines of temporary elements. Every
+// backend implements it, so TimedMap never depends on a particular data
+// structure. All methods are called with the map's mu held.
+type expiryScheduler interface {
+	// add schedules el, which must not be scheduled yet.
+	add(el *element)
+	// update reschedules el after its ExpiresAt changed.
+	update(el *element)
+	// cancel unschedules el.
+	cancel(el *element)
+	// next returns a deadline no later than the earliest scheduled one.
+	next() (deadline int64, ok bool)
+	// popDue unschedules and returns up to limit elements (all of them
+	// if limit < 0) whose deadline is at or before now.
+	popDue(now int64, limit int) []*element
+	// len returns the number of scheduled elements.
+	len() int
+	// holds reports whether el is scheduled according to the
+	// scheduler's own bookkeeping, see CheckIntegrity.
+	holds(el *element) bool
+	// each calls fn for every scheduled element in no particular order
+	// until fn returns false.
+	each(fn func(el *element) bool)
+	// reset unschedules everything.
+	reset()
+}
+
+// orderedScheduler is implemented by schedulers that can walk their
+// elements in deadline order without sorting.
+type orderedScheduler interface {
+	ascend(fn func(el *element) bool)
+}
+
+// batchScheduler is implemented by schedulers that can apply many
+// add/update/cancel calls more cheaply together than one by one. Between
+// beginBatch and endBatch only add, update and cancel may be called.
+type batchScheduler interface {
+	beginBatch()
+	endBatch()
+}
+
+// checkedScheduler is implemented by schedulers that can verify their
+// internal invariants, see CheckIntegrity.
+type checkedScheduler interface {
+	check() error
+}
+
+// growableScheduler is implemented by schedulers with preallocatable
+// storage.
+type growableScheduler interface {
+	grow(n int)
+}
+
+// --------------------------------------------------------------------
+// Heap scheduler
+// --------------------------------------------------------------------
+
+type heapScheduler struct {
+	h expiryHeap
+
+	batching bool
+	dropped  int // elements cancelled during the current batch
+}
+
+func (s *heapScheduler) add(el *element) {
+	if s.batching {
+		el.index = len(s.h)
+		s.h = append(s.h, el)
+		return
+	}
+	heap.Push(&s.h, el)
+}
+
+func (s *heapScheduler) update(el *element) {
+	if !s.batching {
+		heap.Fix(&s.h, el.index)
+	}
+}
+
+func (s *heapScheduler) cancel(el *element) {
+	if el.index < 0 {
+		return
+	}
+	if s.batching {
+		// endBatch drops slots whose element no longer points back.
+		el.index = -1
+		s.dropped++
+		return
+	}
+	heap.Remove(&s.h, el.index)
+}
+
+func (s *heapScheduler) next() (int64, bool) {
+	if len(s.h) == 0 {
+		return 0, false
+	}
+	return s.h[0].ExpiresAt, true
+}
+
+func (s *heapScheduler) popDue(now int64, limit int) []*element {
+	var due []*element
+	for len(s.h) > 0 && s.h[0].ExpiresAt <= now && limit != 0 {
+		due = append(due, heap.Pop(&s.h).(*element))
+		limit--
+	}
+	return due
+}
+
+func (s *heapScheduler) len() int { return len(s.h) - s.dropped }
+
+func (s *heapScheduler) holds(el *element) bool {
+	return el.index >= 0 && el.index < len(s.h) && s.h[el.index] == el
+}
+
+// check verifies that every element knows its position and, outside of
+// batches, that no element is due before its parent.
+func (s *heapScheduler) check() error {
+	for i, el := range s.h {
+		if el.index != i && !s.batching {
+			return fmt.Errorf("heap slot %d holds key %v, which thinks it is at %d", i, el.Key, el.index)
+		}
+		if p := (i - 1) / 2; i > 0 && !s.batching && s.h[p].ExpiresAt > el.ExpiresAt {
+			return fmt.Errorf("heap slot %d is due before its parent %d", i, p)
+		}
+	}
+	return nil
+}
+
+func (s *heapScheduler) each(fn func(el *element) bool) {
+	for i, el := range s.h {
+		if el.index == i && !fn(el) {
+			return
+		}
+	}
+}
+
+func (s *heapScheduler) reset() {
+	for _, el := range s.h {
+		el.index = -1
+	}
+	clear(s.h)
+	s.h = s.h[:0]
+	s.batching, s.dropped = false, 0
+}
+
+func (s *heapScheduler) grow(n int) {
+	s.h = slices.Grow(s.h, n-len(s.h))
+}
+
+// ascend walks the heap lazily without modifying it, so stopping after k
+// elements costs O(k log k).
+func (s *heapScheduler) ascend(fn func(el *element) bool) {
+	if len(s.h) == 0 {
+		return
+	}
+
+	frontier := &heapCursor{h: s.h, idx: []int{0}}
+	for frontier.Len() > 0 {
+		i := heap.Pop(frontier).(int)
+		if !fn(s.h[i]) {
+			return
+		}
+		for _, c := range [2]int{2*i + 1, 2*i + 2} {
+			if c < len(s.h) {
+				heap.Push(frontier, c)
+			}
+		}
+	}
+}
+
+func (s *heapScheduler) beginBatch() {
+	s.batching = true
+}
+
+// endBatch compacts away cancelled elements and restores the heap
+// invariant in O(n).
+func (s *heapScheduler) endBatch() {
+	h := s.h[:0]
+	for i, el := range s.h {
+		if el.index != i {
+			continue
+		}
+		el.index = len(h)
+		h = append(h, el)
+	}
+	clear(s.h[len(h):])
+	s.h = h
+	heap.Init(&s.h)
+	s.batching, s.dropped = false, 0
+}
+
+// heapCursor is a min-heap of indexes into an expiryHeap. Every element
+// of a heap is preceded by its parent, so expanding children as parents
+// are popped yields the whole heap in sorted order.
+type heapCursor struct {
+	h   expiryHeap
+	idx []int
+}
+
+func (c *heapCursor) Len() int           { return len(c.idx) }
+func (c *heapCursor) Less(i, j int) bool { return c.h[c.idx[i]].ExpiresAt < c.h[c.idx[j]].ExpiresAt }
+func (c *heapCursor) Swap(i, j int)      { c.idx[i], c.idx[j] = c.idx[j], c.idx[i] }
+func (c *heapCursor) Push(x any)         { c.idx = append(c.idx, x.(int)) }
+func (c *heapCursor) Pop() any {
+	n := len(c.idx)
+	i := c.idx[n-1]
+	c.idx = c.idx[:n-1]
+	return i
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "time"
+
+// --------------------------------------------------------------------
+// Expiring set
+// --------------------------------------------------------------------
+
+// Set is a set whose members expire individually, such as the IDs seen
+// in the last few minutes for deduplication. It is a TimedMap keyed by
+// member, so every Option applies. Contains is a lookup like Get: it
+// counts as a hit or miss and slides the member's deadline with
+// WithSlidingExpiration. Members and Len are bulk reads, like Keys and
+// Size, and do neither.
+type Set struct {
+	m *TimedMap
+}
+
+// NewSet creates a Set; onExpire, if not nil, is called with every
+// member that expires.
+func NewSet(onExpire func(member any), opts ...Option) *Set {
+	var cb func(key, val any)
+	if onExpire != nil {
+		cb = func(key, _ any) { onExpire(key) }
+	}
+	return &Set{New(cb, opts...)}
+}
+
+// Add adds member for ttl, or for good if ttl <= 0. Adding a member
+// again restarts its ttl.
+func (s *Set) Add(member any, ttl time.Duration) {
+	s.m.SetWithTTL(member, struct{}{}, ttl)
+}
+
+// AddIfAbsent adds member like Add unless it is already in the set, and
+// reports whether it did. Concurrent calls for the same member add it
+// once, which makes it the check-and-mark step of deduplication.
+func (s *Set) AddIfAbsent(member any, ttl time.Duration) bool {
+	t := s.m.timedMap
+	value := t.encode(struct{}{})
+	exp := int64(ElementPermanent)
+	if ttl > 0 {
+		exp = t.ticks(t.now().Add(ttl))
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	if el, ok := t.items[member]; ok && !t.overdue(el) || t.rejectWrite() {
+		t.free(value)
+		return false
+	}
+	t.set(member, value, exp)
+	return true
+}
+
+// Contains reports whether member is in the set. Members past their
+// deadline are reported missing even before the cleaner removes them.
+func (s *Set) Contains(member any) bool {
+	t := s.m.timedMap
+	_, exp, ok := t.get(member)
+	hit := ok && (exp == ElementPermanent || exp > t.nowNano())
+	t.looked(member, hit)
+	return hit
+}
+
+// Remove removes member.
+func (s *Set) Remove(member any) {
+	s.m.Remove(member)
+}
+
+// Members returns the members of the set in no particular order,
+// leaving out those past their deadline.
+func (s *Set) Members() []any {
+	t := s.m.timedMap
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	members := make([]any, 0, len(t.items))
+	for k, el := range t.items {
+		if !t.overdue(el) {
+			members = append(members, k)
+		}
+	}
+	return members
+}
+
+// Len returns the number of members, leaving out those past their
+// deadline like Members. With the default backend it only visits the
+// members past their deadline, which the cleaner has yet to remove;
+// otherwise, or with WithExpiryDecider or WithGracePeriod, it visits
+// every member.
+func (s *Set) Len() int {
+	t := s.m.timedMap
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	o, ordered := t.sched.(orderedScheduler)
+	if ordered && t.decide == nil && t.grace == 0 {
+		n, now := len(t.items), t.nowTicks()
+		o.ascend(func(el *element) bool {
+			if el.ExpiresAt > now {
+				return false
+			}
+			n--
+			return true
+		})
+		return n
+	}
+
+	n := 0
+	for _, el := range t.items {
+		if !t.overdue(el) {
+			n++
+		}
+	}
+	return n
+}
+
+// Map returns the TimedMap backing the set, for stats and cleaner
+// control.
+func (s *Set) Map() *TimedMap {
+	return s.m
+}
+
+// Close stops the set's cleaner, see TimedMap.Close.
+func (s *Set) Close() {
+	s.m.Close()
+}
+
+// overdue reports whether el is past its deadline. Callers must hold mu.
+func (t *timedMap) overdue(el *element) bool {
+	return el.ExpiresAt != ElementPermanent && el.ExpiresAt <= t.nowTicks()
+}
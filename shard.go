@@ -0,0 +1,403 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/maphash"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Sharded map
+// --------------------------------------------------------------------
+
+// ShardedMap spreads keys over independent TimedMaps by key hash, so
+// writers of keys on different shards never contend for a lock. Every
+// shard has its own cleaner and is configured with the same options.
+type ShardedMap struct {
+	layout   atomic.Pointer[shardLayout]
+	onExpire func(key, val any)
+	opts     []Option
+
+	// elastic maps can be resized; their operations hold moving for
+	// reading so that Resize can switch layouts between operations.
+	elastic bool
+	moving  sync.RWMutex
+
+	resize sync.Mutex // serializes Resize and Close
+	closed bool
+	stop   chan struct{} // stops the autoscaler, if any
+	wg     sync.WaitGroup
+
+	retiredMu sync.Mutex
+	retired   map[string]uint64 // counters of shards dropped by Resize
+}
+
+// shardLayout is the set of shards keys are spread over. While Resize
+// moves entries to new shards, old holds the shards they come from.
+type shardLayout struct {
+	shards []*TimedMap
+	old    []*TimedMap
+	seed   maphash.Seed
+}
+
+func (l *shardLayout) shard(key any) *TimedMap {
+	return l.shards[hashKey(l.seed, key)%uint64(len(l.shards))]
+}
+
+func (l *shardLayout) oldShard(key any) *TimedMap {
+	return l.old[hashKey(l.seed, key)%uint64(len(l.old))]
+}
+
+// all returns the old shards, if any, followed by the current ones,
+// which is the order shards must be locked in.
+func (l *shardLayout) all() []*TimedMap {
+	if l.old == nil {
+		return l.shards
+	}
+	return append(l.old[:len(l.old):len(l.old)], l.shards...)
+}
+
+// ShardStats describes one shard of a ShardedMap.
+type ShardStats struct {
+	Shard     int
+	Size      int
+	Temporary int    // entries waiting in the expiry scheduler
+	LockWaits uint64 // lock acquisitions that had to wait
+
+	// Mean and longest wait of a sample of the writers and readers that
+	// had to wait for the lock.
+	WriteWaitAvg, WriteWaitMax time.Duration
+	ReadWaitAvg, ReadWaitMax   time.Duration
+
+	Stats map[string]uint64
+}
+
+// NewSharded creates a ShardedMap with n shards (1 if n <= 0).
+func NewSharded(n int, onExpire func(key, val any), opts ...Option) *ShardedMap {
+	m := &ShardedMap{onExpire: onExpire, opts: opts, retired: make(map[string]uint64)}
+	m.layout.Store(&shardLayout{shards: m.newShards(n), seed: maphash.MakeSeed()})
+	return m
+}
+
+func (m *ShardedMap) newShards(n int) []*TimedMap {
+	shards := make([]*TimedMap, max(n, 1))
+	for i := range shards {
+		shards[i] = New(m.onExpire, m.opts...)
+	}
+	return shards
+}
+
+// use returns the current layout, holding it until done is called.
+func (m *ShardedMap) use() (l *shardLayout, done func()) {
+	if !m.elastic {
+		return m.layout.Load(), func() {}
+	}
+	m.moving.RLock()
+	return m.layout.Load(), m.moving.RUnlock
+}
+
+// Shard returns the shard that holds key. While a Resize is in progress
+// the key may still be in one of the shards being drained.
+func (m *ShardedMap) Shard(key any) *TimedMap {
+	return m.layout.Load().shard(key)
+}
+
+// SetTemporary sets a key with explicit expiration time.
+func (m *ShardedMap) SetTemporary(key, value any, expiresAt time.Time) {
+	l, done := m.use()
+	defer done()
+	l.evictOld(key)
+	l.shard(key).SetTemporary(key, value, expiresAt)
+}
+
+// SetWithTTL sets a key that expires after the given TTL duration.
+func (m *ShardedMap) SetWithTTL(key, value any, ttl time.Duration) {
+	l, done := m.use()
+	defer done()
+	l.evictOld(key)
+	l.shard(key).SetWithTTL(key, value, ttl)
+}
+
+// SetPermanent sets a key that never expires.
+func (m *ShardedMap) SetPermanent(key, value any) {
+	l, done := m.use()
+	defer done()
+	l.evictOld(key)
+	l.shard(key).SetPermanent(key, value)
+}
+
+// Get retrieves a value and its expiration.
+func (m *ShardedMap) Get(key any) (any, int64, bool) {
+	l, done := m.use()
+	defer done()
+	if l.old != nil {
+		// Entries only move from old to new shards, so looking in that
+		// order cannot miss one. Only the final outcome is observed.
+		old := l.oldShard(key)
+		if v, exp, ok := old.get(key); ok {
+			old.looked(key, true)
+			return v, exp, true
+		}
+	}
+	return l.shard(key).Get(key)
+}
+
+// Remove deletes a key.
+func (m *ShardedMap) Remove(key any) {
+	l, done := m.use()
+	defer done()
+	if l.old != nil {
+		l.oldShard(key).Remove(key)
+	}
+	l.shard(key).Remove(key)
+}
+
+// RemoveAll clears all shards, one at a time.
+func (m *ShardedMap) RemoveAll() {
+	l, done := m.use()
+	defer done()
+	for _, s := range l.all() {
+		s.RemoveAll()
+	}
+}
+
+// Size returns the number of items over all shards, as of one instant:
+// every shard is read-locked while they are counted.
+func (m *ShardedMap) Size() int {
+	l, done := m.use()
+	defer done()
+	n := 0
+	shards := l.all()
+	for _, s := range shards {
+		s.rlock()
+		n += len(s.items)
+	}
+	for _, s := range shards {
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// SizeApprox sums the sizes of the shards without locking them, so
+// writes made meanwhile may be counted in some shards and not others.
+func (m *ShardedMap) SizeApprox() int {
+	l, done := m.use()
+	defer done()
+	n := 0
+	for _, s := range l.all() {
+		n += s.SizeApprox()
+	}
+	return n
+}
+
+// Close stops the autoscaler, if any, and closes every shard.
+func (m *ShardedMap) Close() {
+	if m.stop != nil {
+		m.resize.Lock()
+		if !m.closed {
+			close(m.stop)
+		}
+		m.resize.Unlock()
+		m.wg.Wait()
+	}
+
+	m.resize.Lock()
+	defer m.resize.Unlock()
+	m.closed = true
+	for _, s := range m.layout.Load().all() {
+		s.Close()
+	}
+}
+
+// Run is TimedMap.Run for every shard: it blocks until ctx is done, then
+// closes the map and waits for the shards' expiry callbacks.
+func (m *ShardedMap) Run(ctx context.Context) error {
+	m.resize.Lock()
+	closed := m.closed
+	m.resize.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	<-ctx.Done()
+	m.Close()
+	for _, s := range m.layout.Load().all() {
+		s.awaitCallbacks()
+	}
+	return nil
+}
+
+// Stats returns the counters of all shards summed up, including those of
+// shards dropped by Resize.
+func (m *ShardedMap) Stats() map[string]uint64 {
+	l, done := m.use()
+	defer done()
+
+	total := make(map[string]uint64)
+	m.retiredMu.Lock()
+	for k, v := range m.retired {
+		total[k] = v
+	}
+	m.retiredMu.Unlock()
+
+	var maxWrite, maxRead uint64
+	for _, s := range l.all() {
+		stats := s.Stats()
+		for k, v := range stats {
+			total[k] += v
+		}
+		maxWrite = max(maxWrite, stats["lock_wait_write_ns_max"])
+		maxRead = max(maxRead, stats["lock_wait_read_ns_max"])
+	}
+	// Not counters, so report them once.
+	total["precision_ns"] = l.shards[0].Stats()["precision_ns"]
+	total["lock_wait_write_ns_max"] = maxWrite
+	total["lock_wait_read_ns_max"] = maxRead
+	return total
+}
+
+// StatsDetailed returns per-shard sizes, scheduler depths and lock
+// contention, to spot hot shards caused by skewed keys. Shards being
+// drained by Resize are left out.
+func (m *ShardedMap) StatsDetailed() []ShardStats {
+	shards := m.layout.Load().shards
+	out := make([]ShardStats, len(shards))
+	for i, s := range shards {
+		stats := s.Stats()
+		out[i] = ShardStats{
+			Shard:        i,
+			Size:         int(stats["current"]),
+			Temporary:    int(stats["current_temporary"]),
+			LockWaits:    stats["lock_waits"],
+			WriteWaitAvg: s.waits.write.avg(),
+			WriteWaitMax: time.Duration(s.waits.write.max.Load()),
+			ReadWaitAvg:  s.waits.read.avg(),
+			ReadWaitMax:  time.Duration(s.waits.read.max.Load()),
+			Stats:        stats,
+		}
+	}
+	return out
+}
+
+// hashKey hashes a map key so that equal keys get equal hashes. Common
+// key types are hashed directly, others by reflection, see hashValue.
+func hashKey(seed maphash.Seed, key any) uint64 {
+	var h maphash.Hash
+	h.SetSeed(seed)
+
+	var buf [8]byte
+	switch k := key.(type) {
+	case string:
+		h.WriteString(k)
+	case int:
+		binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		h.Write(buf[:])
+	case int64:
+		binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		h.Write(buf[:])
+	case int32:
+		binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		h.Write(buf[:])
+	case uint:
+		binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		h.Write(buf[:])
+	case uint64:
+		binary.LittleEndian.PutUint64(buf[:], k)
+		h.Write(buf[:])
+	case uint32:
+		binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		h.Write(buf[:])
+	case float64:
+		writeFloat(&h, k)
+	default:
+		hashValue(&h, reflect.ValueOf(key))
+	}
+	return h.Sum64()
+}
+
+// hashValue writes v to h the way == compares it: pointers, channels
+// and unsafe pointers by address, not by what they point to, structs
+// and arrays field by field, and interfaces by dynamic type and value.
+func hashValue(h *maphash.Hash, v reflect.Value) {
+	var buf [8]byte
+	word := func(x uint64) {
+		binary.LittleEndian.PutUint64(buf[:], x)
+		h.Write(buf[:])
+	}
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		word(0)
+	case reflect.Bool:
+		if v.Bool() {
+			word(1)
+		} else {
+			word(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		word(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		word(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		writeFloat(h, v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		writeFloat(h, real(c))
+		writeFloat(h, imag(c))
+	case reflect.String:
+		word(uint64(v.Len()))
+		h.WriteString(v.String())
+	case reflect.Pointer, reflect.Chan, reflect.UnsafePointer:
+		word(uint64(v.Pointer()))
+	case reflect.Interface:
+		if v.IsNil() {
+			word(0)
+			return
+		}
+		h.WriteString(v.Elem().Type().String())
+		hashValue(h, v.Elem())
+	case reflect.Struct:
+		h.WriteString(v.Type().String())
+		for i := 0; i < v.NumField(); i++ {
+			hashValue(h, v.Field(i))
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			hashValue(h, v.Index(i))
+		}
+	default:
+		// Maps, slices and funcs cannot be map keys.
+		panic("temap: unhashable key type " + v.Type().String())
+	}
+}
+
+// writeFloat writes f to h with -0.0 and +0.0 alike, as == has them.
+func writeFloat(h *maphash.Hash, f float64) {
+	if f == 0 {
+		f = 0
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(f))
+	h.Write(buf[:])
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "time"
+
+// --------------------------------------------------------------------
+// Silent entries
+// --------------------------------------------------------------------
+
+// SetSilentWithTTL is SetWithTTL for an entry that expires silently: no
+// expiry callback runs and no EventExpired is emitted for it, so
+// bookkeeping keys do not load the callback pipeline. Removal and
+// overwrite events are emitted as usual.
+func (t *timedMap) SetSilentWithTTL(key, value any, ttl time.Duration) {
+	t.throttle()
+	value = t.encode(value)
+
+	exp := int64(ElementPermanent)
+	if ttl > 0 {
+		exp = t.ticks(t.now().Add(ttl))
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		t.free(value)
+		return
+	}
+
+	t.set(key, value, exp)
+	t.items[key].silent = true
+}
+
+// SetSilent changes whether an existing key expires silently, see
+// SetSilentWithTTL. Returns false if the key does not exist.
+func (t *timedMap) SetSilent(key any, silent bool) bool {
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		return false
+	}
+
+	el, ok := t.items[key]
+	if ok {
+		el.silent = silent
+	}
+	return ok
+}
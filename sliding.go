@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "time"
+
+// --------------------------------------------------------------------
+// Sliding expiration
+// --------------------------------------------------------------------
+
+// WithSlidingExpiration makes Get push the deadline of a temporary entry
+// back by the TTL it was last given, so it only expires after going
+// unread for that long. Get takes the write lock while this is enabled.
+func WithSlidingExpiration() Option {
+	return func(t *TimedMap) {
+		t.sliding = true
+	}
+}
+
+// WithMaxLifetime caps every deadline at d after the entry was created,
+// so neither sliding expiration nor overwrites can keep an entry alive
+// longer. Permanent entries are not affected.
+func WithMaxLifetime(d time.Duration) Option {
+	return func(t *TimedMap) {
+		if d > 0 {
+			t.maxLifetime = d
+		}
+	}
+}
+
+// getSliding is Get with sliding expiration.
+func (t *timedMap) getSliding(key any) (any, int64, bool) {
+	t.lock()
+	el, ok := t.items[key]
+	if !ok {
+		t.unlock()
+		return nil, ElementDoesntExist, false
+	}
+	if !t.frozen && !t.closed {
+		t.slide(el)
+	}
+	value, exp := el.Value, el.ExpiresAt
+	t.unlock()
+
+	return t.decode(value), t.unixNano(exp), true
+}
+
+// slide moves el's deadline to its TTL from now. Overdue entries are left
+// for the cleaner. Callers must hold mu.
+func (t *timedMap) slide(el *element) {
+	now := t.nowTicks()
+	if el.ExpiresAt == ElementPermanent || el.ExpiresAt <= now {
+		return
+	}
+	exp := t.lifetimeCap(el.createdAt, now+el.ttl)
+	if exp > el.ExpiresAt {
+		t.beforeWrite(el)
+		el.ExpiresAt = exp
+		t.sched.update(el)
+	}
+}
+
+// lifetimeCap limits the deadline exp of an entry created at createdAt
+// (UnixNano) to the maximum lifetime.
+func (t *timedMap) lifetimeCap(createdAt, exp int64) int64 {
+	if t.maxLifetime == 0 || exp == ElementPermanent {
+		return exp
+	}
+	return min(exp, t.ticks(time.Unix(0, createdAt).Add(t.maxLifetime)))
+}
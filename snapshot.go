@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"maps"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Point-in-time snapshots
+// --------------------------------------------------------------------
+
+// Snapshot is an immutable view of a map at one instant: its entries,
+// with their deadlines, and its Stats. Reading it takes no locks.
+type Snapshot struct {
+	at      time.Time
+	entries map[any]Entry
+	stats   map[string]uint64
+}
+
+// Snapshot copies the map's entries and counters as of one instant, so
+// that they are consistent with each other. Like Entries, it only
+// blocks writers for a chunk of entries at a time. On maps using
+// WithEncryption, encrypted values are kept as their ciphertext.
+func (t *timedMap) Snapshot() *Snapshot {
+	s := &Snapshot{}
+	entries := t.copyEntries(func() {
+		s.at = time.Now()
+		s.stats = t.statsLocked()
+	})
+
+	s.entries = make(map[any]Entry, len(entries))
+	for _, e := range entries {
+		e.Value = t.sealed(e.Value)
+		s.entries[e.Key] = e
+	}
+	return s
+}
+
+// Time returns when the snapshot was taken.
+func (s *Snapshot) Time() time.Time {
+	return s.at
+}
+
+// Len returns the number of entries in the snapshot.
+func (s *Snapshot) Len() int {
+	return len(s.entries)
+}
+
+// Get returns the entry of key as of the snapshot.
+func (s *Snapshot) Get(key any) (Entry, bool) {
+	e, ok := s.entries[key]
+	return e, ok
+}
+
+// Range calls fn for every entry, in no particular order, until fn
+// returns false.
+func (s *Snapshot) Range(fn func(e Entry) bool) {
+	for _, e := range s.entries {
+		if !fn(e) {
+			return
+		}
+	}
+}
+
+// Stats returns a copy of the map's counters as of the snapshot.
+func (s *Snapshot) Stats() map[string]uint64 {
+	return maps.Clone(s.stats)
+}
@@ -1,14 +1,64 @@
 package temap
 
-// Stats returns a copy of internal counters.
-func (t *TimedMap) Stats() map[string]uint64 {
-	t.mu.RLock()
+// Stats returns a copy of internal counters. "permanent" counts how many
+// times an entry became permanent; "current_permanent" and
+// "current_temporary" give the live split. "hits" and "misses" count
+// lookups, see HitRatio.
+func (t *timedMap) Stats() map[string]uint64 {
+	t.rlock()
 	defer t.mu.RUnlock()
-	return map[string]uint64{
+	return t.statsLocked()
+}
+
+// statsLocked builds the Stats map. Callers must hold mu.
+func (t *timedMap) statsLocked() map[string]uint64 {
+	stats := map[string]uint64{
 		"added":     t.stats.added,
 		"removed":   t.stats.removed,
 		"expired":   t.stats.expired,
 		"permanent": t.stats.permanent,
 		"current":   uint64(len(t.items)),
+		"hits":      t.hits.Load(),
+		"misses":    t.misses.Load(),
+
+		"current_permanent": uint64(len(t.items) - t.sched.len()),
+		"current_temporary": uint64(t.sched.len()),
+
+		"decode_errors":       t.decodeErrors.Load(),
+		"cleaner_panics":      t.cleanerPanics.Load(),
+		"expire_queue_depth":  uint64(t.inflight.Load()),
+		"lock_waits":          t.lockWaits.Load(),
+		"expiry_bound_misses": t.boundMisses.Load(),
+		"slow_callbacks":      t.slowCallbacks.Load(),
+		"frozen_rejects":      t.frozenRejects,
+		"integrity_errors":    t.integrityErrors.Load(),
+		"integrity_repairs":   t.integrityRepairs.Load(),
+		"precision_ns":        uint64(t.unit),
+	}
+	if t.pool != nil {
+		stats["callback_workers"] = uint64(t.pool.running.Load())
+		stats["callback_overflow"] = t.pool.overflow.Load()
+		stats["backpressure_waits"] = t.pool.waits.Load()
+	}
+	t.waits.write.into(stats, "lock_wait_write")
+	t.waits.read.into(stats, "lock_wait_read")
+	if t.filter != nil {
+		stats["filter_rejects"] = t.filter.rejected.Load()
+	}
+	if t.arena != nil {
+		stats["arena_bytes"], stats["arena_live_bytes"] = t.arena.stats()
+	}
+	t.classStatsInto(stats)
+	return stats
+}
+
+// HitRatio returns the share of lookups in stats, as returned by Stats,
+// that found their key, or 0 if there were none. Lookups are Get and the
+// methods built on it, GetWithVersion and GetEntry.
+func HitRatio(stats map[string]uint64) float64 {
+	hits, misses := stats["hits"], stats["misses"]
+	if hits+misses == 0 {
+		return 0
 	}
+	return float64(hits) / float64(hits+misses)
 }
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package temaptest provides helpers for testing code that uses temap.
+package temaptest
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// settle is how long VerifyNoLeaks waits for goroutines that are
+// already on their way out.
+const settle = time.Second
+
+// createdBy marks the stack trace of a goroutine started by temap.
+const createdBy = "created by github.com/majiddarvishan/temap."
+
+// VerifyNoLeaks fails t if, when t ends, goroutines started by temap are
+// running that were not running when VerifyNoLeaks was called: cleaners
+// of maps that were never stopped, callback workers, async appliers and
+// the like. Each leaked goroutine is reported with its stack. Call it
+// first thing in a test, before creating maps:
+//
+//	func TestSessions(t *testing.T) {
+//		temaptest.VerifyNoLeaks(t)
+//		...
+//	}
+func VerifyNoLeaks(t testing.TB) {
+	t.Helper()
+
+	before := make(map[string]bool)
+	for id := range goroutines() {
+		before[id] = true
+	}
+
+	t.Cleanup(func() {
+		var leaked []string
+		deadline := time.Now().Add(settle)
+		for {
+			leaked = leaked[:0]
+			for id, stack := range goroutines() {
+				if !before[id] {
+					leaked = append(leaked, stack)
+				}
+			}
+			if len(leaked) == 0 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for _, stack := range leaked {
+			t.Errorf("temaptest: leaked goroutine:\n%s", stack)
+		}
+	})
+}
+
+// goroutines returns the stacks of the goroutines started by temap, by
+// goroutine id.
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	out := make(map[string]string)
+	for _, g := range bytes.Split(buf, []byte("\n\n")) {
+		stack := string(g)
+		if !strings.Contains(stack, createdBy) {
+			continue
+		}
+		// "goroutine 42 [select]:"
+		header, _, _ := strings.Cut(stack, "\n")
+		if f := strings.Fields(header); len(f) >= 2 {
+			out[f[1]] = stack
+		}
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temaptest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/majiddarvishan/temap"
+)
+
+// recorder is a testing.TB that records errors instead of failing.
+type recorder struct {
+	testing.TB
+	cleanups []func()
+	errors   []string
+}
+
+func (r *recorder) Helper()               {}
+func (r *recorder) Cleanup(f func())      { r.cleanups = append(r.cleanups, f) }
+func (r *recorder) Errorf(string, ...any) { r.errors = append(r.errors, "leak") }
+
+func (r *recorder) finish() {
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+}
+
+func TestVerifyNoLeaks(t *testing.T) {
+	r := &recorder{TB: t}
+	VerifyNoLeaks(r)
+	m := temap.New(nil)
+	m.SetWithTTL("k", 1, time.Hour)
+	m.Close()
+	r.finish()
+	if len(r.errors) != 0 {
+		t.Fatalf("closed map reported as %d leaks", len(r.errors))
+	}
+
+	r = &recorder{TB: t}
+	VerifyNoLeaks(r)
+	leaky := temap.New(nil, temap.WithCallbackWorkers(2, 8))
+	r.finish()
+	if len(r.errors) != 3 { // cleaner and two workers
+		t.Fatalf("got %d leaks, want 3", len(r.errors))
+	}
+	leaky.Close()
+}
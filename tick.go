@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "time"
+
+// --------------------------------------------------------------------
+// Manually driven expiry
+// --------------------------------------------------------------------
+
+// WithManualExpiry makes New leave the cleaner stopped, so that expiry
+// only happens when the application calls Tick, e.g. from the frame loop
+// of a game server or simulation. StartCleaner still starts it.
+func WithManualExpiry() Option {
+	return func(t *TimedMap) {
+		t.manual = true
+	}
+}
+
+// Tick expires the entries due at now, as one pass of the cleaner would,
+// and returns how many expired. Their callbacks are dispatched before
+// Tick returns, and run inline with WithSyncCallbacks. Entries left to
+// WithExpiryDecider or WithGracePeriod are not counted. A frozen or
+// closed map expires nothing. With BackendTimers only entries whose
+// timers have gone off are considered.
+func (t *timedMap) Tick(now time.Time) (expired int) {
+	t.lock()
+	defer t.unlock()
+
+	if t.frozen || t.closed {
+		return 0
+	}
+
+	before := t.stats.expired
+	sweptAt := now.UnixNano()
+	t.lastSweep.Store(time.Now().UnixNano())
+	t.expireDue(t.floorTicks(sweptAt), sweptAt, -1)
+	return int(t.stats.expired - before)
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"context"
+	"math"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Process-wide timer wheel
+// --------------------------------------------------------------------
+
+// TimerWheel runs timers of a fixed resolution from a single goroutine,
+// so that many maps and application timeouts share one runtime timer.
+// Maps join with WithTimerWheel; other code schedules with AfterFunc.
+// Timers fire up to one tick after their deadline, never before.
+type TimerWheel struct {
+	mu     sync.Mutex
+	idle   sync.Cond // signalled when a map sweep ends
+	tick   int64     // nanoseconds
+	slots  [][]*WheelTimer
+	cursor int64 // last tick fired
+	n      int
+
+	maps map[*timedMap]*wheelMember
+
+	wake chan struct{}
+	stop chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// WheelTimer is a timer scheduled on a TimerWheel.
+type WheelTimer struct {
+	w     *TimerWheel
+	fn    func()
+	at    int64 // tick to fire at
+	slot  int   // -1 if not scheduled
+	index int   // position in the slot
+}
+
+// wheelMember is a map driven by the wheel.
+type wheelMember struct {
+	timer    *WheelTimer
+	sweeping bool
+}
+
+var sharedWheel struct {
+	once sync.Once
+	w    *TimerWheel
+}
+
+// SharedTimerWheel returns the process-wide wheel, with a resolution of
+// 10ms, starting it on first use. It is never closed.
+func SharedTimerWheel() *TimerWheel {
+	sharedWheel.once.Do(func() {
+		sharedWheel.w = NewTimerWheel(10*time.Millisecond, 512)
+	})
+	return sharedWheel.w
+}
+
+// NewTimerWheel starts a wheel firing timers every tick, with slots
+// buckets; a timer more than slots ticks out is looked at once per
+// rotation until due.
+func NewTimerWheel(tick time.Duration, slots int) *TimerWheel {
+	if tick <= 0 {
+		tick = time.Millisecond
+	}
+	if slots <= 0 {
+		slots = defaultWheelSlots
+	}
+	w := &TimerWheel{
+		tick:  int64(tick),
+		slots: make([][]*WheelTimer, slots),
+		maps:  make(map[*timedMap]*wheelMember),
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+	}
+	w.idle.L = &w.mu
+	w.cursor = time.Now().UnixNano() / w.tick
+
+	ctx := pprof.WithLabels(context.Background(), pprof.Labels("temap.role", "timer-wheel"))
+	w.wg.Add(1)
+	goLabeled(ctx, func() {
+		defer w.wg.Done()
+		w.run()
+	})
+	return w
+}
+
+// WithTimerWheel has w expire the map's entries instead of a cleaner
+// goroutine of its own; expirations are then up to one tick of w late.
+// Sweeps run on the wheel's goroutine. It has no effect with
+// BackendTimers.
+func WithTimerWheel(w *TimerWheel) Option {
+	return func(t *TimedMap) {
+		t.driver = w
+	}
+}
+
+// AfterFunc calls fn on the wheel's goroutine once d has passed. fn must
+// not block, as it holds up every other timer of the wheel.
+func (w *TimerWheel) AfterFunc(d time.Duration, fn func()) *WheelTimer {
+	tm := &WheelTimer{w: w, fn: fn, slot: -1}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.schedule(tm, time.Now().Add(d).UnixNano())
+	return tm
+}
+
+// Stop prevents the timer from firing. It returns false if the timer
+// already fired or was stopped.
+func (tm *WheelTimer) Stop() bool {
+	tm.w.mu.Lock()
+	defer tm.w.mu.Unlock()
+	return tm.w.unschedule(tm)
+}
+
+// Len returns the number of pending timers.
+func (w *TimerWheel) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.n
+}
+
+// Close stops the wheel's goroutine; pending timers never fire. Close the
+// wheel after the maps using it.
+func (w *TimerWheel) Close() {
+	w.once.Do(func() { close(w.stop) })
+	w.wg.Wait()
+}
+
+// schedule (re)arms tm to fire at the first tick at or after at
+// (UnixNano). Callers must hold mu.
+func (w *TimerWheel) schedule(tm *WheelTimer, at int64) {
+	w.unschedule(tm)
+	tick := (at + w.tick - 1) / w.tick
+	tm.at = max(tick, w.cursor+1)
+	tm.slot = int(tm.at % int64(len(w.slots)))
+	tm.index = len(w.slots[tm.slot])
+	w.slots[tm.slot] = append(w.slots[tm.slot], tm)
+	w.n++
+	if w.n == 1 {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// unschedule removes tm from its slot. Callers must hold mu.
+func (w *TimerWheel) unschedule(tm *WheelTimer) bool {
+	if tm.slot < 0 {
+		return false
+	}
+	slot := w.slots[tm.slot]
+	last := len(slot) - 1
+	slot[tm.index] = slot[last]
+	slot[tm.index].index = tm.index
+	slot[last] = nil
+	w.slots[tm.slot] = slot[:last]
+	tm.slot = -1
+	w.n--
+	return true
+}
+
+// advance removes and returns the timers due by tick now. Callers must
+// hold mu.
+func (w *TimerWheel) advance(now int64, fired []*WheelTimer) []*WheelTimer {
+	from := w.cursor + 1
+	if span := int64(len(w.slots)); now-from >= span {
+		from = now - span + 1
+	}
+	for c := from; c <= now; c++ {
+		slot := w.slots[c%int64(len(w.slots))]
+		for i := 0; i < len(slot); {
+			tm := slot[i]
+			if tm.at > now {
+				i++
+				continue
+			}
+			w.unschedule(tm)
+			slot = w.slots[c%int64(len(w.slots))]
+			fired = append(fired, tm)
+		}
+	}
+	w.cursor = max(w.cursor, now)
+	return fired
+}
+
+// run fires due timers every tick until the wheel is closed, sleeping
+// while none are pending.
+func (w *TimerWheel) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	var fired []*WheelTimer
+	for {
+		w.mu.Lock()
+		nowNano := time.Now().UnixNano()
+		fired = w.advance(nowNano/w.tick, fired[:0])
+		idle := w.n == 0
+		w.mu.Unlock()
+
+		for i, tm := range fired {
+			tm.fn()
+			fired[i] = nil
+		}
+
+		wait := time.Duration(math.MaxInt64)
+		if !idle {
+			wait = time.Duration((nowNano/w.tick+1)*w.tick - nowNano)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-w.wake:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// add makes t a member, due for a sweep right away.
+func (w *TimerWheel) add(t *timedMap) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.maps[t]; ok {
+		return
+	}
+	m := &wheelMember{}
+	m.timer = &WheelTimer{w: w, slot: -1, fn: func() { w.sweep(t, m) }}
+	w.maps[t] = m
+	w.schedule(m.timer, time.Now().UnixNano())
+}
+
+// remove drops t from the wheel, waiting for a sweep of t in progress if
+// wait is set.
+func (w *TimerWheel) remove(t *timedMap, wait bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	m, ok := w.maps[t]
+	if !ok {
+		return
+	}
+	delete(w.maps, t)
+	w.unschedule(m.timer)
+	for wait && m.sweeping {
+		w.idle.Wait()
+	}
+}
+
+// reschedule moves t's timer to at, see expiryDriver.
+func (w *TimerWheel) reschedule(t *timedMap, at int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	m, ok := w.maps[t]
+	switch {
+	case !ok:
+	case at == math.MaxInt64:
+		w.unschedule(m.timer)
+	default:
+		w.schedule(m.timer, at)
+	}
+}
+
+// sweep sweeps member t unless it left the wheel meanwhile.
+func (w *TimerWheel) sweep(t *timedMap, m *wheelMember) {
+	w.mu.Lock()
+	if w.maps[t] != m {
+		w.mu.Unlock()
+		return
+	}
+	m.sweeping = true
+	w.mu.Unlock()
+
+	t.sweepDriven()
+
+	w.mu.Lock()
+	m.sweeping = false
+	w.idle.Broadcast()
+	w.mu.Unlock()
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "time"
+
+// --------------------------------------------------------------------
+// Tombstones for recently expired keys
+// --------------------------------------------------------------------
+
+type tombstones struct {
+	window int64             // nanoseconds
+	values bool              // keep expired values, see WithStaleRetention
+	at     map[any]tombstone // key -> latest tombstone
+	queue  []tombstoneMark   // in expiry order, for pruning
+}
+
+type tombstone struct {
+	at    int64 // expired at (UnixNano)
+	value any   // stored form, if values are kept
+}
+
+type tombstoneMark struct {
+	key any
+	at  int64
+}
+
+// WithTombstones remembers keys removed by expiry for window, so that
+// WasExpired can tell an expired key from one that never existed.
+// Setting a key again drops its tombstone.
+func WithTombstones(window time.Duration) Option {
+	return func(t *TimedMap) {
+		t.keepTombstones(window, false)
+	}
+}
+
+// WithStaleRetention is like WithTombstones but also keeps the expired
+// values for window, so that GetStale can still return them.
+func WithStaleRetention(window time.Duration) Option {
+	return func(t *TimedMap) {
+		t.keepTombstones(window, true)
+	}
+}
+
+// WasExpired reports whether key expired within the tombstone window and
+// when. It always returns false unless WithTombstones or
+// WithStaleRetention is used.
+func (t *timedMap) WasExpired(key any) (expiredAt time.Time, ok bool) {
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	ts, ok := t.tombstone(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ts.at), true
+}
+
+// GetStale returns the value of key, or the value it had when it expired
+// if that happened within the WithStaleRetention window; stale tells the
+// two apart. A live entry in its grace period is stale too, see
+// WithGracePeriod.
+func (t *timedMap) GetStale(key any) (value any, stale bool, ok bool) {
+	t.rlock()
+	if el, live := t.items[key]; live {
+		value, stale = el.Value, el.stale
+	} else if ts, found := t.tombstone(key); found && t.tombs.values {
+		value, stale = ts.value, true
+	} else {
+		t.mu.RUnlock()
+		return nil, false, false
+	}
+	t.mu.RUnlock()
+
+	return t.decode(value), stale, true
+}
+
+// keepTombstones enables tombstones, widening an existing window.
+func (t *timedMap) keepTombstones(window time.Duration, values bool) {
+	if window <= 0 {
+		return
+	}
+	if t.tombs == nil {
+		t.tombs = &tombstones{at: make(map[any]tombstone)}
+	}
+	t.tombs.window = max(t.tombs.window, int64(window))
+	t.tombs.values = t.tombs.values || values
+}
+
+// tombstone returns the tombstone of key if it is within the window.
+// Callers must hold mu.
+func (t *timedMap) tombstone(key any) (tombstone, bool) {
+	if t.tombs == nil {
+		return tombstone{}, false
+	}
+	ts, ok := t.tombs.at[key]
+	if !ok || time.Now().UnixNano()-ts.at > t.tombs.window {
+		return tombstone{}, false
+	}
+	return ts, true
+}
+
+// bury records that el expired at now and prunes tombstones older than
+// the window. Callers must hold mu.
+func (t *timedMap) bury(el *element, now int64) {
+	ts := t.tombs
+	key := el.Key
+	if ts.values {
+		ts.at[key] = tombstone{at: now, value: el.Value}
+	} else {
+		ts.at[key] = tombstone{at: now}
+	}
+	ts.queue = append(ts.queue, tombstoneMark{key, now})
+
+	n := 0
+	for n < len(ts.queue) && now-ts.queue[n].at > ts.window {
+		m := ts.queue[n]
+		// A key that expired again later has a newer mark.
+		if ts.at[m.key].at == m.at {
+			delete(ts.at, m.key)
+		}
+		n++
+	}
+	if n > 0 {
+		clear(ts.queue[:n])
+		ts.queue = ts.queue[n:]
+	}
+}
+
+// unbury drops the tombstone of key. Callers must hold mu.
+func (t *timedMap) unbury(key any) {
+	if t.tombs != nil {
+		delete(t.tombs.at, key)
+	}
+}
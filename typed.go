@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Specialized maps
+// --------------------------------------------------------------------
+
+// StringMap is a timed map with string keys and values of type V. Keys
+// and values are stored unboxed, so writes and reads do not allocate
+// interfaces. It supports the core TimedMap operations only.
+type StringMap[V any] struct {
+	typedMap[string, V]
+}
+
+// Int64Map is a timed map with int64 keys and values of type V, see
+// StringMap.
+type Int64Map[V any] struct {
+	typedMap[int64, V]
+}
+
+// NewStringMap creates a StringMap with a background cleaner.
+func NewStringMap[V any](onExpire func(key string, val V)) *StringMap[V] {
+	m := &StringMap[V]{}
+	m.init(onExpire)
+	return m
+}
+
+// NewInt64Map creates an Int64Map with a background cleaner.
+func NewInt64Map[V any](onExpire func(key int64, val V)) *Int64Map[V] {
+	m := &Int64Map[V]{}
+	m.init(onExpire)
+	return m
+}
+
+type typedElement[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt int64 // UnixNano, ElementPermanent if none
+	index     int   // heap index, -1 if permanent
+}
+
+type typedHeap[K comparable, V any] []*typedElement[K, V]
+
+func (h typedHeap[K, V]) Len() int           { return len(h) }
+func (h typedHeap[K, V]) Less(i, j int) bool { return h[i].expiresAt < h[j].expiresAt }
+func (h typedHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *typedHeap[K, V]) Push(x any) {
+	el := x.(*typedElement[K, V])
+	el.index = len(*h)
+	*h = append(*h, el)
+}
+
+func (h *typedHeap[K, V]) Pop() any {
+	old := *h
+	n := len(old)
+	el := old[n-1]
+	old[n-1] = nil
+	el.index = -1
+	*h = old[:n-1]
+	return el
+}
+
+// typedMap implements StringMap and Int64Map.
+type typedMap[K comparable, V any] struct {
+	mu       sync.RWMutex
+	items    map[K]*typedElement[K, V]
+	expHeap  typedHeap[K, V]
+	onExpire func(key K, val V)
+
+	nextWake  int64 // guarded by mu
+	wake      chan struct{}
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func (m *typedMap[K, V]) init(onExpire func(key K, val V)) {
+	m.items = make(map[K]*typedElement[K, V])
+	m.onExpire = onExpire
+	m.nextWake = math.MaxInt64
+	m.wake = make(chan struct{}, 1)
+	m.stop = make(chan struct{})
+	m.wg.Add(1)
+	go m.runCleaner()
+}
+
+// SetTemporary sets a key with explicit expiration time. The zero time
+// makes the key permanent.
+func (m *typedMap[K, V]) SetTemporary(key K, value V, expiresAt time.Time) {
+	m.set(key, value, deadlineNano(expiresAt))
+}
+
+// SetWithTTL sets a key that expires after the given TTL duration.
+func (m *typedMap[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	if ttl <= 0 {
+		m.SetPermanent(key, value)
+		return
+	}
+	m.SetTemporary(key, value, time.Now().Add(ttl))
+}
+
+// SetPermanent sets a key that never expires.
+func (m *typedMap[K, V]) SetPermanent(key K, value V) {
+	m.set(key, value, ElementPermanent)
+}
+
+// Get retrieves a value and its expiration.
+func (m *typedMap[K, V]) Get(key K) (V, int64, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	el, ok := m.items[key]
+	if !ok {
+		var zero V
+		return zero, ElementDoesntExist, false
+	}
+	return el.value, el.expiresAt, true
+}
+
+// Remove deletes a key.
+func (m *typedMap[K, V]) Remove(key K) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.items[key]; ok {
+		delete(m.items, key)
+		if el.index >= 0 {
+			heap.Remove(&m.expHeap, el.index)
+		}
+	}
+}
+
+// Size returns current number of items.
+func (m *typedMap[K, V]) Size() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.items)
+}
+
+// Close stops the cleaner and waits for it to exit.
+func (m *typedMap[K, V]) Close() {
+	m.closeOnce.Do(func() { close(m.stop) })
+	m.wg.Wait()
+}
+
+func (m *typedMap[K, V]) set(key K, value V, exp int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.items[key]
+	if !ok {
+		el = &typedElement[K, V]{key: key, index: -1}
+		m.items[key] = el
+	}
+	el.value = value
+	el.expiresAt = exp
+
+	switch {
+	case exp == ElementPermanent:
+		if el.index >= 0 {
+			heap.Remove(&m.expHeap, el.index)
+		}
+		return
+	case el.index < 0:
+		heap.Push(&m.expHeap, el)
+	default:
+		heap.Fix(&m.expHeap, el.index)
+	}
+
+	if exp < m.nextWake {
+		m.nextWake = exp
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (m *typedMap[K, V]) runCleaner() {
+	defer m.wg.Done()
+
+	timer := time.NewTimer(cleanerIdleWait)
+	defer timer.Stop()
+
+	for {
+		wait := m.sweep()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-m.wake:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// sweep removes due entries, starts their callbacks and returns the time
+// until the next deadline.
+func (m *typedMap[K, V]) sweep() time.Duration {
+	m.mu.Lock()
+	now := time.Now().UnixNano()
+	var expired []*typedElement[K, V]
+	for len(m.expHeap) > 0 && m.expHeap[0].expiresAt <= now {
+		el := heap.Pop(&m.expHeap).(*typedElement[K, V])
+		delete(m.items, el.key)
+		expired = append(expired, el)
+	}
+	wait := cleanerIdleWait
+	m.nextWake = math.MaxInt64
+	if len(m.expHeap) > 0 {
+		m.nextWake = m.expHeap[0].expiresAt
+		wait = time.Duration(m.nextWake - now)
+	}
+	m.mu.Unlock()
+
+	if m.onExpire != nil {
+		for _, el := range expired {
+			go m.onExpire(el.key, el.value)
+		}
+	}
+	return wait
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"crypto/rand"
+	"slices"
+)
+
+// --------------------------------------------------------------------
+// Stored value encoding (compression, encryption)
+// --------------------------------------------------------------------
+
+// storedValue is the in-memory form of a []byte or string value that
+// went through compression and/or encryption.
+type storedValue struct {
+	data       []byte
+	str        bool // original value was a string
+	compressed bool
+	encrypted  bool // data is nonce || ciphertext
+}
+
+// encode converts a caller value into its stored form.
+func (t *timedMap) encode(v any) any {
+	if t.codec == nil && t.aead == nil {
+		if b, ok := v.([]byte); ok && t.arena != nil {
+			if ref := t.arena.alloc(b); ref != nil {
+				return ref
+			}
+		}
+		return v
+	}
+
+	sv := &storedValue{}
+	switch x := v.(type) {
+	case []byte:
+		sv.data = x
+	case string:
+		sv.data, sv.str = []byte(x), true
+	default:
+		return v
+	}
+
+	if t.codec != nil && len(sv.data) >= t.codecThreshold {
+		if data, err := t.codec.Compress(sv.data); err == nil && len(data) < len(sv.data) {
+			sv.data, sv.compressed = data, true
+		}
+	}
+
+	if t.aead != nil {
+		nonce := make([]byte, t.aead.NonceSize(), t.aead.NonceSize()+len(sv.data)+t.aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			panic("temap: reading nonce: " + err.Error())
+		}
+		sv.data, sv.encrypted = t.aead.Seal(nonce, nonce, sv.data, nil), true
+	}
+
+	if !sv.compressed && !sv.encrypted {
+		return v
+	}
+	return sv
+}
+
+// decode converts a stored value back into the caller's value. Values
+// that cannot be decoded are counted in Stats and reported as nil.
+func (t *timedMap) decode(v any) any {
+	if ref, ok := v.(*arenaRef); ok {
+		return ref.bytes()
+	}
+	sv, ok := v.(*storedValue)
+	if !ok {
+		return v
+	}
+
+	data := sv.data
+	var err error
+	if sv.encrypted {
+		n := t.aead.NonceSize()
+		if len(data) < n {
+			t.decodeErrors.Add(1)
+			return nil
+		}
+		if data, err = t.aead.Open(nil, data[:n], data[n:], nil); err != nil {
+			t.decodeErrors.Add(1)
+			return nil
+		}
+	}
+	if sv.compressed {
+		if data, err = t.codec.Decompress(data); err != nil {
+			t.decodeErrors.Add(1)
+			return nil
+		}
+	}
+
+	if sv.str {
+		return string(data)
+	}
+	return data
+}
+
+// sealed is decode for values that leave the map in bulk, as in
+// snapshots and dumps: encrypted values keep their stored form,
+// nonce || ciphertext, so that the plaintext is never written out.
+func (t *timedMap) sealed(v any) any {
+	if sv, ok := v.(*storedValue); ok && sv.encrypted {
+		return slices.Clone(sv.data)
+	}
+	return t.decode(v)
+}
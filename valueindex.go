@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "reflect"
+
+// --------------------------------------------------------------------
+// Reverse lookup by value
+// --------------------------------------------------------------------
+
+// valueIndex maps what extract returns for a value to the keys holding
+// such a value, see WithValueIndex.
+type valueIndex struct {
+	extract func(value any) any
+	keys    map[any]map[any]struct{}
+}
+
+// WithValueIndex keeps an index from values to the keys holding them, so
+// KeysForValue needs no scan. Values are indexed by what extract returns
+// for them, such as a user ID for session objects, or by themselves if
+// extract is nil. Values for which that is not comparable are not
+// indexed. Every write pays for a map update, and for decoding the value
+// with WithCompression or WithEncryption.
+func WithValueIndex(extract func(value any) any) Option {
+	return func(t *TimedMap) {
+		if extract == nil {
+			extract = func(value any) any { return value }
+		}
+		t.values = &valueIndex{extract: extract, keys: make(map[any]map[any]struct{})}
+	}
+}
+
+// KeysForValue returns the keys whose value indexes as v, see
+// WithValueIndex, in no particular order. Without a value index it scans
+// the map, comparing values with ==.
+func (t *timedMap) KeysForValue(v any) []any {
+	t.rlock()
+	defer t.mu.RUnlock()
+
+	if !isComparable(v) {
+		return nil
+	}
+	var keys []any
+	if t.values != nil {
+		for k := range t.values.keys[v] {
+			keys = append(keys, k)
+		}
+		return keys
+	}
+	for k, el := range t.items {
+		if val := t.decode(el.Value); isComparable(val) && val == v {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// isComparable reports whether v can be compared with == without panicking.
+func isComparable(v any) bool {
+	return v != nil && reflect.ValueOf(v).Comparable()
+}
+
+// indexValue adds el to the value index. Callers must hold mu.
+func (t *timedMap) indexValue(el *element) {
+	if t.values == nil {
+		return
+	}
+	v := t.values.extract(t.decode(el.Value))
+	if !isComparable(v) {
+		el.valueKey = nil
+		return
+	}
+	el.valueKey = v
+	keys := t.values.keys[v]
+	if keys == nil {
+		keys = make(map[any]struct{})
+		t.values.keys[v] = keys
+	}
+	keys[el.Key] = struct{}{}
+}
+
+// unindexValue drops el from the value index. Callers must hold mu.
+func (t *timedMap) unindexValue(el *element) {
+	if t.values == nil || el.valueKey == nil {
+		return
+	}
+	keys := t.values.keys[el.valueKey]
+	delete(keys, el.Key)
+	if len(keys) == 0 {
+		delete(t.values.keys, el.valueKey)
+	}
+	el.valueKey = nil
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"runtime/debug"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Expiry verdicts
+// --------------------------------------------------------------------
+
+// Verdict is what WithExpiryDecider says should happen to an entry that
+// reached its deadline: Drop, Persist or Renew.
+type Verdict time.Duration
+
+const (
+	// Drop lets the entry expire as usual.
+	Drop Verdict = 0
+	// Persist makes the entry permanent.
+	Persist Verdict = -1
+)
+
+// Renew keeps the entry for ttl more. A ttl <= 0 drops it.
+func Renew(ttl time.Duration) Verdict {
+	if ttl <= 0 {
+		return Drop
+	}
+	return Verdict(ttl)
+}
+
+// WithExpiryDecider has decide rule on every entry that reaches its
+// deadline before it is removed. Until decide returns, the entry stays
+// in the map, unscheduled; the verdict is then applied under the lock,
+// unless the entry was overwritten, removed or given a new deadline
+// meanwhile, in which case that change wins. Dropped entries expire with
+// the usual callback and events. decide runs on the cleaner goroutine,
+// one entry at a time, so it must be quick; if it panics, the entry is
+// dropped.
+func WithExpiryDecider(decide func(key, value any) Verdict) Option {
+	return func(t *TimedMap) {
+		t.decide = decide
+	}
+}
+
+// WithPreExpiryHook has hook consulted just before an entry expires; if
+// it returns ok with a positive extend, the entry stays for extend more,
+// which suits entries that must not expire while still referenced. It is
+// a WithExpiryDecider that can only Renew or Drop, and the two options
+// replace each other.
+func WithPreExpiryHook(hook func(key, value any) (extend time.Duration, ok bool)) Option {
+	return WithExpiryDecider(func(key, value any) Verdict {
+		if extend, ok := hook(key, value); ok {
+			return Renew(extend)
+		}
+		return Drop
+	})
+}
+
+// pendingVerdict is an entry waiting for its verdict, with its key and
+// value as of the deadline.
+type pendingVerdict struct {
+	el         *element
+	key, value any
+}
+
+// awaitVerdicts parks due elements, which are no longer scheduled, until
+// decide has ruled on them. Callers must hold mu.
+func (t *timedMap) awaitVerdicts(els []*element) {
+	if len(els) == 0 {
+		return
+	}
+	pending := make([]pendingVerdict, len(els))
+	for i, el := range els {
+		el.deciding = true
+		pending[i] = pendingVerdict{el, el.Key, el.Value}
+	}
+	t.after(func() { t.applyVerdicts(pending) })
+}
+
+// applyVerdicts asks decide about each pending entry and applies the
+// verdicts to those still waiting.
+func (t *timedMap) applyVerdicts(pending []pendingVerdict) {
+	verdicts := make([]Verdict, len(pending))
+	for i, p := range pending {
+		verdicts[i] = t.verdict(p.key, p.value)
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	var drop []*element
+	for i, p := range pending {
+		el := p.el
+		if !el.deciding || !t.live(el) {
+			continue
+		}
+		switch v := verdicts[i]; {
+		case v == Persist:
+			t.setDeadline(el, ElementPermanent)
+		case v > 0:
+			t.setDeadline(el, t.ticks(t.now().Add(time.Duration(v))))
+		case t.frozen || t.closed:
+			t.setDeadline(el, t.nowTicks()) // expires after Unfreeze, if ever
+		default:
+			el.deciding = false
+			drop = append(drop, el)
+		}
+	}
+	t.expire(drop, time.Now().UnixNano())
+}
+
+// verdict calls decide, dropping the entry if it panics.
+func (t *timedMap) verdict(key, value any) (v Verdict) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.logf("temap: expiry decider panic for key %v: %v\n%s", key, r, debug.Stack())
+			v = Drop
+		}
+	}()
+	return t.decide(key, t.decode(value))
+}
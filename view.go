@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+// --------------------------------------------------------------------
+// Read-only views
+// --------------------------------------------------------------------
+
+// ROView is the read-only subset of a TimedMap, see ReadOnly.
+type ROView interface {
+	Get(key any) (value any, expiresAt int64, ok bool)
+	Keys() []any
+	Size() int
+	Stats() map[string]uint64
+}
+
+// ReadOnly returns a view of the map that can be handed to components
+// that must not change or stop it. The view does not unwrap to the map,
+// not even with a type assertion. The view keeps the map from being
+// abandoned, see LeakedMaps.
+func (t *TimedMap) ReadOnly() ROView {
+	return roView{t}
+}
+
+// roView hides every method of the map but those of ROView.
+type roView struct {
+	t *TimedMap
+}
+
+func (v roView) Get(key any) (any, int64, bool) { return v.t.Get(key) }
+func (v roView) Keys() []any                    { return v.t.Keys() }
+func (v roView) Size() int                      { return v.t.Size() }
+func (v roView) Stats() map[string]uint64       { return v.t.Stats() }
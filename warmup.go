@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Warm-up loading
+// --------------------------------------------------------------------
+
+// WarmupFunc pre-populates a new map by calling add for each entry. A
+// ttl <= 0 adds a permanent entry.
+type WarmupFunc func(add func(key, value any, ttl time.Duration)) error
+
+// WithWarmup runs fn during New, which returns once fn has.
+func WithWarmup(fn WarmupFunc) Option {
+	return func(t *TimedMap) {
+		t.warmup, t.warmAsync = fn, false
+	}
+}
+
+// WithAsyncWarmup runs fn on its own goroutine started by New, so the map
+// can serve traffic while it loads; wait on Ready before relying on the
+// preloaded entries. Keys written meanwhile are not overwritten by fn.
+func WithAsyncWarmup(fn WarmupFunc) Option {
+	return func(t *TimedMap) {
+		t.warmup, t.warmAsync = fn, true
+	}
+}
+
+// NewFromSnapshot is New for a map preloaded from the file at path,
+// written by Export. The map serves traffic at once while the file is
+// imported in the background, like WithAsyncWarmup: entries that expired
+// meanwhile are skipped, and keys written before their entry is read
+// keep the newer value. Ready and WarmupErr report on the import.
+func NewFromSnapshot(path string, onExpire func(key, val any), opts ...Option) *TimedMap {
+	load := func(t *TimedMap) {
+		tm := t.timedMap // not t, which would keep the map from being abandoned
+		t.warmAsync = true
+		t.warmup = func(func(key, value any, ttl time.Duration)) error {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return tm.importStream(bufio.NewReader(f), false)
+		}
+	}
+	return New(onExpire, append(opts[:len(opts):len(opts)], load)...)
+}
+
+// Ready returns a channel that is closed once the warm-up function has
+// returned, see WithWarmup. It is closed from the start without one.
+func (t *timedMap) Ready() <-chan struct{} {
+	return t.ready
+}
+
+// WarmupErr returns the error of the warm-up function once Ready is
+// closed, and nil before that.
+func (t *timedMap) WarmupErr() error {
+	select {
+	case <-t.ready:
+		return t.warmErr
+	default:
+		return nil
+	}
+}
+
+// startWarmup runs the warm-up function, if any, and closes ready.
+func (t *timedMap) startWarmup() {
+	t.ready = make(chan struct{})
+	if t.warmup == nil {
+		close(t.ready)
+		return
+	}
+	if !t.warmAsync {
+		t.runWarmup()
+		return
+	}
+	goLabeled(t.labels.async, t.runWarmup)
+}
+
+func (t *timedMap) runWarmup() {
+	defer close(t.ready)
+	defer func() {
+		if r := recover(); r != nil {
+			t.warmErr = fmt.Errorf("temap: warm-up panic: %v", r)
+		}
+		if t.warmErr != nil {
+			t.logf("temap: warm-up failed: %v", t.warmErr)
+		}
+	}()
+	t.warmErr = t.warmup(t.warmAdd)
+}
+
+// warmAdd stores an entry for the warm-up function unless the key exists.
+func (t *timedMap) warmAdd(key, value any, ttl time.Duration) {
+	value = t.encode(value)
+	exp := int64(ElementPermanent)
+	if ttl > 0 {
+		exp = t.ticks(t.now().Add(ttl))
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		t.free(value)
+		return
+	}
+
+	if _, ok := t.items[key]; ok {
+		t.free(value)
+		return
+	}
+	t.set(key, value, exp)
+}
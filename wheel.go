@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import "fmt"
+
+// --------------------------------------------------------------------
+// Timing wheel scheduler
+// --------------------------------------------------------------------
+
+// wheelScheduler is a hashed timing wheel: deadlines are bucketed into
+// ticks of res deadline units and ticks map onto a fixed ring of slots.
+// Adding and cancelling are O(1); a slot may hold elements of later
+// rotations, which are skipped until their round comes up.
+type wheelScheduler struct {
+	res    int64 // tick width in deadline units
+	slots  [][]*element
+	cursor int64 // last tick whose slot is known to hold nothing due
+	n      int
+}
+
+func newWheelScheduler(res int64, slots int, now int64) *wheelScheduler {
+	if res <= 0 {
+		res = 1
+	}
+	if slots <= 0 {
+		slots = defaultWheelSlots
+	}
+	return &wheelScheduler{
+		res:    res,
+		slots:  make([][]*element, slots),
+		cursor: now/res - 1,
+	}
+}
+
+// defaultWheelSlots is the ring size used when none is configured.
+const defaultWheelSlots = 1024
+
+func (s *wheelScheduler) add(el *element) {
+	tick := el.ExpiresAt / s.res
+	if tick <= s.cursor {
+		tick = s.cursor + 1
+	}
+	i := tick % int64(len(s.slots))
+	el.slot = i
+	el.index = len(s.slots[i])
+	s.slots[i] = append(s.slots[i], el)
+	s.n++
+}
+
+func (s *wheelScheduler) update(el *element) {
+	s.cancel(el)
+	s.add(el)
+}
+
+func (s *wheelScheduler) cancel(el *element) {
+	if el.index < 0 {
+		return
+	}
+	slot := s.slots[el.slot]
+	last := len(slot) - 1
+	slot[el.index] = slot[last]
+	slot[el.index].index = el.index
+	slot[last] = nil
+	s.slots[el.slot] = slot[:last]
+	el.index = -1
+	s.n--
+}
+
+// next returns the earliest deadline among the elements of the first
+// non-empty slot that belong to the current rotation.
+func (s *wheelScheduler) next() (int64, bool) {
+	if s.n == 0 {
+		return 0, false
+	}
+
+	size := int64(len(s.slots))
+	for tick := s.cursor + 1; tick <= s.cursor+size; tick++ {
+		end := (tick + 1) * s.res
+		best, found := int64(0), false
+		for _, el := range s.slots[tick%size] {
+			if el.ExpiresAt < end && (!found || el.ExpiresAt < best) {
+				best, found = el.ExpiresAt, true
+			}
+		}
+		if found {
+			return best, true
+		}
+	}
+
+	// Everything is at least one full rotation away.
+	return (s.cursor + size + 1) * s.res, true
+}
+
+func (s *wheelScheduler) popDue(now int64, limit int) []*element {
+	var due []*element
+
+	size := int64(len(s.slots))
+	nowTick := now / s.res
+	last := min(nowTick, s.cursor+size)
+	for tick := s.cursor + 1; tick <= last; tick++ {
+		i := tick % size
+		for j := 0; j < len(s.slots[i]); {
+			el := s.slots[i][j]
+			if el.ExpiresAt > now {
+				j++
+				continue
+			}
+			if limit == 0 {
+				return due
+			}
+			s.cancel(el) // moves the last element into j
+			due = append(due, el)
+			limit--
+		}
+		// The current tick may still receive entries due later in it.
+		if tick < nowTick {
+			s.cursor = tick
+		}
+	}
+	if nowTick-1 > s.cursor {
+		s.cursor = nowTick - 1
+	}
+	return due
+}
+
+func (s *wheelScheduler) len() int { return s.n }
+
+func (s *wheelScheduler) holds(el *element) bool {
+	if el.index < 0 || el.slot < 0 || el.slot >= int64(len(s.slots)) {
+		return false
+	}
+	slot := s.slots[el.slot]
+	return el.index < len(slot) && slot[el.index] == el
+}
+
+// check verifies that every element knows its slot and that n counts
+// them.
+func (s *wheelScheduler) check() error {
+	n := 0
+	for i, slot := range s.slots {
+		for j, el := range slot {
+			if el.slot != int64(i) || el.index != j {
+				return fmt.Errorf("wheel slot %d/%d holds key %v, which thinks it is at %d/%d", i, j, el.Key, el.slot, el.index)
+			}
+		}
+		n += len(slot)
+	}
+	if n != s.n {
+		return fmt.Errorf("wheel holds %d elements but counts %d", n, s.n)
+	}
+	return nil
+}
+
+func (s *wheelScheduler) each(fn func(el *element) bool) {
+	for _, slot := range s.slots {
+		for _, el := range slot {
+			if !fn(el) {
+				return
+			}
+		}
+	}
+}
+
+func (s *wheelScheduler) reset() {
+	for i, slot := range s.slots {
+		for _, el := range slot {
+			el.index = -1
+		}
+		clear(slot)
+		s.slots[i] = slot[:0]
+	}
+	s.n = 0
+}
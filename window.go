@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2020 Firas M. Darwish ( https://firas.dev.sy )
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package temap
+
+import (
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------
+// Sliding-window counter
+// --------------------------------------------------------------------
+
+// Window counts events per key over sliding time windows, the building
+// block of rate limiters. Counts are kept in buckets of a fixed width;
+// the buckets of a key share one entry of a TimedMap that expires once
+// its newest bucket is older than span, the widest window Count can be
+// asked about.
+type Window struct {
+	m      *TimedMap
+	bucket int64 // bucket width in nanoseconds
+	span   time.Duration
+}
+
+// windowBuckets holds the live buckets of one key, oldest first. It has
+// its own lock so Count and IncrBy don't walk buckets under the map's.
+type windowBuckets struct {
+	mu    sync.Mutex
+	slots []windowBucket
+}
+
+// windowBucket is the count of the bucket starting at slot*bucket.
+type windowBucket struct {
+	slot, n int64
+}
+
+// NewWindow creates a Window with buckets of width bucket that keeps
+// counts for span. Count is exact to within one bucket.
+func NewWindow(bucket, span time.Duration, opts ...Option) *Window {
+	bucket = max(bucket, time.Millisecond)
+	return &Window{
+		m:      New(nil, opts...),
+		bucket: int64(bucket),
+		span:   max(span, bucket),
+	}
+}
+
+// Incr counts one event for key and returns the count of the current
+// bucket.
+func (w *Window) Incr(key any) int64 {
+	return w.IncrBy(key, 1)
+}
+
+// IncrBy counts n events for key and returns the count of the current
+// bucket. It counts nothing and returns 0 while the window's map is
+// frozen or closed.
+func (w *Window) IncrBy(key any, n int64) int64 {
+	t := w.m.timedMap
+	now := t.now()
+	slot := now.UnixNano() / w.bucket
+
+	// Adding to the current bucket needs no new deadline.
+	t.rlock()
+	if el, ok := t.items[key]; ok && !t.frozen && !t.closed {
+		if c, ok := el.Value.(*windowBuckets).addCurrent(slot, n); ok {
+			t.mu.RUnlock()
+			return c
+		}
+	}
+	t.mu.RUnlock()
+
+	t.lock()
+	defer t.unlock()
+
+	if t.rejectWrite() {
+		return 0
+	}
+	end := time.Unix(0, (slot+1)*w.bucket)
+	exp := t.ticks(end.Add(w.span))
+	if el, ok := t.items[key]; ok {
+		c := el.Value.(*windowBuckets).add(slot, n, w.oldest(slot))
+		t.setDeadline(el, exp)
+		return c
+	}
+	b := &windowBuckets{slots: []windowBucket{{slot, n}}}
+	t.set(key, b, exp)
+	return n
+}
+
+// Count returns the number of events counted for key within the last
+// window, which is capped at the span of w. The oldest bucket is counted
+// in full even if the window only covers part of it.
+func (w *Window) Count(key any, window time.Duration) int64 {
+	t := w.m.timedMap
+	window = min(window, w.span)
+	now := t.now().UnixNano()
+	first := (now - int64(window)) / w.bucket
+
+	t.rlock()
+	el, ok := t.items[key]
+	var b *windowBuckets
+	if ok {
+		b = el.Value.(*windowBuckets)
+	}
+	t.mu.RUnlock()
+	if b == nil {
+		return 0
+	}
+	return b.since(first, now/w.bucket)
+}
+
+// oldest is the first slot any Count can still ask about once slot is
+// the current one.
+func (w *Window) oldest(slot int64) int64 {
+	return slot - int64(w.span)/w.bucket - 1
+}
+
+// addCurrent adds n to the bucket of slot if it is the newest one.
+func (b *windowBuckets) addCurrent(slot, n int64) (int64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if last := len(b.slots) - 1; last >= 0 && b.slots[last].slot == slot {
+		b.slots[last].n += n
+		return b.slots[last].n, true
+	}
+	return 0, false
+}
+
+// add adds n to the bucket of slot, opening it if needed and dropping
+// buckets before oldest.
+func (b *windowBuckets) add(slot, n, oldest int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if last := len(b.slots) - 1; last >= 0 && b.slots[last].slot >= slot {
+		// A clock step back lands in the newest bucket.
+		b.slots[last].n += n
+		return b.slots[last].n
+	}
+	i := 0
+	for i < len(b.slots) && b.slots[i].slot < oldest {
+		i++
+	}
+	b.slots = append(b.slots[:copy(b.slots, b.slots[i:])], windowBucket{slot, n})
+	return n
+}
+
+// since sums the buckets from first to last, walking back from the
+// newest.
+func (b *windowBuckets) since(first, last int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var n int64
+	for i := len(b.slots) - 1; i >= 0 && b.slots[i].slot >= first; i-- {
+		if b.slots[i].slot <= last {
+			n += b.slots[i].n
+		}
+	}
+	return n
+}
+
+// Map returns the TimedMap holding the buckets, for stats and cleaner
+// control.
+func (w *Window) Map() *TimedMap {
+	return w.m
+}
+
+// Close stops the window's cleaner, see TimedMap.Close.
+func (w *Window) Close() {
+	w.m.Close()
+}